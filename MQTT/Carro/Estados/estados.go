@@ -0,0 +1,159 @@
+package estados
+
+// Máquina de estados da reserva do lado do carro. Não depende de MQTT: o carro traduz
+// as mensagens recebidas em eventos e só age quando a transição é aceita, ignorando
+// respostas que chegam fora de hora (ex: um status de reserva repetido).
+
+import (
+	"fmt"
+	"sync"
+)
+
+type Estado string
+
+const (
+	Ocioso           Estado = "ocioso"
+	SolicitandoRotas Estado = "solicitando_rotas"
+	EscolhendoRota   Estado = "escolhendo_rota"
+	Reservando       Estado = "reservando"
+	NaListaEspera    Estado = "lista_espera"
+	Reservado        Estado = "reservado"
+	Carregando       Estado = "carregando"
+	Concluido        Estado = "concluido"
+	Cancelado        Estado = "cancelado"
+)
+
+type Evento string
+
+const (
+	PedirRotas       Evento = "pedir_rotas"
+	RotasRecebidas   Evento = "rotas_recebidas"
+	SemRotas         Evento = "sem_rotas" // Nenhuma rota viável; conta como tentativa
+	RotaEscolhida    Evento = "rota_escolhida"
+	EscolhaCancelada Evento = "escolha_cancelada"
+	ReservaOK        Evento = "reserva_ok"
+	ReservaErro      Evento = "reserva_erro" // 2PC abortado; conta como tentativa
+	ListaEspera      Evento = "lista_espera"
+	Promovido        Evento = "promovido"
+	Retomar          Evento = "retomar" // Reserva restaurada do perfil
+	RecargaIniciada  Evento = "recarga_iniciada"
+	ParadaConcluida  Evento = "parada_concluida"
+	ViagemConcluida  Evento = "viagem_concluida"
+	ReservaPerdida   Evento = "reserva_perdida" // Expirada ou descartada pelo coordenador
+	Cancelar         Evento = "cancelar"
+)
+
+// Eventos que consomem uma tentativa: voltam a pedir rotas enquanto houver tentativas
+var eventosComNovaTentativa = map[Evento]bool{SemRotas: true, ReservaErro: true}
+
+// Estados finais aceitam o mesmo que Ocioso
+var inicio = map[Evento]Estado{
+	PedirRotas: SolicitandoRotas,
+	Retomar:    Reservado,
+}
+
+var transicoes = map[Estado]map[Evento]Estado{
+	Ocioso:    inicio,
+	Concluido: inicio,
+	Cancelado: inicio,
+	SolicitandoRotas: {
+		RotasRecebidas: EscolhendoRota,
+		Cancelar:       Cancelado,
+	},
+	EscolhendoRota: {
+		RotaEscolhida:    Reservando,
+		EscolhaCancelada: Ocioso,
+		SemRotas:         SolicitandoRotas,
+		Cancelar:         Cancelado,
+	},
+	Reservando: {
+		ReservaOK:   Reservado,
+		ReservaErro: SolicitandoRotas,
+		ListaEspera: NaListaEspera,
+		Cancelar:    Cancelado,
+	},
+	NaListaEspera: {
+		Promovido: Reservando, // Abriu vaga: a rota é reservada de novo pelo 2PC
+		Cancelar:  Cancelado,
+	},
+	Reservado: {
+		RecargaIniciada: Carregando,
+		ParadaConcluida: Reservado, // A recarga pode terminar antes do aviso de início chegar
+		ViagemConcluida: Concluido,
+		ReservaPerdida:  Cancelado,
+		Cancelar:        Cancelado,
+	},
+	Carregando: {
+		ParadaConcluida: Reservado,
+		ViagemConcluida: Concluido,
+		ReservaPerdida:  Cancelado,
+		Cancelar:        Cancelado,
+	},
+}
+
+// Mudança de estado aplicada por Disparar
+type Transicao struct {
+	De     Estado
+	Para   Estado
+	Evento Evento
+}
+
+func (t Transicao) String() string {
+	return fmt.Sprintf("%s → %s (%s)", t.De, t.Para, t.Evento)
+}
+
+type Maquina struct {
+	mutex         sync.Mutex
+	estado        Estado
+	tentativas    int // Pedidos de rota feitos na viagem atual
+	maxTentativas int
+}
+
+// Cria a máquina em Ocioso. maxTentativas limita os pedidos de rota por viagem (mínimo 1).
+func NovaMaquina(maxTentativas int) *Maquina {
+	return &Maquina{estado: Ocioso, maxTentativas: max(maxTentativas, 1)}
+}
+
+func (m *Maquina) Estado() Estado {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.estado
+}
+
+func (m *Maquina) Tentativas() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.tentativas
+}
+
+// Aplica o evento. Retorna a transição e false, sem mudar de estado, se o evento não é
+// esperado no estado atual. SemRotas e ReservaErro voltam a SolicitandoRotas enquanto
+// houver tentativas e vão para Ocioso quando elas acabam.
+func (m *Maquina) Disparar(evento Evento) (Transicao, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t := Transicao{De: m.estado, Para: m.estado, Evento: evento}
+	destino, ok := transicoes[m.estado][evento]
+	if !ok {
+		return t, false
+	}
+	switch {
+	case evento == PedirRotas:
+		m.tentativas = 1
+	case eventosComNovaTentativa[evento] && m.tentativas >= m.maxTentativas:
+		destino = Ocioso
+	case eventosComNovaTentativa[evento]:
+		m.tentativas++
+	case destino == Reservado || destino == Cancelado:
+		m.tentativas = 0
+	}
+	m.estado = destino
+	t.Para = destino
+	return t, true
+}
+
+// Indica se uma reserva está em andamento (reservado ou carregando)
+func (m *Maquina) ComReserva() bool {
+	estado := m.Estado()
+	return estado == Reservado || estado == Carregando
+}
@@ -0,0 +1,170 @@
+package estados
+
+import "testing"
+
+// Dispara os eventos em ordem, falhando se algum for recusado
+func disparar(t *testing.T, m *Maquina, eventos ...Evento) {
+	t.Helper()
+	for _, evento := range eventos {
+		if transicao, ok := m.Disparar(evento); !ok {
+			t.Fatalf("evento %s recusado em %s", evento, transicao.De)
+		}
+	}
+}
+
+func TestTransicoesValidas(t *testing.T) {
+	casos := []struct {
+		nome    string
+		eventos []Evento
+		final   Estado
+	}{
+		{"reserva", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK}, Reservado},
+		{"recarga", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, RecargaIniciada}, Carregando},
+		{"parada concluída", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, RecargaIniciada, ParadaConcluida}, Reservado},
+		{"fim antes do início", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, ParadaConcluida}, Reservado},
+		{"viagem concluída", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, RecargaIniciada, ViagemConcluida}, Concluido},
+		{"escolha cancelada", []Evento{PedirRotas, RotasRecebidas, EscolhaCancelada}, Ocioso},
+		{"reserva perdida", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, ReservaPerdida}, Cancelado},
+		{"cancelada na espera", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ListaEspera, Cancelar}, Cancelado},
+		{"nova viagem após concluir", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, ViagemConcluida, PedirRotas}, SolicitandoRotas},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			m := NovaMaquina(3)
+			disparar(t, m, caso.eventos...)
+			if estado := m.Estado(); estado != caso.final {
+				t.Errorf("estado %s, esperado %s", estado, caso.final)
+			}
+		})
+	}
+}
+
+func TestTransicoesRecusadas(t *testing.T) {
+	casos := []struct {
+		nome    string
+		eventos []Evento // Levam ao estado de partida
+		evento  Evento
+	}{
+		{"reserva ok em ocioso", nil, ReservaOK},
+		{"recarga em ocioso", nil, RecargaIniciada},
+		{"promovido em ocioso", nil, Promovido},
+		{"status repetido", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK}, ReservaOK},
+		{"novo pedido durante a reserva", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK}, PedirRotas},
+		{"retomar durante a reserva", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK}, Retomar},
+		{"promovido antes da espera", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida}, Promovido},
+		{"reserva ok na espera", []Evento{PedirRotas, RotasRecebidas, RotaEscolhida, ListaEspera}, ReservaOK},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			m := NovaMaquina(3)
+			disparar(t, m, caso.eventos...)
+			antes := m.Estado()
+			transicao, ok := m.Disparar(caso.evento)
+			if ok {
+				t.Fatalf("evento %s aceito: %s", caso.evento, transicao)
+			}
+			if transicao.De != antes || transicao.Para != antes || m.Estado() != antes {
+				t.Errorf("estado mudou de %s para %s em uma transição recusada", antes, m.Estado())
+			}
+		})
+	}
+}
+
+func TestComReserva(t *testing.T) {
+	m := NovaMaquina(1)
+	esperado := []struct {
+		evento     Evento
+		comReserva bool
+	}{
+		{PedirRotas, false},
+		{RotasRecebidas, false},
+		{RotaEscolhida, false},
+		{ReservaOK, true},
+		{RecargaIniciada, true},
+		{ParadaConcluida, true},
+		{ViagemConcluida, false},
+	}
+	if m.ComReserva() {
+		t.Fatal("máquina nova com reserva")
+	}
+	for _, passo := range esperado {
+		disparar(t, m, passo.evento)
+		if m.ComReserva() != passo.comReserva {
+			t.Errorf("após %s em %s: ComReserva = %v, esperado %v", passo.evento, m.Estado(), m.ComReserva(), passo.comReserva)
+		}
+	}
+}
+
+func TestRetomarReserva(t *testing.T) {
+	partidas := map[Estado][]Evento{
+		Ocioso:    nil,
+		Concluido: {PedirRotas, RotasRecebidas, RotaEscolhida, ReservaOK, ViagemConcluida},
+		Cancelado: {PedirRotas, Cancelar},
+	}
+	for partida, eventos := range partidas {
+		t.Run(string(partida), func(t *testing.T) {
+			m := NovaMaquina(3)
+			disparar(t, m, eventos...)
+			if m.Estado() != partida {
+				t.Fatalf("estado de partida %s, esperado %s", m.Estado(), partida)
+			}
+			disparar(t, m, Retomar)
+			if m.Estado() != Reservado || !m.ComReserva() {
+				t.Errorf("estado %s após retomar, esperado %s", m.Estado(), Reservado)
+			}
+		})
+	}
+}
+
+func TestTentativasAteOMaximo(t *testing.T) {
+	m := NovaMaquina(3)
+	disparar(t, m, PedirRotas, RotasRecebidas, RotaEscolhida)
+	if m.Tentativas() != 1 {
+		t.Fatalf("tentativas = %d, esperado 1", m.Tentativas())
+	}
+	// Abaixo do máximo, o 2PC abortado e a falta de rotas consomem uma tentativa e voltam
+	// a pedir rotas
+	disparar(t, m, ReservaErro)
+	if m.Estado() != SolicitandoRotas || m.Tentativas() != 2 {
+		t.Fatalf("estado %s com %d tentativa(s), esperado %s com 2", m.Estado(), m.Tentativas(), SolicitandoRotas)
+	}
+	disparar(t, m, RotasRecebidas, SemRotas)
+	if m.Estado() != SolicitandoRotas || m.Tentativas() != 3 {
+		t.Fatalf("estado %s com %d tentativa(s), esperado %s com 3", m.Estado(), m.Tentativas(), SolicitandoRotas)
+	}
+	// No máximo, o próximo erro desiste e volta para Ocioso
+	disparar(t, m, RotasRecebidas, RotaEscolhida, ReservaErro)
+	if m.Estado() != Ocioso {
+		t.Errorf("estado %s após esgotar as tentativas, esperado %s", m.Estado(), Ocioso)
+	}
+	// Um novo pedido recomeça a contagem
+	disparar(t, m, PedirRotas)
+	if m.Tentativas() != 1 {
+		t.Errorf("tentativas = %d após novo pedido, esperado 1", m.Tentativas())
+	}
+}
+
+func TestMinimoDeUmaTentativa(t *testing.T) {
+	m := NovaMaquina(0)
+	disparar(t, m, PedirRotas, RotasRecebidas, RotaEscolhida, ReservaErro)
+	if m.Estado() != Ocioso {
+		t.Errorf("estado %s, esperado %s com uma única tentativa", m.Estado(), Ocioso)
+	}
+}
+
+func TestPromovidoDaListaEspera(t *testing.T) {
+	m := NovaMaquina(3)
+	disparar(t, m, PedirRotas, RotasRecebidas, RotaEscolhida, ListaEspera)
+	if m.Estado() != NaListaEspera || m.ComReserva() {
+		t.Fatalf("estado %s, esperado %s sem reserva", m.Estado(), NaListaEspera)
+	}
+	transicao, ok := m.Disparar(Promovido)
+	if !ok || transicao.De != NaListaEspera || transicao.Para != Reservando {
+		t.Fatalf("transição %s, esperado %s → %s", transicao, NaListaEspera, Reservando)
+	}
+	// A rota é reservada de novo pelo 2PC do coordenador
+	disparar(t, m, ReservaOK)
+	if m.Estado() != Reservado {
+		t.Errorf("estado %s após o 2PC, esperado %s", m.Estado(), Reservado)
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	estados "MQTT/Carro/Estados"
+	ambiente "MQTT/utils/Ambiente"
 	consts "MQTT/utils/Constantes"
 	topics "MQTT/utils/Topicos"
 	clientemqtt "MQTT/utils/mqttLib/ClienteMQTT"
 	router "MQTT/utils/mqttLib/Router"
+	storage "MQTT/utils/storage"
 	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"net"
+	"math"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings" // Para lowercasing do comando do usuário
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -38,52 +43,99 @@ type Prompt struct {
 
 type Carro struct {
 	ID                string                 `json:"id"`
+	Modelo            string                 `json:"modelo"`
+	Proprietario      string                 `json:"proprietario"`
 	Bateria           float64                `json:"bateria"`
 	Clientemqtt       clientemqtt.MQTTClient `json:"-"`
-	X                 float64                `json:"x"`
-	Y                 float64                `json:"y"`
+	Lat               float64                `json:"lat"`
+	Lon               float64                `json:"lon"`
 	CapacidadeBateria float64                `json:"capacidadebateria"`
 	Consumobateria    float64                `json:"consumobateria"`
 	CidadeAtual       string                 `json:"cidadeatual"`
+	Conectores        []string               `json:"conectores"`
+	TaxaMaxCargaKW    float64                `json:"taxamaxcargakw"`
 	// Adicionado para a função solicitarRota
+	reservaPendente *consts.Reserva // Rota escolhida aguardando o resultado do 2PC
+	Reserva         *consts.Reserva `json:"-"` // Reserva confirmada pelo servidor
+	ParadaAtual     int             `json:"-"` // Índice da próxima parada da reserva
+	// Servidor que coordenou a reserva, consultado em "minhas reservas"
+	coordenadorID     string
+	coordenadorCidade string
+	ultimasRotas      map[string][]consts.Parada // Rotas oferecidas, usadas como alternativas ao trocar uma parada
+	ofertas           []OfertaRota               // Rotas oferecidas, na ordem numerada para a escolha
+	arquivoPerfil     string                     // Perfil persistente; vazio quando o ID vem do cenário
+	retomando         bool                       // Reserva restaurada do perfil ou após reconexão, aguardando a confirmação do coordenador
+	destino           string                     // Cidade de destino da viagem atual, usada nas novas tentativas
+	escalas           []consts.Escala            // Destinos intermediários da viagem atual
+	esperaDesde       time.Time                  // Entrada na lista de espera com a rota recusada em reservaPendente
+	estado            *estados.Maquina
+	// Posição, bateria e viagem mudam na goroutine da simulação
+	mutex  sync.Mutex
+	viagem estadoViagem
 }
 
-func (c *Carro) SolicitarReserva(rotas map[string][]consts.Parada, cidadeDestino string, serverID string) {
-
-	rotasIndexadas := []string{}
-	for nome, paradas := range rotas {
-		fmt.Printf("\n[%d] %s:\n", len(rotasIndexadas), nome)
-		for i, parada := range paradas {
-			fmt.Printf("  \t [%d] %s (ID: %s)\n", i+1, parada.NomePosto, parada.IDPosto)
-			fmt.Printf("      \t Localização: (X: %.2f, Y: %.2f)\n", parada.X, parada.Y)
-		}
-		rotasIndexadas = append(rotasIndexadas, nome)
+// Dados do carro no formato compartilhado com o servidor
+func (c *Carro) dadosCarro() consts.Carro {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return consts.Carro{
+		ID:                c.ID,
+		Bateria:           c.Bateria,
+		Lat:               c.Lat,
+		Lon:               c.Lon,
+		CapacidadeBateria: c.CapacidadeBateria,
+		Consumobateria:    c.Consumobateria,
+		Conectores:        c.Conectores,
+		TaxaMaxCargaKW:    c.TaxaMaxCargaKW,
 	}
+}
 
-	input := perguntarUsuario("Digite o número da rota desejada: ")
-	escolha, _ := strconv.Atoi(input)
+func (c *Carro) SolicitarReserva(rotas map[string][]consts.Parada, resumos map[string]consts.ResumoRota, cidadeDestino string, serverID string) {
+	c.ultimasRotas = rotas
+	ordem := ordemRotas()
+	ofertas := c.montarOfertas(rotas, resumos)
+	ordenarOfertas(ofertas, ordem)
+	c.ofertas = ofertas
 
-	if escolha < 0 || escolha >= len(rotasIndexadas) {
-		fmt.Println("❌ Escolha inválida.")
+	var nomeRotaEscolhida string
+	listaEspera := false
+	if len(ofertas) == 0 {
+		fmt.Println("❌ Nenhuma rota recebida.")
+		if c.transicao(estados.SemRotas) {
+			c.novaTentativa(EventoSemRotas)
+		}
 		return
+	}
+	if cenario != nil {
+		// Modo sem menu: a política do cenário escolhe a rota
+		c.mostrarOfertas(ofertas, ordem)
+		nomeRotaEscolhida = escolherOferta(ofertas, cenario.Politica)
+		listaEspera = cenario.ListaEspera
+	} else if politica := os.Getenv("POLITICA_ROTA"); politica != "" {
+		// Escolha automática também no menu
+		c.mostrarOfertas(ofertas, ordem)
+		nomeRotaEscolhida = escolherOferta(ofertas, politica)
+		listaEspera = strings.EqualFold(perguntarUsuario("Entrar na lista de espera se não houver vaga? (s/N): "), "s")
+	} else {
+		nomeRotaEscolhida = c.perguntarOferta(ofertas, ordem)
+		if nomeRotaEscolhida == "" {
+			fmt.Println("❌ Escolha inválida.")
+			c.transicao(estados.EscolhaCancelada)
+			return
 
+		}
+		listaEspera = strings.EqualFold(perguntarUsuario("Entrar na lista de espera se não houver vaga? (s/N): "), "s")
 	}
 
-	nomeRotaEscolhida := rotasIndexadas[escolha]
 	fmt.Printf("Você escolheu a rota: %s\n", nomeRotaEscolhida)
 	paradasEscolhidas := rotas[nomeRotaEscolhida]
 	// Enviar a rota escolhida para o servidor
 
 	reserva := consts.Reserva{
-		Carro: consts.Carro{
-			ID:                c.ID,
-			Bateria:           c.Bateria,
-			X:                 c.X,
-			Y:                 c.Y,
-			CapacidadeBateria: c.CapacidadeBateria,
-			Consumobateria:    c.Consumobateria,
-		},
-		Paradas: paradasEscolhidas,
+		Carro:       c.dadosCarro(),
+		Paradas:     paradasEscolhidas,
+		ListaEspera: listaEspera,
+		Escalas:     c.escalas,
 	}
 
 	ConteudoJSON, err := json.Marshal(reserva)
@@ -92,13 +144,17 @@ func (c *Carro) SolicitarReserva(rotas map[string][]consts.Parada, cidadeDestino
 		return
 	}
 
+	if !c.transicao(estados.RotaEscolhida) {
+		return
+	}
+	c.reservaPendente = &reserva
 	topic := topics.CarroRequestReserva(c.ID, serverID, cidadeDestino)
 	log.Println("[CARRO] Publicando solicitação de reserva no tópico: ", topic)
 	c.publicarAoServidor(ConteudoJSON, topic)
 }
 
 func (c *Carro) CancelarReserva() {
-	topic := topics.CarroSendsRechargeFinish(c.ID)
+	topic := topics.CarroRequestCancel(c.ID)
 	log.Println("[CARRO] Publicando cancelamento de reserva no tópico: ", topic)
 	msg := map[string]string{
 		"IDCarro": c.ID,
@@ -106,6 +162,329 @@ func (c *Carro) CancelarReserva() {
 	}
 	msgJSON, _ := json.Marshal(msg)
 	c.Clientemqtt.Publish(topic, msgJSON)
+	c.transicao(estados.Cancelar)
+	c.reservaPendente = nil
+	c.mutex.Lock()
+	c.Reserva = nil
+	c.ParadaAtual = 0
+	c.viagem = estadoViagem{}
+	c.mutex.Unlock()
+	c.salvarPerfil()
+}
+
+// Pede ao servidor coordenador o estado da reserva; a resposta chega em ServerNotifyCar
+func (c *Carro) ConsultarReservas() {
+	if c.coordenadorID == "" {
+		fmt.Println("❌ Nenhuma reserva feita nesta sessão.")
+		return
+	}
+	topic := topics.CarroRequestStatus(c.ID, c.coordenadorID, c.coordenadorCidade)
+	msg := map[string]string{
+		"IDCarro": c.ID,
+		"Msg":     "Minhas Reservas",
+	}
+	msgJSON, _ := json.Marshal(msg)
+	c.publicarAoServidor(msgJSON, topic)
+}
+
+// Troca ou remove uma parada ainda não iniciada; a resposta chega em ServerNotifyCar
+func (c *Carro) AlterarParada() {
+	if _, ok := c.paradaAtual(); !ok || c.coordenadorID == "" {
+		fmt.Println("❌ Nenhuma parada reservada pendente.")
+		return
+	}
+	for i := c.ParadaAtual; i < len(c.Reserva.Paradas); i++ {
+		parada := c.Reserva.Paradas[i]
+		fmt.Printf("  [%d] %s (%s/%s) em %s\n", i, parada.NomePosto, parada.IDPosto, parada.IDConector, parada.Cidade)
+	}
+	indice, err := strconv.Atoi(perguntarUsuario("Digite o número da parada: "))
+	if err != nil || indice < c.ParadaAtual || indice >= len(c.Reserva.Paradas) {
+		fmt.Println("❌ Escolha inválida.")
+		return
+	}
+
+	alteracao := consts.AlteracaoReserva{
+		TransacaoID:  c.Reserva.ID,
+		Carro:        c.dadosCarro(),
+		IndiceParada: indice,
+	}
+	switch strings.ToLower(perguntarUsuario("(t)rocar ou (r)emover a parada? ")) {
+	case "t":
+		alternativas := c.alternativasParada(c.Reserva.Paradas[indice])
+		if len(alternativas) == 0 {
+			fmt.Println("❌ Nenhum outro posto nas rotas recebidas. Solicite uma nova rota.")
+			return
+		}
+		for i, parada := range alternativas {
+			fmt.Printf("  [%d] %s (%s/%s) - R$ %.2f/kWh\n", i, parada.NomePosto, parada.IDPosto, parada.IDConector, parada.CustoKW)
+		}
+		escolha, err := strconv.Atoi(perguntarUsuario("Digite o número do novo posto: "))
+		if err != nil || escolha < 0 || escolha >= len(alternativas) {
+			fmt.Println("❌ Escolha inválida.")
+			return
+		}
+		alteracao.NovaParada = &alternativas[escolha]
+	case "r":
+	default:
+		fmt.Println("❌ Opção inválida.")
+		return
+	}
+
+	alteracaoJSON, err := json.Marshal(alteracao)
+	if err != nil {
+		log.Printf("[ERRO] Falha ao serializar alteração: %v\n", err)
+		return
+	}
+	c.publicarAoServidor(alteracaoJSON, topics.CarroRequestAlteracao(c.ID, c.coordenadorID, c.coordenadorCidade))
+}
+
+// Paradas das rotas recebidas na mesma cidade da parada que ainda não fazem parte da reserva
+func (c *Carro) alternativasParada(parada consts.Parada) []consts.Parada {
+	naReserva := make(map[string]bool)
+	for _, p := range c.Reserva.Paradas {
+		naReserva[p.IDPosto+"/"+p.IDConector] = true
+	}
+	var alternativas []consts.Parada
+	for _, paradas := range c.ultimasRotas {
+		for _, p := range paradas {
+			chave := p.IDPosto + "/" + p.IDConector
+			if p.Cidade != parada.Cidade || naReserva[chave] {
+				continue
+			}
+			naReserva[chave] = true // evita repetir o mesmo posto de rotas diferentes
+			alternativas = append(alternativas, p)
+		}
+	}
+	return alternativas
+}
+
+// Próxima parada da reserva confirmada, se houver
+func (c *Carro) paradaAtual() (consts.Parada, bool) {
+	if c.Reserva == nil || c.ParadaAtual >= len(c.Reserva.Paradas) {
+		return consts.Parada{}, false
+	}
+	return c.Reserva.Paradas[c.ParadaAtual], true
+}
+
+// Avisa o servidor dono do posto que o carro chegou e quer iniciar a recarga
+func (c *Carro) IniciarRecarga() {
+	parada, ok := c.paradaAtual()
+	if !ok {
+		fmt.Println("❌ Nenhuma parada reservada pendente.")
+		return
+	}
+	topic := topics.CarroSendsRechargeStart(c.ID, "", parada.Cidade)
+	c.mutex.Lock()
+	msg := map[string]interface{}{
+		"IDCarro": c.ID,
+		"IDPosto": parada.IDPosto,
+		"Bateria": c.Bateria,
+	}
+	c.mutex.Unlock()
+	msgJSON, _ := json.Marshal(msg)
+	c.publicarAoServidor(msgJSON, topic)
+	fmt.Printf("[CARRO] Chegada informada ao posto %s (%s)\n", parada.NomePosto, parada.IDConector)
+}
+
+func (c *Carro) FinalizarRecarga() {
+	topic := topics.CarroSendsRechargeFinish(c.ID)
+	msg := map[string]string{
+		"IDCarro": c.ID,
+		"Msg":     "Finalizar Recarga",
+	}
+	if parada, ok := c.paradaAtual(); ok {
+		msg["IDPosto"] = parada.IDPosto
+	}
+	msgJson, _ := json.Marshal(msg)
+	c.Clientemqtt.Publish(topic, msgJson)
+	fmt.Println("[CARRO] Fim de recarga solicitado, aguardando o resumo da sessão...")
+}
+
+// Trata as notificações de sessão enviadas pelo servidor dono do posto
+func (c *Carro) processarNotificacao(msgServer consts.Mensagem) {
+	switch msgServer.Conteudo["tipo"] {
+	case "sessao":
+		bytes, _ := json.Marshal(msgServer.Conteudo["sessao"])
+		var sessao consts.SessaoRecarga
+		if err := json.Unmarshal(bytes, &sessao); err != nil {
+			log.Println("Erro ao converter sessão:", err)
+			return
+		}
+		fmt.Printf(">> [Sessão %s] Posto %s: %s\n", sessao.ID, sessao.PostoID, sessao.Estado)
+		if tela != nil {
+			tela.registrarSessao(sessao.PostoID, sessao.Estado)
+		}
+		c.atualizarSimulacao(sessao)
+		switch sessao.Estado {
+		case consts.SessaoReservada:
+			if sessao.PosicaoFila > 0 {
+				fmt.Printf(">> Conector %s: %d carro(s) à frente, espera prevista de %.0f min\n", sessao.ConectorID, sessao.PosicaoFila, sessao.EsperaEstimadaMin)
+			}
+		case consts.SessaoCarregando:
+			c.transicao(estados.RecargaIniciada)
+		case consts.SessaoFinalizada:
+			if simulacao == nil {
+				c.Bateria = math.Min(c.Bateria+sessao.EnergiaKWh, c.CapacidadeBateria)
+			}
+			fmt.Printf(">> Recarga concluída: %.2f kWh em %.1f min. Bateria: %.2f%%\n", sessao.EnergiaKWh, sessao.DuracaoMin, c.PorcentagemBateria())
+			mostrarFatura(msgServer.Conteudo["fatura"])
+			c.avancarParada()
+			if _, ok := c.paradaAtual(); !ok {
+				fmt.Println(">> Todas as paradas da reserva foram concluídas.")
+				c.transicao(estados.ViagemConcluida)
+				c.definirReserva(nil, 0)
+				c.concluirViagemSimulada()
+			} else {
+				c.transicao(estados.ParadaConcluida)
+			}
+			c.salvarPerfil()
+			sinalizarCenario(EventoSessaoFinalizada)
+		case consts.SessaoAbortada:
+			fmt.Printf(">> Sessão abortada: %s\n", sessao.Motivo)
+			mostrarFatura(msgServer.Conteudo["fatura"])
+			// Liberações por troca ou replanejamento de paradas fazem parte da viagem
+			if sessao.Motivo == consts.MotivoNoShow {
+				sinalizarCenario(EventoSessaoAbortada)
+			}
+		}
+	case "promovido":
+		// Abriu vaga no posto da lista de espera: a rota recusada volta ao coordenador com o
+		// conector oferecido, e as demais paradas são reservadas junto pelo 2PC
+		bytes, _ := json.Marshal(msgServer.Conteudo["vaga"])
+		var vaga consts.VagaEspera
+		if err := json.Unmarshal(bytes, &vaga); err != nil {
+			log.Println("Erro ao converter vaga:", err)
+			return
+		}
+		if c.reservaPendente == nil || !c.transicao(estados.Promovido) {
+			fmt.Printf(">> Vaga no posto %s ignorada: o carro não está mais na lista de espera.\n", vaga.PostoID)
+			return
+		}
+		reserva := c.mesclarVaga(*c.reservaPendente, vaga, time.Since(c.esperaDesde))
+		reservaJSON, err := json.Marshal(reserva)
+		if err != nil {
+			log.Printf("[ERRO] Falha ao serializar mensagem de reserva: %v\n", err)
+			return
+		}
+		c.reservaPendente = &reserva
+		fmt.Printf(">> Vaga liberada no posto %s, conector %s! Reservando a rota de novo...\n", vaga.PostoID, vaga.ConectorID)
+		c.publicarAoServidor(reservaJSON, topics.CarroRequestReserva(c.ID, c.coordenadorID, c.coordenadorCidade))
+	case "replanejamento":
+		c.responderReplanejamento(msgServer)
+	case "alteracao":
+		fmt.Printf(">> [Alteração] %v\n", msgServer.Conteudo["mensagem"])
+		if msgServer.Conteudo["status"] != "OK" {
+			return
+		}
+		bytes, _ := json.Marshal(msgServer.Conteudo["reserva"])
+		var reserva consts.Reserva
+		if err := json.Unmarshal(bytes, &reserva); err != nil {
+			log.Println("Erro ao converter reserva:", err)
+			return
+		}
+		_, parada := c.reservaAtual()
+		c.definirReserva(&reserva, parada)
+		if _, ok := c.paradaAtual(); !ok {
+			fmt.Println(">> A reserva não tem mais paradas pendentes.")
+		}
+		c.salvarPerfil()
+	case "reservas":
+		c.conciliarReservaRetomada(msgServer.Conteudo["reservas"])
+		mostrarReservas(msgServer.Conteudo["reservas"])
+	case "fila":
+		fmt.Printf(">> [Fila] %v\n", msgServer.Conteudo["mensagem"])
+	case "reserva_expirada":
+		fmt.Printf(">> [Servidor %s] %v\n", msgServer.Origem, msgServer.Conteudo["mensagem"])
+		c.transicao(estados.ReservaPerdida)
+		c.mutex.Lock()
+		c.Reserva = nil
+		c.ParadaAtual = 0
+		c.viagem = estadoViagem{}
+		c.mutex.Unlock()
+		c.salvarPerfil()
+		sinalizarCenario(EventoSessaoAbortada)
+	case "erro":
+		fmt.Printf(">> [Servidor %s] %v\n", msgServer.Origem, msgServer.Conteudo["mensagem"])
+	default:
+		fmt.Printf(">> [Notificação %s] %v\n", msgServer.Origem, msgServer.Conteudo)
+	}
+}
+
+// Rota recusada com a vaga da lista de espera: o posto da vaga passa a usar o conector
+// oferecido e as demais paradas são mantidas. As chegadas previstas são adiadas pelo tempo
+// de espera e as cotações, já vencidas, são descartadas (o posto cota o preço no prepare).
+func (c *Carro) mesclarVaga(reserva consts.Reserva, vaga consts.VagaEspera, espera time.Duration) consts.Reserva {
+	reserva.Carro = c.dadosCarro()
+	reserva.Paradas = append([]consts.Parada{}, reserva.Paradas...)
+	for i := range reserva.Paradas {
+		parada := &reserva.Paradas[i]
+		if parada.IDPosto == vaga.PostoID {
+			parada.IDConector = vaga.ConectorID
+		}
+		if !parada.ChegadaPrevista.IsZero() {
+			parada.ChegadaPrevista = parada.ChegadaPrevista.Add(espera)
+		}
+		parada.Cotacao = nil
+	}
+	return reserva
+}
+
+// Reserva comitada e o estado de cada parada, enviados pelo coordenador
+func mostrarReservas(conteudo interface{}) {
+	if conteudo == nil {
+		fmt.Println(">> Nenhuma reserva ativa.")
+		return
+	}
+	bytes, _ := json.Marshal(conteudo)
+	var status consts.StatusReserva
+	if err := json.Unmarshal(bytes, &status); err != nil {
+		log.Println("Erro ao converter reservas:", err)
+		return
+	}
+	fmt.Printf(">> [Reserva %s] %d parada(s)\n", status.TransacaoID, len(status.Paradas))
+	for i, item := range status.Paradas {
+		parada := item.Parada
+		fmt.Printf("  [%d] %s (%s/%s) em %s\n", i+1, parada.NomePosto, parada.IDPosto, parada.IDConector, parada.Cidade)
+		switch {
+		case item.Sessao != nil:
+			sessao := item.Sessao
+			if tela != nil {
+				tela.registrarSessao(sessao.PostoID, sessao.Estado)
+			}
+			fmt.Printf("      Sessão %s: %s, R$ %.2f/kWh\n", sessao.ID, sessao.Estado, sessao.PrecoKWh)
+			if sessao.PosicaoFila > 0 {
+				fmt.Printf("      Fila: %d carro(s) à frente, espera prevista de %.0f min\n", sessao.PosicaoFila, sessao.EsperaEstimadaMin)
+			}
+			if sessao.Estado == consts.SessaoReservada && !sessao.ExpiraEm.IsZero() {
+				fmt.Printf("      Expira às %s se o carro não chegar\n", sessao.ExpiraEm.Local().Format("15:04"))
+			}
+		case item.Erro != "":
+			fmt.Printf("      Estado indisponível: %s\n", item.Erro)
+		default:
+			fmt.Println("      Sem sessão ativa (encerrada ou liberada)")
+		}
+	}
+}
+
+// Resumo da cobrança enviado pelo servidor junto com a sessão encerrada
+func mostrarFatura(conteudo interface{}) {
+	if conteudo == nil {
+		return
+	}
+	bytes, _ := json.Marshal(conteudo)
+	var fatura consts.Fatura
+	if err := json.Unmarshal(bytes, &fatura); err != nil {
+		log.Println("Erro ao converter fatura:", err)
+		return
+	}
+	fmt.Printf(">> [Fatura %s] Energia: %.2f kWh × R$ %.2f = R$ %.2f\n", fatura.ID, fatura.EnergiaKWh, fatura.PrecoKWh, fatura.ValorEnergia)
+	if fatura.TaxaOciosidade > 0 {
+		fmt.Printf(">> Taxa de ociosidade (%.1f min): R$ %.2f\n", fatura.OciosidadeMin, fatura.TaxaOciosidade)
+	}
+	if fatura.TaxaNoShow > 0 {
+		fmt.Printf(">> Taxa de não comparecimento: R$ %.2f\n", fatura.TaxaNoShow)
+	}
+	fmt.Printf(">> Total: R$ %.2f\n", fatura.Total)
 }
 
 func serializarMensagem(msg consts.Mensagem) []byte {
@@ -117,6 +496,91 @@ func serializarMensagem(msg consts.Mensagem) []byte {
 	return ConteudoJSON
 }
 
+// Publica posição e bateria periodicamente enquanto houver reserva, para o coordenador
+// acompanhar a viagem (INTERVALO_TELEMETRIA, padrão 30s)
+func (c *Carro) PublicarTelemetria() {
+	intervalo := ambiente.Duracao("INTERVALO_TELEMETRIA", 30*time.Second)
+	ultimaReserva, ultimaParada, ultimaPerna := "", -1, -1
+	for range time.Tick(intervalo) {
+		c.mutex.Lock()
+		if c.Reserva == nil {
+			c.mutex.Unlock()
+			continue
+		}
+		telemetria, _ := json.Marshal(consts.Telemetria{
+			CarroID:     c.ID,
+			Lat:         c.Lat,
+			Lon:         c.Lon,
+			Bateria:     c.Bateria,
+			ParadaAtual: c.ParadaAtual,
+			Instante:    time.Now(),
+		})
+		perna := -1
+		if c.ParadaAtual < len(c.Reserva.Paradas) {
+			perna = c.Reserva.Paradas[c.ParadaAtual].Perna
+		}
+		avancou := c.Reserva.ID != ultimaReserva || c.ParadaAtual != ultimaParada || perna != ultimaPerna
+		ultimaReserva, ultimaParada, ultimaPerna = c.Reserva.ID, c.ParadaAtual, perna
+		c.mutex.Unlock()
+		c.Clientemqtt.Publish(topics.CarroTelemetria(c.ID), telemetria)
+		// O perfil só é regravado quando a viagem muda de parada ou de perna
+		if avancou {
+			c.salvarPerfil()
+		}
+	}
+}
+
+// Troca a reserva em andamento e o índice da próxima parada. A telemetria lê os dois em
+// outra goroutine, então a escrita passa pelo mutex.
+func (c *Carro) definirReserva(reserva *consts.Reserva, paradaAtual int) {
+	c.mutex.Lock()
+	c.Reserva = reserva
+	c.ParadaAtual = paradaAtual
+	c.mutex.Unlock()
+}
+
+// Lê a reserva em andamento e o índice da próxima parada sob o mesmo mutex da escrita
+func (c *Carro) reservaAtual() (*consts.Reserva, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Reserva, c.ParadaAtual
+}
+
+// Passa para a próxima parada da reserva
+func (c *Carro) avancarParada() {
+	c.mutex.Lock()
+	c.ParadaAtual++
+	c.mutex.Unlock()
+}
+
+// O coordenador propôs novas paradas porque a viagem saiu do plano
+func (c *Carro) responderReplanejamento(msgServer consts.Mensagem) {
+	fmt.Printf(">> [Replanejamento] %v\n", msgServer.Conteudo["motivo"])
+	bytes, _ := json.Marshal(msgServer.Conteudo["paradas"])
+	var paradas []consts.Parada
+	if err := json.Unmarshal(bytes, &paradas); err != nil || len(paradas) == 0 {
+		fmt.Println(">> Nenhuma rota alternativa encontrada. A reserva atual foi mantida.")
+		return
+	}
+	fmt.Println(">> Novas paradas propostas:")
+	for i, parada := range paradas {
+		fmt.Printf("  [%d] %s (%s/%s) em %s - R$ %.2f/kWh\n", i+1, parada.NomePosto, parada.IDPosto, parada.IDConector, parada.Cidade, parada.CustoKW)
+	}
+	aceitar := "nao"
+	if cenario != nil {
+		if cenario.AceitarReplanejamento {
+			aceitar = "sim"
+		}
+	} else if strings.EqualFold(perguntarUsuario("Aceitar o replanejamento? (s/N): "), "s") {
+		aceitar = "sim"
+	}
+	msg, _ := json.Marshal(map[string]string{
+		"IDCarro": c.ID,
+		"Aceitar": aceitar,
+	})
+	c.publicarAoServidor(msg, topics.CarroRequestReplanejamento(c.ID, msgServer.ID, msgServer.Origem))
+}
+
 func (c *Carro) publicarAoServidor(conteudoJSON []byte, topico string) {
 	if conteudoJSON == nil {
 		log.Println("[CARRO] Não foi possível publicar: conteúdo JSON é nulo.")
@@ -126,22 +590,68 @@ func (c *Carro) publicarAoServidor(conteudoJSON []byte, topico string) {
 	c.Clientemqtt.Publish(topico, conteudoJSON)
 }
 
-func (c *Carro) solicitarRota(cidadeInicial string, cidadeDestino string) {
+// Intervalo antes de pedir a rota de novo após uma reserva recusada
+const esperaNovaTentativa = 2 * time.Second
+
+// Pedidos de rota por viagem: os do cenário ou TENTATIVAS_ROTA (padrão 3)
+func tentativasRota() int {
+	if cenario != nil {
+		return cenario.Tentativas
+	}
+	return ambiente.Inteiro("TENTATIVAS_ROTA", 3)
+}
+
+// Aplica o evento na máquina de estados; mensagens fora de hora são só registradas
+func (c *Carro) transicao(evento estados.Evento) bool {
+	t, ok := c.estado.Disparar(evento)
+	if !ok {
+		log.Printf("[CARRO] Evento %s ignorado no estado %s", evento, t.De)
+		return false
+	}
+	if t.De != t.Para {
+		log.Printf("[CARRO] Estado: %s", t)
+	}
+	return true
+}
+
+// Após SemRotas ou ReservaErro: pede a rota de novo se ainda há tentativas, ou desiste
+func (c *Carro) novaTentativa(eventoCenario string) {
+	if c.estado.Estado() != estados.SolicitandoRotas {
+		fmt.Printf("❌ Reserva não obtida após %d tentativa(s). Solicite uma nova rota.\n", c.estado.Tentativas())
+		sinalizarCenario(eventoCenario)
+		return
+	}
+	fmt.Printf(">> Pedindo outra rota para %s (tentativa %d)...\n", c.destino, c.estado.Tentativas())
+	time.AfterFunc(esperaNovaTentativa, func() {
+		c.enviarPedidoRota(c.CidadeAtual, c.destino)
+	})
+}
+
+// Inicia uma viagem, com escalas opcionais antes do destino: só é aceito sem outro
+// pedido ou reserva em andamento
+func (c *Carro) solicitarRota(cidadeInicial string, cidadeDestino string, escalas []consts.Escala) {
+	if cidadeDestino == "" {
+		return
+	}
+	if !c.transicao(estados.PedirRotas) {
+		fmt.Printf("❌ Já existe uma viagem em andamento (%s). Cancele-a antes de pedir outra rota.\n", c.estado.Estado())
+		return
+	}
+	c.destino = cidadeDestino
+	c.escalas = escalas
+	c.enviarPedidoRota(cidadeInicial, cidadeDestino)
+}
+
+func (c *Carro) enviarPedidoRota(cidadeInicial string, cidadeDestino string) {
 	log.Println("[CARRO] Função solicitarRota foi chamada")
 	topic := topics.CarroRequestRotas(c.ID, cidadeDestino)
 	log.Printf("[CARRO] Topico para solicitação de rota: %s", topic)
 
 	trajeto := consts.Trajeto{
-		CarroMQTT: consts.Carro{
-			ID:                c.ID,
-			Bateria:           c.Bateria,
-			X:                 c.X,
-			Y:                 c.Y,
-			CapacidadeBateria: c.CapacidadeBateria,
-			Consumobateria:    c.Consumobateria,
-		},
-		Inicio:  cidadeInicial,
+		CarroMQTT: c.dadosCarro(),
+		Inicio:    cidadeInicial,
 		Destino: cidadeDestino,
+		Escalas:   c.escalas,
 	}
 	ConteudoJSON, err := json.Marshal(trajeto)
 	if err != nil {
@@ -151,16 +661,6 @@ func (c *Carro) solicitarRota(cidadeInicial string, cidadeDestino string) {
 	c.publicarAoServidor(ConteudoJSON, topic)
 }
 
-func getLocalIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String(), nil
-}
-
 func (c *Carro) PorcentagemBateria() float64 {
 	return (c.Bateria / c.CapacidadeBateria) * 100
 }
@@ -176,15 +676,25 @@ func desserializarMensagem(mensagem []byte) consts.Mensagem {
 }
 
 func (c *Carro) exibirMenu() {
+	if tela != nil {
+		return // O menu fica no painel lateral da interface
+	}
 	fmt.Println("\n━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println("          🚀 MENU PRINCIPAL 🚀        ")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Printf("  🆔 Carro ID: %s \n", c.ID)
 	fmt.Printf("  🔋 Bateria: %.2f%%\n", c.PorcentagemBateria())
+	fmt.Printf("  🚦 Estado: %s\n", c.estado.Estado())
 	fmt.Println("  1️⃣  | Solicitar Nova Rota")
 	fmt.Println("  2️⃣  | Cancelar Rota Atual")
-	fmt.Println("  3️⃣  | Finalizar Recarga")
-	fmt.Println("  4️⃣  | Encerrar Conexão")
+	if parada, ok := c.paradaAtual(); ok {
+		fmt.Printf("  📍 Próxima parada: %s (%s)\n", parada.NomePosto, parada.Cidade)
+	}
+	fmt.Println("  3️⃣  | Iniciar Recarga (cheguei ao posto)")
+	fmt.Println("  4️⃣  | Finalizar Recarga")
+	fmt.Println("  5️⃣  | Minhas Reservas")
+	fmt.Println("  6️⃣  | Alterar Parada")
+	fmt.Println("  7️⃣  | Encerrar Conexão")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 }
 
@@ -214,6 +724,13 @@ func setupMqttHandlers(router *router.Router, carID string) {
 			Payload: payload,
 		}
 	})
+	router.Register(topics.ServerNotifyCar("+", carID), func(payload []byte) {
+		log.Println("[CARRO] [Callback MQTT] Notificação do servidor recebida. Enviando para canal...")
+		incomingMqttChan <- MqttMessage{
+			Topic:   topics.ServerNotifyCar("+", carID),
+			Payload: payload,
+		}
+	})
 	// Adicione outros handlers conforme necessário
 }
 
@@ -233,11 +750,22 @@ func processIncomingMqttMessages(car *Carro) {
 
 			// Desserializa a mensagem para o tipo genérico
 			msgServer := desserializarMensagem(msg.Payload)
+			if !car.transicao(estados.RotasRecebidas) {
+				continue
+			}
 
 			fmt.Println(">> Rotas Recebidas do IP :", msgServer.ID)
 			paradasMap := make(map[string][]consts.Parada)
 
+			resumos := make(map[string]consts.ResumoRota)
 			for nome, v := range msgServer.Conteudo {
+				if nome == consts.ChaveResumosRotas {
+					bytes, _ := json.Marshal(v)
+					if err := json.Unmarshal(bytes, &resumos); err != nil {
+						log.Println("Erro ao converter resumos das rotas:", err)
+					}
+					continue
+				}
 				// Primeiro, transforma o slice genérico em JSON
 				bytes, err := json.Marshal(v)
 				if err != nil {
@@ -256,7 +784,7 @@ func processIncomingMqttMessages(car *Carro) {
 				paradasMap[nome] = paradas
 			}
 
-			car.SolicitarReserva(paradasMap, msgServer.Origem, msgServer.ID)
+			car.SolicitarReserva(paradasMap, resumos, msgServer.Origem, msgServer.ID)
 
 			//Adicione lógica para exibir visualmente ou armazenar rotas
 		} else if strings.HasPrefix(msg.Topic, topics.ServerReserveStatus("+", car.ID)) {
@@ -274,20 +802,48 @@ func processIncomingMqttMessages(car *Carro) {
 			}
 			if reserveStatus["status"] == "OK" {
 				log.Println("Reserva bem sucedida")
+				if car.reservaPendente != nil && car.transicao(estados.ReservaOK) {
+					reserva := car.reservaPendente
+					reserva.ID = reserveStatus["transacao"]
+					car.definirReserva(reserva, 0)
+					car.coordenadorID = msgServer.ID
+					car.coordenadorCidade = msgServer.Origem
+					car.reservaPendente = nil
+					car.salvarPerfil()
+					fmt.Printf(">> Reserva %s confirmada com %d parada(s).\n", car.Reserva.ID, len(car.Reserva.Paradas))
+					sinalizarCenario(EventoReservaOK)
+				}
 
+			} else if reserveStatus["status"] == "ERRO" && reserveStatus["lista_espera"] != "" {
+				if car.transicao(estados.ListaEspera) {
+					// A rota fica guardada para ser reservada de novo quando a vaga abrir
+					car.esperaDesde = time.Now()
+					car.coordenadorID = msgServer.ID
+					car.coordenadorCidade = msgServer.Origem
+					fmt.Printf(">> Sem vaga no momento. Carro na posição %s da lista de espera do posto %s.\n", reserveStatus["posicao"], reserveStatus["lista_espera"])
+					sinalizarCenario(EventoListaEspera)
+				}
 			} else if reserveStatus["status"] == "ERRO" {
-				log.Println("Erro ao reserver postos.")
-				log.Println("[SOLICITE OUTRA ROTA]")
-				log.Println("Cidade destino: ", msgServer.Origem)
-				car.solicitarRota(car.CidadeAtual, msgServer.Origem)
-
+				if reserveStatus["mensagem"] != "" {
+					fmt.Printf(">> [Servidor %s] %s\n", msgServer.Origem, reserveStatus["mensagem"])
+				}
+				if car.transicao(estados.ReservaErro) {
+					log.Println("Erro ao reserver postos.")
+					car.reservaPendente = nil
+					car.novaTentativa(EventoReservaErro)
+				}
 			}
 
+		} else if strings.HasPrefix(msg.Topic, topics.ServerNotifyCar("+", car.ID)) {
+			car.processarNotificacao(desserializarMensagem(msg.Payload))
+		} else if msg.Topic == topics.CarroReconectado(car.ID) {
+			car.reconectado()
 		} else {
 			log.Printf("[Processador MQTT] Tópico desconhecido ou não tratado especificamente: %s\n", msg.Topic)
 		}
 	}
 	log.Println("[Processador MQTT] Encerrando.")
+	close(processadorEncerrado)
 }
 
 func (c *Carro) AssinarRespostaServidor() {
@@ -302,12 +858,16 @@ func (c *Carro) AssinarRespostaServidor() {
 	topicReserveStatus := topics.ServerReserveStatus("+", c.ID)
 	c.Clientemqtt.Subscribe(topicReserveStatus)
 	log.Printf("[CARRO] Subscrito ao tópico: %s\n", topicReserveStatus)
+
+	topicNotify := topics.ServerNotifyCar("+", c.ID)
+	c.Clientemqtt.Subscribe(topicNotify)
+	log.Printf("[CARRO] Subscrito ao tópico: %s\n", topicNotify)
 }
 
 func (c *Carro) selecionarCidade() string {
 	// Remove a cidade atual da lista de cidades disponíveis
-	cidades := make([]string, 0, len(consts.CidadesArray))
-	for _, cidade := range consts.CidadesArray {
+	cidades := make([]string, 0, len(consts.Cidades()))
+	for _, cidade := range consts.IDsCidades() {
 		log.Printf("[CARRO] Cidade: %s\n [CARRO] Cidade Atual: %s\n", cidade, c.CidadeAtual)
 		if cidade != c.CidadeAtual {
 			cidades = append(cidades, cidade)
@@ -316,7 +876,8 @@ func (c *Carro) selecionarCidade() string {
 
 	fmt.Println("Cidades disponíveis para rota:")
 	for i, cidade := range cidades {
-		fmt.Printf("  %d - %s\n", i, cidade)
+		info, _ := consts.BuscarCidade(cidade)
+		fmt.Printf("  %d - %s (%s)\n", i, cidade, info.Nome)
 	}
 
 	input := perguntarUsuario(strings.TrimSpace("Digite a opção para cidade de destino: "))
@@ -329,13 +890,24 @@ func (c *Carro) selecionarCidade() string {
 	return cidadeDestino
 }
 
+// Pergunta as escalas antes do destino; vazio segue direto. Retorna false se a entrada for inválida.
+func (c *Carro) perguntarEscalas() ([]consts.Escala, bool) {
+	entrada := perguntarUsuario("Escalas antes do destino (ex: SSA:60,ILH, com a permanência em minutos; vazio para ir direto): ")
+	escalas, err := consts.ParseEscalas(entrada)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return nil, false
+	}
+	return escalas, true
+}
+
 // handleUserCommand processa os comandos recebidos do canal userInputChan
 func (c *Carro) handleUserCommand(command string) {
 	switch command {
 	case "1": // Solicitar Rota para Destino
 		// Remove a cidade atual da lista de cidades disponíveis
-		cidades := make([]string, 0, len(consts.CidadesArray))
-		for _, cidade := range consts.CidadesArray {
+		cidades := make([]string, 0, len(consts.Cidades()))
+		for _, cidade := range consts.IDsCidades() {
 			log.Printf("[CARRO] Cidade: %s\n [CARRO] Cidade Atual: %s\n", cidade, c.CidadeAtual)
 			if cidade != c.CidadeAtual {
 				cidades = append(cidades, cidade)
@@ -354,7 +926,7 @@ func (c *Carro) handleUserCommand(command string) {
 			return
 		}
 		cidadeDestino := cidades[escolha]
-		c.solicitarRota(c.CidadeAtual, cidadeDestino)
+		c.solicitarRota(c.CidadeAtual, cidadeDestino, nil)
 	case "2": // Finalizar recarga
 		topic := topics.CarroSendsRechargeFinish(c.ID)
 		msg := map[string]string{
@@ -381,7 +953,11 @@ func readUserInput() {
 	for {
 		select {
 		case prompt := <-promptChan:
-			fmt.Print(prompt.Pergunta)
+			if tela != nil {
+				tela.definirPrompt(prompt.Pergunta)
+			} else {
+				fmt.Print(prompt.Pergunta)
+			}
 			input, err := reader.ReadString('\n')
 			if err != nil {
 				log.Printf("[Entrada Usuário] Erro ao ler entrada: %v\n", err)
@@ -404,12 +980,66 @@ func perguntarUsuario(pergunta string) string {
 	return <-respCh
 }
 
+// Loop do menu interativo; retorna quando o usuário encerra a conexão
+func (c *Carro) executarMenu() {
+menu:
+	for {
+
+		c.exibirMenu() // Exibe o menu antes de cada prompt de entrada
+		opcao := strings.TrimSpace(perguntarUsuario("Digite a opção desejada: "))
+		switch opcao {
+		case "1":
+			cidadeDestino := c.selecionarCidade()
+			if cidadeDestino == "" {
+				break
+			}
+			escalas, ok := c.perguntarEscalas()
+			if !ok {
+				break
+			}
+			c.solicitarRota(c.CidadeAtual, cidadeDestino, escalas)
+		case "2":
+			c.CancelarReserva()
+		case "3":
+			c.IniciarRecarga()
+		case "4":
+			c.FinalizarRecarga()
+		case "5":
+			c.ConsultarReservas()
+		case "6":
+			c.AlterarParada()
+		case "7":
+			log.Println("Desconectado")
+			break menu
+		default:
+			fmt.Println("Opção inválida. Tente novamente.")
+		}
+	}
+}
+
 func main() {
 	log.Println("[CARRO] Inicializando aplicação...")
-	ip, _ := getLocalIP()
+	storage.CarregarCidades()
+	var err error
+	if cenario, err = carregarCenario(); err != nil {
+		log.Fatalf("[CARRO] %v", err)
+	}
+	simulacao = carregarSimulacao()
+	arquivo := arquivoPerfil()
+	perfil, err := carregarPerfil(arquivo)
+	if err != nil {
+		log.Fatalf("[CARRO] %v", err)
+	}
+	if cenario != nil && cenario.ID != "" && cenario.ID != perfil.ID {
+		// O ID do cenário vale só para esta execução; o perfil não é alterado
+		log.Printf("[CARRO] Usando o ID %s do cenário no lugar do perfil %s", cenario.ID, perfil.ID)
+		perfil.ID = cenario.ID
+		perfil.Reserva = nil
+		arquivo = ""
+	}
 
 	routerCarro := router.NewRouter()
-	mqttClient := *clientemqtt.NewClient(string(consts.Broker), routerCarro, topics.CarroDesconectado(ip), ip)
+	mqttClient := *clientemqtt.NewClientComID(string(consts.Broker), routerCarro, topics.CarroDesconectado(perfil.ID), perfil.ID)
 
 	// Conectar ao broker MQTT
 	conn := mqttClient.Connect()
@@ -418,75 +1048,75 @@ func main() {
 	}
 	log.Println("[CARRO] Conectado ao broker MQTT.")
 
-	// Definindo a cidade de origem do carro para o exemplo
-	randomX := rand.Float64()*(355.0-60.0) + 60.0
-	randomY := rand.Float64()*(270.0-50.0) + 50.0
-	cidadeInicial := consts.CidadeAtualDoCarro(randomX, randomY)
-	log.Printf("Cidade [%s]: (%2f, %2f) \n", cidadeInicial, randomX, randomY)
+	// Posição salva no perfil; na primeira execução, uma posição aleatória
+	randomLat, randomLon := perfil.Lat, perfil.Lon
+	if randomLat == 0 && randomLon == 0 {
+		randomLat, randomLon = consts.PosicaoAleatoria()
+	}
+	if cenario != nil {
+		randomLat, randomLon = cenario.posicaoInicial()
+	}
+	cidadeInicial := consts.CidadeAtualDoCarro(randomLat, randomLon)
+	log.Printf("Cidade [%s]: (%.5f, %.5f) \n", cidadeInicial, randomLat, randomLon)
 	carro := Carro{
-		ID:                ip,
-		Bateria:           60.0,
+		ID:                perfil.ID,
+		Modelo:            perfil.Modelo,
+		Proprietario:      perfil.Proprietario,
+		Bateria:           perfil.CapacidadeBateria,
 		Clientemqtt:       mqttClient,
-		X:                 randomX,
-		Y:                 randomY,
-		CapacidadeBateria: 60.0,
-		Consumobateria:    0.20,
+		Lat:               randomLat,
+		Lon:               randomLon,
+		CapacidadeBateria: perfil.CapacidadeBateria,
+		Consumobateria:    perfil.Consumobateria,
 		CidadeAtual:       cidadeInicial,
+		Conectores:        perfil.Conectores,
+		TaxaMaxCargaKW:    perfil.TaxaMaxCargaKW,
+		arquivoPerfil:     arquivo,
+		estado:            estados.NovaMaquina(tentativasRota()),
+	}
+	if perfil.Bateria > 0 {
+		carro.Bateria = math.Min(perfil.Bateria, carro.CapacidadeBateria)
+	}
+	if cenario != nil {
+		carro.Bateria = cenario.bateriaInicial(carro.CapacidadeBateria)
 	}
 
 	// Assinar tópicos necessários no broker MQTT
 	carro.AssinarRespostaServidor()
 	// e setupMqttHandlers os configurará para enviar para o canal.
 	setupMqttHandlers(routerCarro, carro.ID)
+	carro.acompanharConexao()
 
 	// Iniciar goroutines de processamento e entrada do usuário
 	go processIncomingMqttMessages(&carro) // Goroutine para processar mensagens MQTT do canal
-	go readUserInput()                     // Goroutine para ler entrada do usuário
-
-	for {
-
-		carro.exibirMenu() // Exibe o menu antes de cada prompt de entrada
-		opcao := strings.TrimSpace(perguntarUsuario("Digite a opção desejada: "))
-		switch opcao {
-		case "1":
-			cidadeDestino := carro.selecionarCidade()
-			carro.solicitarRota(carro.CidadeAtual, cidadeDestino)
-		case "2":
-			topic := topics.CarroSendsRechargeFinish(carro.ID)
-			msg := map[string]string{
-				"IDCarro": carro.ID,
-				"Msg":     "Finalizar Recarga",
+	if cenario == nil {
+		if *flagTUI {
+			if tela, err = iniciarTela(&carro); err != nil {
+				log.Fatalf("[CARRO] %v", err)
 			}
-			msgJson, _ := json.Marshal(msg)
-			carro.Clientemqtt.Publish(topic, msgJson)
-			fmt.Println("[CARRO] = RECARGA FINALIZADA")
-		case "3":
-			log.Println("Desconectado")
-			break // Adiciona a quebra do loop
-		case "4":
-			carro.CancelarReserva()
-		default:
-			fmt.Println("Opção inválida. Tente novamente.")
 		}
+		go readUserInput() // Goroutine para ler entrada do usuário
+	}
+	go carro.PublicarTelemetria()
+	if simulacao != nil {
+		go carro.Simular(simulacao)
+	}
+	if perfil.Reserva != nil && cenario == nil {
+		carro.retomarReserva(perfil.Reserva)
 	}
 
-	// A PARTIR DAQUI OS TRECHOS SÃO DE DESLIGAMENTO MAS AINDA NÃO ESTÃO IMPLEMENTADOS. MAS A IDEIA É QUE SEJA ASSIM
-
-	// Processo de desligamento gracioso
-	fmt.Println("[Main] Fechando canais e desconectando do broker...")
-
-	// Fecha o canal de mensagens MQTT para sinalizar à goroutine processIncomingMqttMessages para parar
-	close(incomingMqttChan)
-	// Dá um pequeno tempo para a goroutine de processamento terminar de consumir as mensagens restantes
-	time.Sleep(time.Second)
+	// SIGINT/SIGTERM (e a opção de saída do menu antigo) seguem o mesmo encerramento
+	signal.Notify(quitChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("[CARRO] Sinal %v recebido, encerrando...", <-quitChan)
+		carro.encerrar(codigoSinal)
+	}()
 
-	/* // Desconecta do broker MQTT
-	if mqttClient.IsConnected() { // Supondo que você tenha um método IsConnected()
-		mqttClient.Disconnect(250)
-		fmt.Println("[Main] Desconectado do broker MQTT.")
+	codigo := 0
+	if cenario != nil {
+		codigo = executarCenario(&carro, cenario)
 	} else {
-		fmt.Println("[Main] Cliente MQTT já estava desconectado.")
-	} */
-
-	fmt.Println("[Main] Aplicação encerrada com sucesso.")
+		carro.executarMenu()
+	}
+	carro.encerrar(codigo)
 }
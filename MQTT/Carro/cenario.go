@@ -0,0 +1,292 @@
+package main
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// Políticas de escolha de rota no modo sem menu
+const (
+	PoliticaPrimeira     = "primeira"      // primeira rota em ordem alfabética
+	PoliticaBarata       = "barata"        // menor custo estimado (energia prevista × preço)
+	PoliticaMenosParadas = "menos-paradas" // menos paradas; empate pelo custo
+	PoliticaRapida       = "rapida"        // menor duração prevista (deslocamento, filas e recargas)
+)
+
+// Cenário para executar o carro sem o menu interativo (CI e testes de carga).
+// Pode vir de um arquivo JSON (-cenario) e ser sobrescrito pelas flags.
+type Cenario struct {
+	ID                    string          `json:"id,omitempty"`     // Padrão: ID salvo no perfil do carro
+	Origem                string          `json:"origem,omitempty"` // Cidade de partida (centro), se lat/lon não forem informados
+	Lat                   float64         `json:"lat,omitempty"`
+	Lon                   float64         `json:"lon,omitempty"`
+	Bateria               float64         `json:"bateria,omitempty"` // kWh
+	Destino               string          `json:"destino"`
+	Escalas               []consts.Escala `json:"escalas,omitempty"` // Destinos intermediários, em ordem
+	Politica              string          `json:"politica,omitempty"`
+	ListaEspera           bool            `json:"listaespera,omitempty"`
+	AceitarReplanejamento bool            `json:"aceitarreplanejamento,omitempty"`
+	Tentativas            int             `json:"tentativas,omitempty"`    // Pedidos de rota antes de desistir
+	Timeout               string          `json:"timeout,omitempty"`       // Duração máxima da viagem (ex: "10m")
+	EsperaChegada         string          `json:"esperachegada,omitempty"` // Tempo até informar a chegada em cada parada
+	FinalizarApos         string          `json:"finalizarapos,omitempty"` // Pede o fim da recarga após esse tempo; vazio espera o posto
+
+	timeout, esperaChegada, finalizarApos time.Duration
+}
+
+// Cenário ativo; nil no modo interativo
+var cenario *Cenario
+
+// Eventos da viagem que conduzem o modo sem menu
+var eventosCenario = make(chan string, 10)
+
+const (
+	EventoReservaOK        = "reserva_ok"
+	EventoReservaErro      = "reserva_erro"
+	EventoListaEspera      = "lista_espera"
+	EventoSemRotas         = "sem_rotas"
+	EventoSessaoFinalizada = "sessao_finalizada"
+	EventoSessaoAbortada   = "sessao_abortada"
+)
+
+// Envia o evento ao modo sem menu, se ativo
+func sinalizarCenario(evento string) {
+	if cenario == nil {
+		return
+	}
+	select {
+	case eventosCenario <- evento:
+	default:
+		log.Printf("[CENARIO] Evento %s descartado (canal cheio)", evento)
+	}
+}
+
+// Lê as flags e o arquivo de cenário. Sem -cenario nem -destino, retorna nil (modo interativo).
+func carregarCenario() (*Cenario, error) {
+	arquivo := flag.String("cenario", "", "arquivo JSON com o cenário a executar sem menu")
+	id := flag.String("id", "", "ID do carro (padrão: o do perfil, gerado no primeiro uso)")
+	origem := flag.String("origem", "", "cidade de partida")
+	lat := flag.Float64("lat", 0, "latitude inicial")
+	lon := flag.Float64("lon", 0, "longitude inicial")
+	bateria := flag.Float64("bateria", 0, "carga inicial da bateria em kWh")
+	destino := flag.String("destino", "", "cidade de destino; ativa o modo sem menu")
+	escalas := flag.String("escalas", "", "escalas antes do destino, com a permanência em minutos (ex: SSA:60,ILH)")
+	politica := flag.String("politica", PoliticaPrimeira, "escolha da rota: primeira, barata, menos-paradas ou rapida")
+	listaEspera := flag.Bool("lista-espera", false, "entrar na lista de espera se a reserva falhar")
+	aceitar := flag.Bool("aceitar-replanejamento", false, "aceitar os replanejamentos propostos pelo coordenador")
+	tentativas := flag.Int("tentativas", 3, "pedidos de rota antes de desistir")
+	timeout := flag.String("timeout", "10m", "duração máxima da viagem")
+	esperaChegada := flag.String("espera-chegada", "0s", "tempo até informar a chegada em cada parada")
+	finalizarApos := flag.String("finalizar-apos", "", "pede o fim da recarga após esse tempo (vazio: espera o posto)")
+	flag.Parse()
+
+	if *arquivo == "" && *destino == "" {
+		return nil, nil
+	}
+	c := &Cenario{
+		Politica:   PoliticaPrimeira,
+		Tentativas: 3,
+		Timeout:    "10m",
+	}
+	if *arquivo != "" {
+		data, err := os.ReadFile(*arquivo)
+		if err != nil {
+			return nil, fmt.Errorf("erro ao ler o cenário: %v", err)
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("erro ao desserializar o cenário: %v", err)
+		}
+	}
+
+	// Flags informadas explicitamente têm prioridade sobre o arquivo
+	var erroEscalas error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			c.ID = *id
+		case "origem":
+			c.Origem = *origem
+		case "lat":
+			c.Lat = *lat
+		case "lon":
+			c.Lon = *lon
+		case "bateria":
+			c.Bateria = *bateria
+		case "destino":
+			c.Destino = *destino
+		case "escalas":
+			c.Escalas, erroEscalas = consts.ParseEscalas(*escalas)
+		case "politica":
+			c.Politica = *politica
+		case "lista-espera":
+			c.ListaEspera = *listaEspera
+		case "aceitar-replanejamento":
+			c.AceitarReplanejamento = *aceitar
+		case "tentativas":
+			c.Tentativas = *tentativas
+		case "timeout":
+			c.Timeout = *timeout
+		case "espera-chegada":
+			c.EsperaChegada = *esperaChegada
+		case "finalizar-apos":
+			c.FinalizarApos = *finalizarApos
+		}
+	})
+	if erroEscalas != nil {
+		return nil, erroEscalas
+	}
+	return c, c.validar()
+}
+
+func (c *Cenario) validar() error {
+	if _, ok := consts.BuscarCidade(c.Destino); !ok {
+		return fmt.Errorf("cidade de destino desconhecida: %q", c.Destino)
+	}
+	for _, escala := range c.Escalas {
+		if _, ok := consts.BuscarCidade(escala.Cidade); !ok {
+			return fmt.Errorf("cidade de escala desconhecida: %q", escala.Cidade)
+		}
+	}
+	if c.Origem != "" {
+		if _, ok := consts.BuscarCidade(c.Origem); !ok {
+			return fmt.Errorf("cidade de origem desconhecida: %q", c.Origem)
+		}
+	}
+	switch c.Politica {
+	case PoliticaPrimeira, PoliticaBarata, PoliticaMenosParadas, PoliticaRapida:
+	default:
+		return fmt.Errorf("política de rota inválida: %q", c.Politica)
+	}
+	if c.Tentativas < 1 {
+		c.Tentativas = 1
+	}
+	var err error
+	if c.timeout, err = time.ParseDuration(c.Timeout); err != nil {
+		return fmt.Errorf("timeout inválido: %v", err)
+	}
+	if c.EsperaChegada != "" {
+		if c.esperaChegada, err = time.ParseDuration(c.EsperaChegada); err != nil {
+			return fmt.Errorf("esperachegada inválida: %v", err)
+		}
+	}
+	if c.FinalizarApos != "" {
+		if c.finalizarApos, err = time.ParseDuration(c.FinalizarApos); err != nil {
+			return fmt.Errorf("finalizarapos inválido: %v", err)
+		}
+	}
+	return nil
+}
+
+// Posição inicial do cenário: lat/lon, o centro da cidade de origem ou uma posição aleatória
+func (c *Cenario) posicaoInicial() (float64, float64) {
+	if c.Lat != 0 || c.Lon != 0 {
+		return c.Lat, c.Lon
+	}
+	if cidade, ok := consts.BuscarCidade(c.Origem); ok {
+		return cidade.Centro.Lat, cidade.Centro.Lon
+	}
+	return consts.PosicaoAleatoria()
+}
+
+// Escolhe a rota conforme a política, pelos totais de cada oferta. As ofertas são
+// percorridas em ordem alfabética para que o resultado não dependa da ordem recebida.
+func escolherOferta(ofertas []OfertaRota, politica string) string {
+	if len(ofertas) == 0 {
+		return ""
+	}
+	ordenadas := append([]OfertaRota(nil), ofertas...)
+	sort.Slice(ordenadas, func(i, j int) bool { return ordenadas[i].Nome < ordenadas[j].Nome })
+
+	melhor := ordenadas[0]
+	for _, oferta := range ordenadas[1:] {
+		r, atual := oferta.Resumo, melhor.Resumo
+		switch politica {
+		case PoliticaBarata:
+			if r.CustoEstimado < atual.CustoEstimado {
+				melhor = oferta
+			}
+		case PoliticaMenosParadas:
+			if r.Paradas < atual.Paradas || (r.Paradas == atual.Paradas && r.CustoEstimado < atual.CustoEstimado) {
+				melhor = oferta
+			}
+		case PoliticaRapida:
+			if r.DuracaoMin < atual.DuracaoMin {
+				melhor = oferta
+			}
+		}
+	}
+	return melhor.Nome
+}
+
+// Conduz a viagem do cenário: pede a rota, reserva, informa a chegada em cada parada e
+// aguarda o fim de cada recarga. Retorna o código de saída do processo.
+func executarCenario(c *Carro, cen *Cenario) int {
+	log.Printf("[CENARIO] Carro %s saindo de %s para %s (política %s, bateria %.1f kWh)", c.ID, c.CidadeAtual, cen.Destino, cen.Politica, c.Bateria)
+	prazo := time.After(cen.timeout)
+	c.solicitarRota(c.CidadeAtual, cen.Destino, cen.Escalas)
+
+	for {
+		select {
+		case <-prazo:
+			log.Printf("[CENARIO] Tempo esgotado (%s) antes de concluir a viagem.", cen.timeout)
+			return 1
+		case evento := <-eventosCenario:
+			log.Printf("[CENARIO] Evento: %s", evento)
+			switch evento {
+			case EventoReservaOK:
+				if simulacao == nil { // Com a simulação, a chegada é informada ao alcançar o posto
+					go c.chegarNaParada(cen)
+				}
+			case EventoReservaErro, EventoSemRotas:
+				// A máquina de estados já refez os pedidos até o limite de tentativas
+				log.Printf("[CENARIO] Reserva não obtida após %d tentativa(s).", c.estado.Tentativas())
+				return 1
+			case EventoListaEspera:
+				log.Println("[CENARIO] Aguardando vaga na lista de espera...")
+			case EventoSessaoFinalizada:
+				if _, ok := c.paradaAtual(); !ok {
+					log.Printf("[CENARIO] Viagem concluída. Bateria: %.2f%%", c.PorcentagemBateria())
+					return 0
+				}
+				if simulacao == nil {
+					go c.chegarNaParada(cen)
+				}
+			case EventoSessaoAbortada:
+				log.Println("[CENARIO] Sessão abortada pelo servidor.")
+				return 1
+			}
+		}
+	}
+}
+
+// Simula a chegada à próxima parada e, se configurado, o pedido de fim da recarga
+func (c *Carro) chegarNaParada(cen *Cenario) {
+	time.Sleep(cen.esperaChegada)
+	parada, ok := c.paradaAtual()
+	if !ok {
+		return
+	}
+	c.IniciarRecarga()
+	if cen.finalizarApos <= 0 {
+		return
+	}
+	time.Sleep(cen.finalizarApos)
+	if atual, ok := c.paradaAtual(); ok && atual.IDPosto == parada.IDPosto {
+		c.FinalizarRecarga()
+	}
+}
+
+// Bateria inicial do cenário limitada à capacidade
+func (c *Cenario) bateriaInicial(capacidade float64) float64 {
+	if c.Bateria <= 0 {
+		return capacidade
+	}
+	return math.Min(c.Bateria, capacidade)
+}
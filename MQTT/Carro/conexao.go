@@ -0,0 +1,48 @@
+package main
+
+import (
+	estados "MQTT/Carro/Estados"
+	topics "MQTT/utils/Topicos"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Liga a queda e a volta da conexão ao carro. A reconexão passa pelo processador de
+// mensagens, que é quem altera o estado da reserva.
+func (c *Carro) acompanharConexao() {
+	c.Clientemqtt.AoPerderConexao(func(err error) {
+		log.Printf("[CARRO] Conexão com o broker perdida: %v", err)
+		fmt.Println(">> Conexão com o broker perdida. Reconectando; os servidores mantêm a reserva durante a tolerância de desconexão.")
+	})
+	c.Clientemqtt.AoReconectar(func() {
+		incomingMqttChan <- MqttMessage{Topic: topics.CarroReconectado(c.ID)}
+	})
+}
+
+// Depois da reconexão automática: assina de novo os tópicos (a sessão é limpa), anuncia a
+// volta para os servidores cancelarem a limpeza agendada pelo LWT e ressincroniza a viagem.
+// A reserva é conferida com o coordenador pela consulta de status, como na retomada do
+// perfil; um pedido de rotas sem resposta é reenviado.
+func (c *Carro) reconectado() {
+	c.AssinarRespostaServidor()
+	anuncio, err := json.Marshal(map[string]string{"ID": c.ID})
+	if err != nil {
+		log.Printf("[ERRO] Falha ao serializar anúncio de reconexão: %v\n", err)
+		return
+	}
+	c.Clientemqtt.Publish(topics.CarroReconectado(c.ID), anuncio)
+	log.Printf("[CARRO] Reconectado ao broker (estado %s)", c.estado.Estado())
+	fmt.Println(">> Conexão com o broker restabelecida.")
+
+	reserva, _ := c.reservaAtual()
+	switch {
+	case reserva != nil && c.estado.ComReserva():
+		fmt.Printf(">> Conferindo a reserva %s com o coordenador...\n", reserva.ID)
+		c.retomando = true
+		c.ConsultarReservas()
+	case c.estado.Estado() == estados.SolicitandoRotas:
+		fmt.Printf(">> Pedindo de novo as rotas para %s...\n", c.destino)
+		c.enviarPedidoRota(c.CidadeAtual, c.destino)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	estados "MQTT/Carro/Estados"
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// O que fazer com a reserva em andamento quando o carro encerra
+const (
+	EncerrarManter   = "manter"   // Salva no perfil; retomada no próximo início
+	EncerrarCancelar = "cancelar" // Libera os postos antes de sair
+)
+
+var flagAoEncerrar = flag.String("ao-encerrar", "", "reserva em andamento ao encerrar: manter ou cancelar (padrão: manter no menu, cancelar no cenário)")
+
+// Código de saída quando o carro é encerrado por SIGINT/SIGTERM
+const codigoSinal = 130
+
+// Fechado quando o processador de mensagens termina de consumir o canal
+var processadorEncerrado = make(chan struct{})
+
+var encerramento sync.Once
+
+// Política da flag ou de AO_ENCERRAR. O cenário não retoma reservas, então cancela por padrão.
+func politicaEncerramento() string {
+	politica := *flagAoEncerrar
+	if politica == "" {
+		politica = os.Getenv("AO_ENCERRAR")
+	}
+	switch politica {
+	case EncerrarManter, EncerrarCancelar:
+		return politica
+	}
+	if cenario != nil {
+		return EncerrarCancelar
+	}
+	return EncerrarManter
+}
+
+// Encerra o carro uma única vez, pelo menu, pelo fim do cenário ou por sinal: restaura o
+// terminal, cancela ou salva a reserva, desconecta sem disparar o LWT e espera o
+// processador de mensagens terminar
+func (c *Carro) encerrar(codigo int) {
+	encerramento.Do(func() {
+		if tela != nil {
+			tela.encerrar()
+		}
+		estado := c.estado.Estado()
+		emAndamento := c.estado.ComReserva() || estado == estados.Reservando || estado == estados.NaListaEspera
+		switch {
+		case emAndamento && politicaEncerramento() == EncerrarCancelar:
+			log.Printf("[CARRO] Cancelando a viagem em andamento (%s) antes de sair", estado)
+			c.CancelarReserva()
+		case emAndamento && c.arquivoPerfil == "":
+			log.Printf("[CARRO] Sem perfil para retomar: a reserva fica no coordenador até expirar")
+		case emAndamento:
+			log.Printf("[CARRO] Reserva salva em %s para ser retomada no próximo início", c.arquivoPerfil)
+		}
+		c.salvarPerfil()
+
+		// A desconexão limpa não dispara o LWT; o cancelamento acima sai antes dela
+		c.Clientemqtt.Client.Disconnect(500)
+		close(incomingMqttChan)
+		select {
+		case <-processadorEncerrado:
+		case <-time.After(time.Second):
+			log.Println("[CARRO] Processador de mensagens ainda ocupado; saindo assim mesmo")
+		}
+		log.Printf("[CARRO] Encerrado (código %d)", codigo)
+		os.Exit(codigo)
+	})
+}
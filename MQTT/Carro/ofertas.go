@@ -0,0 +1,233 @@
+package main
+
+import (
+	consts "MQTT/utils/Constantes"
+	rotaslib "MQTT/utils/Rotas"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Critérios de ordenação das rotas oferecidas (ORDEM_ROTAS, padrão custo)
+const (
+	OrdemCusto     = "custo"
+	OrdemTempo     = "tempo"
+	OrdemDistancia = "distancia"
+	OrdemParadas   = "paradas"
+)
+
+// Rota oferecida pelo servidor com os totais usados na comparação
+type OfertaRota struct {
+	Nome    string
+	Paradas []consts.Parada
+	Resumo  consts.ResumoRota
+}
+
+func ordemRotas() string {
+	switch ordem := os.Getenv("ORDEM_ROTAS"); ordem {
+	case OrdemTempo, OrdemDistancia, OrdemParadas:
+		return ordem
+	}
+	return OrdemCusto
+}
+
+// Junta as paradas e os totais de cada rota. Servidores que não enviam os totais
+// têm as rotas resumidas pelo próprio carro.
+func (c *Carro) montarOfertas(rotas map[string][]consts.Parada, resumos map[string]consts.ResumoRota) []OfertaRota {
+	ofertas := make([]OfertaRota, 0, len(rotas))
+	for nome, paradas := range rotas {
+		resumo, ok := resumos[nome]
+		if !ok {
+			resumo = c.resumirRota(paradas)
+		}
+		ofertas = append(ofertas, OfertaRota{Nome: nome, Paradas: paradas, Resumo: resumo})
+	}
+	return ofertas
+}
+
+// Ponto da viagem usado no resumo local: uma parada ou o centro de uma escala ou do destino
+type pontoViagem struct {
+	consts.Coordenadas
+	parada      *consts.Parada
+	permanencia float64 // Minutos na escala
+}
+
+// Totais estimados a partir da posição e da bateria atuais, passando pelas paradas e
+// escalas até o centro da cidade de destino, com as mesmas premissas do planejamento no servidor
+func (c *Carro) resumirRota(paradas []consts.Parada) consts.ResumoRota {
+	c.mutex.Lock()
+	posicao := consts.Coordenadas{Lat: c.Lat, Lon: c.Lon}
+	bateria := c.Bateria
+	c.mutex.Unlock()
+
+	// As paradas de cada perna seguidas da escala que a encerra (a última perna, do destino)
+	var pontos []pontoViagem
+	proxima := 0
+	for perna := 0; perna <= len(c.escalas); perna++ {
+		for ; proxima < len(paradas) && paradas[proxima].Perna <= perna; proxima++ {
+			parada := &paradas[proxima]
+			pontos = append(pontos, pontoViagem{Coordenadas: consts.Coordenadas{Lat: parada.Lat, Lon: parada.Lon}, parada: parada})
+		}
+		cidade, permanencia := c.destino, 0.0
+		if perna < len(c.escalas) {
+			cidade, permanencia = c.escalas[perna].Cidade, c.escalas[perna].PermanenciaMin
+		}
+		if info, ok := consts.BuscarCidade(cidade); ok {
+			pontos = append(pontos, pontoViagem{Coordenadas: info.Centro, permanencia: permanencia})
+		}
+	}
+
+	resumo := consts.ResumoRota{Paradas: len(paradas)}
+	for _, ponto := range pontos {
+		distancia := consts.CalcularDistancia(posicao, ponto.Coordenadas)
+		resumo.DistanciaKm += distancia
+		bateria -= distancia * c.Consumobateria
+		posicao = ponto.Coordenadas
+		resumo.DuracaoMin += ponto.permanencia
+		if parada := ponto.parada; parada != nil {
+			resumo.CustoEstimado += parada.CustoKW * parada.EnergiaKWh
+			resumo.DuracaoMin += parada.EsperaEstimadaMin
+			if parada.PotenciaKW > 0 {
+				resumo.DuracaoMin += parada.EnergiaKWh / parada.PotenciaKW * 60
+			}
+			bateria = math.Min(bateria+parada.EnergiaKWh, c.CapacidadeBateria)
+		}
+	}
+	resumo.DuracaoMin += resumo.DistanciaKm / rotaslib.VelocidadeMediaKmH * 60
+	resumo.BateriaChegada = bateria
+	resumo.ChegadaPrevista = time.Now().Add(consts.TempoReal(time.Duration(resumo.DuracaoMin * float64(time.Minute))))
+	return resumo
+}
+
+// Ordena as ofertas pelo critério; empates e critérios desconhecidos seguem o custo e o nome
+func ordenarOfertas(ofertas []OfertaRota, ordem string) {
+	chave := func(o OfertaRota) float64 {
+		switch ordem {
+		case OrdemTempo:
+			return o.Resumo.DuracaoMin
+		case OrdemDistancia:
+			return o.Resumo.DistanciaKm
+		case OrdemParadas:
+			return float64(o.Resumo.Paradas)
+		}
+		return o.Resumo.CustoEstimado
+	}
+	sort.SliceStable(ofertas, func(i, j int) bool {
+		a, b := ofertas[i], ofertas[j]
+		if chave(a) != chave(b) {
+			return chave(a) < chave(b)
+		}
+		if a.Resumo.CustoEstimado != b.Resumo.CustoEstimado {
+			return a.Resumo.CustoEstimado < b.Resumo.CustoEstimado
+		}
+		return a.Nome < b.Nome
+	})
+}
+
+// Duração no formato "2h05" ou "45 min"
+func formatarDuracao(minutos float64) string {
+	if minutos < 60 {
+		return fmt.Sprintf("%.0f min", minutos)
+	}
+	total := int(math.Round(minutos))
+	return fmt.Sprintf("%dh%02d", total/60, total%60)
+}
+
+// Linha com os totais da oferta, usada na lista e na interface de tela cheia
+func (o OfertaRota) Totais(capacidade float64) string {
+	r := o.Resumo
+	totais := fmt.Sprintf("%d parada(s) · %.0f km · ~R$ %.2f · %s · chega com %.1f kWh", r.Paradas, r.DistanciaKm, r.CustoEstimado, formatarDuracao(r.DuracaoMin), r.BateriaChegada)
+	if capacidade > 0 {
+		totais += fmt.Sprintf(" (%.0f%%)", r.BateriaChegada/capacidade*100)
+	}
+	if !r.ChegadaPrevista.IsZero() {
+		totais += " às " + r.ChegadaPrevista.Local().Format("15:04")
+	}
+	return totais
+}
+
+// Lista as ofertas numeradas na ordem atual, com os totais e o detalhe de cada parada
+func (c *Carro) mostrarOfertas(ofertas []OfertaRota, ordem string) {
+	fmt.Printf("\nRotas oferecidas (ordenadas por %s):\n", ordem)
+	for i, oferta := range ofertas {
+		fmt.Printf("\n[%d] %s: %s\n", i, oferta.Nome, oferta.Totais(c.CapacidadeBateria))
+		perna := 0
+		for j, parada := range oferta.Paradas {
+			for ; perna < parada.Perna && perna < len(c.escalas); perna++ {
+				c.mostrarEscala(perna)
+			}
+			fmt.Printf("  \t [%d] %s (ID: %s)\n", j+1, parada.NomePosto, parada.IDPosto)
+			fmt.Printf("      \t Localização: (Lat: %.5f, Lon: %.5f)\n", parada.Lat, parada.Lon)
+			fmt.Printf("      \t Conector: %s (%s, %.0f kW)\n", parada.IDConector, parada.TipoConector, parada.PotenciaKW)
+			fmt.Printf("      \t Preço: R$ %.2f/kWh (estimado R$ %.2f)\n", parada.CustoKW, parada.CustoKW*parada.EnergiaKWh)
+			if parada.Cotacao != nil {
+				if len(parada.Cotacao.Regras) > 0 {
+					fmt.Printf("      \t Tarifa: %s\n", strings.Join(parada.Cotacao.Regras, ", "))
+				}
+				fmt.Printf("      \t Cotação válida até %s\n", parada.Cotacao.ValidaAte.Local().Format("15:04"))
+			}
+			if parada.EsperaEstimadaMin > 0 {
+				fmt.Printf("      \t Fila: espera prevista de %.0f min\n", parada.EsperaEstimadaMin)
+			}
+		}
+		for ; perna < len(c.escalas); perna++ {
+			c.mostrarEscala(perna)
+		}
+	}
+}
+
+// Linha da escala que encerra a perna, entre as paradas da lista de ofertas
+func (c *Carro) mostrarEscala(perna int) {
+	escala := c.escalas[perna]
+	fmt.Printf("  \t ── Escala em %s", escala.Cidade)
+	if escala.PermanenciaMin > 0 {
+		fmt.Printf(" (%s)", formatarDuracao(escala.PermanenciaMin))
+	}
+	fmt.Println()
+}
+
+// Escalas em uma linha, ex: "SSA (1h00) → ILH"
+func descreverEscalas(escalas []consts.Escala) string {
+	partes := make([]string, 0, len(escalas))
+	for _, escala := range escalas {
+		parte := escala.Cidade
+		if escala.PermanenciaMin > 0 {
+			parte += " (" + formatarDuracao(escala.PermanenciaMin) + ")"
+		}
+		partes = append(partes, parte)
+	}
+	return strings.Join(partes, " → ")
+}
+
+// Pergunta a rota ao usuário, que também pode reordenar a lista ou deixar a política
+// escolher. Retorna "" se a escolha for inválida.
+func (c *Carro) perguntarOferta(ofertas []OfertaRota, ordem string) string {
+	for {
+		c.mostrarOfertas(ofertas, ordem)
+		entrada := strings.ToLower(perguntarUsuario("Número da rota, (a)utomática, ou ordenar por (c)usto, (t)empo, (d)istância, (p)aradas: "))
+		switch entrada {
+		case "c", "t", "d", "p":
+			ordem = map[string]string{"c": OrdemCusto, "t": OrdemTempo, "d": OrdemDistancia, "p": OrdemParadas}[entrada]
+			ordenarOfertas(ofertas, ordem) // Reordena também c.ofertas, que é a mesma lista
+			continue
+		case "a":
+			return escolherOferta(ofertas, politicaAutomatica())
+		}
+		var escolha int
+		if _, err := fmt.Sscan(entrada, &escolha); err != nil || escolha < 0 || escolha >= len(ofertas) {
+			return ""
+		}
+		return ofertas[escolha].Nome
+	}
+}
+
+// Política do modo automático no menu (POLITICA_ROTA, padrão barata)
+func politicaAutomatica() string {
+	if politica := os.Getenv("POLITICA_ROTA"); politica != "" {
+		return politica
+	}
+	return PoliticaBarata
+}
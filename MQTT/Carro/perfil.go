@@ -0,0 +1,132 @@
+package main
+
+import (
+	estados "MQTT/Carro/Estados"
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var flagPerfil = flag.String("perfil", "", "arquivo do perfil do carro (padrão: ARQUIVO_PERFIL_CARRO ou perfil_carro.json)")
+
+// Caminho do perfil: flag, ambiente ou arquivo no diretório atual
+func arquivoPerfil() string {
+	if *flagPerfil != "" {
+		return *flagPerfil
+	}
+	if arquivo := os.Getenv("ARQUIVO_PERFIL_CARRO"); arquivo != "" {
+		return arquivo
+	}
+	return "perfil_carro.json"
+}
+
+// Lê o perfil ou, na primeira execução, cria um com UUID novo e as características padrão
+func carregarPerfil(arquivo string) (consts.PerfilCarro, error) {
+	perfil, err := storage.LerPerfilCarro(arquivo)
+	if err != nil {
+		return consts.PerfilCarro{}, err
+	}
+	if perfil != nil {
+		log.Printf("[CARRO] Perfil %s carregado de %s (%s)", perfil.ID, arquivo, perfil.Modelo)
+		return *perfil, nil
+	}
+	novo := consts.PerfilCarro{
+		ID:                consts.NovoUUID(),
+		Modelo:            "Genérico",
+		CapacidadeBateria: 60.0,
+		Consumobateria:    0.20,
+		Conectores:        []string{consts.ConectorCCS2, consts.ConectorTipo2},
+		TaxaMaxCargaKW:    100.0,
+	}
+	if err := storage.SalvarPerfilCarro(arquivo, novo); err != nil {
+		return consts.PerfilCarro{}, err
+	}
+	log.Printf("[CARRO] Novo perfil %s criado em %s", novo.ID, arquivo)
+	return novo, nil
+}
+
+// Grava a identidade, a bateria, a posição e a reserva em andamento no perfil
+func (c *Carro) salvarPerfil() {
+	if c.arquivoPerfil == "" {
+		return
+	}
+	c.mutex.Lock()
+	perfil := consts.PerfilCarro{
+		ID:                c.ID,
+		Modelo:            c.Modelo,
+		Proprietario:      c.Proprietario,
+		CapacidadeBateria: c.CapacidadeBateria,
+		Consumobateria:    c.Consumobateria,
+		Conectores:        c.Conectores,
+		TaxaMaxCargaKW:    c.TaxaMaxCargaKW,
+		Bateria:           c.Bateria,
+		Lat:               c.Lat,
+		Lon:               c.Lon,
+	}
+	if c.Reserva != nil {
+		perfil.Reserva = &consts.ReservaAtiva{
+			Reserva:           *c.Reserva,
+			ParadaAtual:       c.ParadaAtual,
+			CoordenadorID:     c.coordenadorID,
+			CoordenadorCidade: c.coordenadorCidade,
+		}
+	}
+	c.mutex.Unlock()
+	if err := storage.SalvarPerfilCarro(c.arquivoPerfil, perfil); err != nil {
+		log.Printf("[CARRO] %v", err)
+	}
+}
+
+// Restaura a reserva salva e pede ao coordenador o estado atual dela
+func (c *Carro) retomarReserva(ativa *consts.ReservaAtiva) {
+	if !c.transicao(estados.Retomar) {
+		return
+	}
+	reserva := ativa.Reserva
+	c.definirReserva(&reserva, ativa.ParadaAtual)
+	c.coordenadorID = ativa.CoordenadorID
+	c.coordenadorCidade = ativa.CoordenadorCidade
+	c.escalas = reserva.Escalas
+	c.retomando = true
+	fmt.Printf(">> Retomando a reserva %s (parada %d de %d), consultando o coordenador...\n", reserva.ID, c.ParadaAtual+1, len(reserva.Paradas))
+	c.ConsultarReservas()
+}
+
+// Confere a reserva retomada com a resposta do coordenador: sem reserva ativa no
+// servidor, a cópia local é descartada; caso contrário, as paradas do servidor prevalecem
+func (c *Carro) conciliarReservaRetomada(conteudo interface{}) {
+	if !c.retomando {
+		return
+	}
+	c.retomando = false
+	// A reserva local pode ter sido descartada ou concluída enquanto a consulta estava em
+	// andamento; nesse caso a resposta do coordenador não tem o que conciliar
+	reserva, parada := c.reservaAtual()
+	if reserva == nil || !c.estado.ComReserva() {
+		return
+	}
+	if conteudo == nil {
+		fmt.Println(">> O coordenador não tem mais a reserva salva. Solicite uma nova rota.")
+		c.transicao(estados.ReservaPerdida)
+		c.definirReserva(nil, 0)
+		c.salvarPerfil()
+		return
+	}
+	bytes, _ := json.Marshal(conteudo)
+	var status consts.StatusReserva
+	if err := json.Unmarshal(bytes, &status); err != nil {
+		log.Println("Erro ao converter reservas:", err)
+		return
+	}
+	paradas := make([]consts.Parada, 0, len(status.Paradas))
+	for _, item := range status.Paradas {
+		paradas = append(paradas, item.Parada)
+	}
+	c.definirReserva(&consts.Reserva{ID: status.TransacaoID, Carro: c.dadosCarro(), Paradas: paradas, Escalas: reserva.Escalas}, max(0, min(parada, len(paradas))))
+	fmt.Printf(">> Reserva %s retomada.\n", status.TransacaoID)
+	c.salvarPerfil()
+}
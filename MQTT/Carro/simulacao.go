@@ -0,0 +1,202 @@
+package main
+
+import (
+	ambiente "MQTT/utils/Ambiente"
+	consts "MQTT/utils/Constantes"
+	rotaslib "MQTT/utils/Rotas"
+	topics "MQTT/utils/Topicos"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Intervalo real entre dois passos da simulação, como no simulador de posto
+const passoSimulacao = time.Second
+
+// Flags da simulação; têm prioridade sobre SIMULAR_MOVIMENTO e VELOCIDADE_KMH
+var (
+	flagSimular    = flag.Bool("simular", false, "desloca o carro pelas paradas da reserva e consome a bateria")
+	flagVelocidade = flag.Float64("velocidade", 0, "velocidade da simulação em km/h")
+)
+
+// Deslocamento do carro ao longo da reserva. O tempo é acelerado por consts.FatorTempo,
+// o mesmo dos postos e servidores.
+type Simulacao struct {
+	VelocidadeKmH float64
+}
+
+// Simulação ativa; nil mantém o carro parado como antes
+var simulacao *Simulacao
+
+// Estado da viagem simulada, protegido por Carro.mutex
+type estadoViagem struct {
+	emViagem       bool    // Já partiu rumo à próxima parada
+	naParada       bool    // Chegou e aguarda ou faz a recarga
+	carregando     bool    // O posto confirmou o início da recarga
+	postoParada    string  // Posto onde o carro chegou
+	bateriaChegada float64 // Bateria ao chegar, base da conciliação com a energia medida pelo posto
+}
+
+// Lê as flags e o ambiente. Retorna nil se a simulação não foi pedida.
+func carregarSimulacao() *Simulacao {
+	ativa := *flagSimular
+	if valor := os.Getenv("SIMULAR_MOVIMENTO"); valor != "" && !ativa {
+		ativa, _ = strconv.ParseBool(valor)
+	}
+	if !ativa {
+		return nil
+	}
+	sim := &Simulacao{VelocidadeKmH: rotaslib.VelocidadeMediaKmH}
+	sim.VelocidadeKmH = ambiente.FloatAcimaDe("VELOCIDADE_KMH", 0, sim.VelocidadeKmH)
+	if *flagVelocidade > 0 {
+		sim.VelocidadeKmH = *flagVelocidade
+	}
+	return sim
+}
+
+// Avança a simulação a cada passo enquanto houver reserva
+func (c *Carro) Simular(sim *Simulacao) {
+	log.Printf("[SIMULACAO] Carro %s a %.0f km/h, tempo acelerado %.0fx", c.ID, sim.VelocidadeKmH, consts.FatorTempo())
+	passoHoras := passoSimulacao.Hours() * consts.FatorTempo()
+	for range time.Tick(passoSimulacao) {
+		c.passoSimulacao(sim.VelocidadeKmH*passoHoras, passoHoras)
+	}
+}
+
+// Desloca o carro em direção à próxima parada, consumindo Consumobateria por km, ou
+// acompanha a recarga em andamento. Ao chegar, informa o posto como a opção do menu.
+func (c *Carro) passoSimulacao(km float64, horas float64) {
+	parada, ok := c.paradaAtual()
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	if c.viagem.naParada && c.viagem.postoParada != parada.IDPosto {
+		// A parada foi trocada por alteração ou replanejamento: segue para o novo posto
+		c.viagem.naParada, c.viagem.carregando = false, false
+	}
+	if c.viagem.naParada {
+		if c.viagem.carregando {
+			// Estimativa até o posto informar a energia entregue
+			potencia := math.Min(parada.PotenciaKW, c.TaxaMaxCargaKW)
+			c.Bateria = math.Min(c.Bateria+potencia*horas, c.CapacidadeBateria)
+		}
+		c.mutex.Unlock()
+		return
+	}
+	if c.Bateria <= 0 {
+		c.mutex.Unlock()
+		return
+	}
+
+	var eventos []consts.EventoCarro
+	if !c.viagem.emViagem {
+		c.viagem.emViagem = true
+		eventos = append(eventos, c.novoEvento(consts.EventoPartida, fmt.Sprintf("rumo a %s (%s)", parada.NomePosto, parada.Cidade)))
+	}
+
+	restante := consts.CalcularDistancia(consts.Coordenadas{Lat: c.Lat, Lon: c.Lon}, consts.Coordenadas{Lat: parada.Lat, Lon: parada.Lon})
+	percorrido := math.Min(km, restante)
+	if c.Consumobateria > 0 && percorrido*c.Consumobateria > c.Bateria {
+		percorrido = c.Bateria / c.Consumobateria
+	}
+	fracao := 1.0
+	if restante > 0 {
+		fracao = percorrido / restante
+	}
+	c.Lat += (parada.Lat - c.Lat) * fracao
+	c.Lon += (parada.Lon - c.Lon) * fracao
+	c.Bateria = math.Max(c.Bateria-percorrido*c.Consumobateria, 0)
+
+	if cidade := consts.CidadeDaPosicao(c.Lat, c.Lon); cidade != c.CidadeAtual && cidade != "Fora de cobertura" {
+		c.CidadeAtual = cidade
+		eventos = append(eventos, c.novoEvento(consts.EventoCidade, cidade))
+	}
+
+	chegou := fracao >= 1
+	switch {
+	case chegou:
+		c.viagem.naParada = true
+		c.viagem.postoParada = parada.IDPosto
+		c.viagem.bateriaChegada = c.Bateria
+		eventos = append(eventos, c.novoEvento(consts.EventoChegada, parada.NomePosto))
+	case c.Bateria <= 0:
+		eventos = append(eventos, c.novoEvento(consts.EventoBateriaEsgotada, fmt.Sprintf("a %.1f km de %s", restante-percorrido, parada.NomePosto)))
+	}
+	c.mutex.Unlock()
+
+	for _, evento := range eventos {
+		c.publicarEvento(evento)
+	}
+	if chegou {
+		c.IniciarRecarga()
+	}
+}
+
+// Acompanha as sessões notificadas pelo servidor dono do posto
+func (c *Carro) atualizarSimulacao(sessao consts.SessaoRecarga) {
+	if simulacao == nil {
+		return
+	}
+	c.mutex.Lock()
+	var evento *consts.EventoCarro
+	switch sessao.Estado {
+	case consts.SessaoCarregando:
+		c.viagem.carregando = true
+		e := c.novoEvento(consts.EventoCargaIniciada, sessao.PostoID)
+		evento = &e
+	case consts.SessaoFinalizada:
+		// A energia medida pelo posto substitui a estimativa feita durante a recarga
+		c.Bateria = math.Min(c.viagem.bateriaChegada+sessao.EnergiaKWh, c.CapacidadeBateria)
+		c.viagem = estadoViagem{emViagem: true}
+		e := c.novoEvento(consts.EventoCargaConcluida, fmt.Sprintf("%.2f kWh em %s", sessao.EnergiaKWh, sessao.PostoID))
+		evento = &e
+	}
+	c.mutex.Unlock()
+	if evento != nil {
+		c.publicarEvento(*evento)
+	}
+}
+
+// Encerra a viagem simulada quando não restam paradas
+func (c *Carro) concluirViagemSimulada() {
+	if simulacao == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.viagem = estadoViagem{}
+	evento := c.novoEvento(consts.EventoViagemConcluida, c.CidadeAtual)
+	c.mutex.Unlock()
+	c.publicarEvento(evento)
+}
+
+// Monta o evento com a posição atual; chamado com c.mutex travado
+func (c *Carro) novoEvento(tipo string, detalhe string) consts.EventoCarro {
+	return consts.EventoCarro{
+		CarroID:     c.ID,
+		Tipo:        tipo,
+		Cidade:      c.CidadeAtual,
+		Lat:         c.Lat,
+		Lon:         c.Lon,
+		Bateria:     c.Bateria,
+		ParadaAtual: c.ParadaAtual,
+		Detalhe:     detalhe,
+		Instante:    time.Now(),
+	}
+}
+
+func (c *Carro) publicarEvento(evento consts.EventoCarro) {
+	eventoJSON, err := json.Marshal(evento)
+	if err != nil {
+		log.Printf("[SIMULACAO] Erro ao serializar evento: %v", err)
+		return
+	}
+	log.Printf("[SIMULACAO] %s: %s (bateria %.1f kWh, %s)", evento.Tipo, evento.Detalhe, evento.Bateria, evento.Cidade)
+	c.Clientemqtt.Publish(topics.CarroEvento(c.ID), eventoJSON)
+}
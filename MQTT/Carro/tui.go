@@ -0,0 +1,412 @@
+package main
+
+import (
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var flagTUI = flag.Bool("tui", false, "interface de tela cheia com mapa, reserva e notificações")
+
+// Interface de tela cheia desenhada com sequências ANSI. A saída padrão do carro passa
+// por um pipe e vira o painel de notificações, e o log vai para ARQUIVO_LOG_CARRO, então
+// o fluxo de mensagens MQTT continua o mesmo do menu de texto.
+type Tela struct {
+	mutex        sync.Mutex
+	terminal     *os.File // Saída padrão original
+	largura      int
+	altura       int
+	carro        *Carro
+	postos       []consts.Posto
+	notificacoes []string
+	sessoes      map[string]consts.EstadoSessao // Último estado notificado por posto
+	redesenhar   chan struct{}
+
+	latMin, latMax, lonMin, lonMax float64
+}
+
+// Interface ativa; nil no menu de texto
+var tela *Tela
+
+const (
+	maxNotificacoes   = 200
+	intervaloDesenho  = time.Second
+	alturaNotificacao = 8
+)
+
+// Cores ANSI usadas no mapa
+const (
+	corNormal = "\x1b[0m"
+	corCarro  = "\x1b[1;33m"
+	corParada = "\x1b[1;32m"
+	corRota   = "\x1b[36m"
+	corPosto  = "\x1b[37m"
+	corCidade = "\x1b[1;34m"
+	corBorda  = "\x1b[2m"
+)
+
+var opcoesMenu = []string{
+	"1 | Solicitar Nova Rota",
+	"2 | Cancelar Rota Atual",
+	"3 | Iniciar Recarga (cheguei ao posto)",
+	"4 | Finalizar Recarga",
+	"5 | Minhas Reservas",
+	"6 | Alterar Parada",
+	"7 | Encerrar Conexão",
+}
+
+// Tamanho do terminal: stty, depois LINES/COLUMNS, depois 36x120
+func tamanhoTerminal() (int, int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	if saida, err := cmd.Output(); err == nil {
+		var linhas, colunas int
+		if _, err := fmt.Sscan(string(saida), &linhas, &colunas); err == nil && linhas > 0 && colunas > 0 {
+			return linhas, colunas
+		}
+	}
+	linhas, colunas := 36, 120
+	if valor, err := strconv.Atoi(os.Getenv("LINES")); err == nil && valor > 0 {
+		linhas = valor
+	}
+	if valor, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && valor > 0 {
+		colunas = valor
+	}
+	return linhas, colunas
+}
+
+func iniciarTela(c *Carro) (*Tela, error) {
+	altura, largura := tamanhoTerminal()
+	if altura < 20 || largura < 80 {
+		return nil, fmt.Errorf("terminal pequeno demais para a interface (%dx%d, mínimo 80x20)", largura, altura)
+	}
+	t := &Tela{
+		terminal:   os.Stdout,
+		largura:    largura,
+		altura:     altura,
+		carro:      c,
+		sessoes:    make(map[string]consts.EstadoSessao),
+		redesenhar: make(chan struct{}, 1),
+	}
+	t.carregarMapa()
+
+	arquivoLog := os.Getenv("ARQUIVO_LOG_CARRO")
+	if arquivoLog == "" {
+		arquivoLog = "carro.log"
+	}
+	saidaLog, err := os.OpenFile(arquivoLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao abrir o log %s: %v", arquivoLog, err)
+	}
+	leitor, escritor, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("erro ao criar o pipe da interface: %v", err)
+	}
+	log.SetOutput(saidaLog)
+	os.Stdout = escritor
+
+	// Tela alternativa, sem quebra automática de linha e com rolagem restrita às duas
+	// últimas linhas, para o Enter da entrada não deslocar os painéis
+	fmt.Fprintf(t.terminal, "\x1b[?1049h\x1b[?7l\x1b[2J\x1b[%d;%dr\x1b[%d;1H", altura-1, altura, altura)
+	go t.lerSaida(leitor)
+	go t.desenharPeriodicamente()
+	return t, nil
+}
+
+// Restaura o terminal e a saída padrão
+func (t *Tela) encerrar() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	os.Stdout = t.terminal
+	log.SetOutput(os.Stderr)
+	fmt.Fprint(t.terminal, "\x1b[r\x1b[?7h\x1b[?1049l")
+}
+
+// Postos de todas as cidades, lidos dos arquivos indicados no registro de cidades
+func (t *Tela) carregarMapa() {
+	diretorio := filepath.Dir(os.Getenv("ARQUIVO_JSON_CIDADES"))
+	t.latMin, t.lonMin = math.MaxFloat64, math.MaxFloat64
+	t.latMax, t.lonMax = -math.MaxFloat64, -math.MaxFloat64
+	incluir := func(lat, lon float64) {
+		t.latMin, t.latMax = math.Min(t.latMin, lat), math.Max(t.latMax, lat)
+		t.lonMin, t.lonMax = math.Min(t.lonMin, lon), math.Max(t.lonMax, lon)
+	}
+	for _, cidade := range consts.Cidades() {
+		raioLat := cidade.RaioKm / 111
+		raioLon := cidade.RaioKm / (111 * math.Cos(cidade.Centro.Lat*math.Pi/180))
+		incluir(cidade.Centro.Lat-raioLat, cidade.Centro.Lon-raioLon)
+		incluir(cidade.Centro.Lat+raioLat, cidade.Centro.Lon+raioLon)
+		if cidade.Arquivo == "" {
+			continue
+		}
+		postos, err := storage.LerPostosDaCidade(filepath.Join(diretorio, cidade.Arquivo), cidade.ID)
+		if err != nil {
+			log.Printf("[TUI] Postos de %s fora do mapa: %v", cidade.ID, err)
+			continue
+		}
+		t.postos = append(t.postos, postos...)
+		for _, posto := range postos {
+			incluir(posto.Lat, posto.Lon)
+		}
+	}
+}
+
+// Cada linha escrita na saída padrão vira uma notificação
+func (t *Tela) lerSaida(leitor io.Reader) {
+	scanner := bufio.NewScanner(leitor)
+	for scanner.Scan() {
+		linha := strings.TrimRight(scanner.Text(), "\r ")
+		if linha == "" {
+			continue
+		}
+		t.mutex.Lock()
+		t.notificacoes = append(t.notificacoes, time.Now().Format("15:04:05")+" "+linha)
+		if len(t.notificacoes) > maxNotificacoes {
+			t.notificacoes = t.notificacoes[len(t.notificacoes)-maxNotificacoes:]
+		}
+		t.mutex.Unlock()
+		t.pedirDesenho()
+	}
+}
+
+func (t *Tela) pedirDesenho() {
+	select {
+	case t.redesenhar <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Tela) desenharPeriodicamente() {
+	ticker := time.NewTicker(intervaloDesenho)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.redesenhar:
+		}
+		t.desenhar()
+	}
+}
+
+// Estado da sessão de cada parada, vindo de ServerNotifyCar
+func (t *Tela) registrarSessao(postoID string, estado consts.EstadoSessao) {
+	t.mutex.Lock()
+	t.sessoes[postoID] = estado
+	t.mutex.Unlock()
+	t.pedirDesenho()
+}
+
+// Escreve a pergunta na última linha, onde o usuário digita a resposta
+func (t *Tela) definirPrompt(pergunta string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fmt.Fprintf(t.terminal, "\x1b[%d;1H\x1b[K%s", t.altura, pergunta)
+}
+
+// Ajusta o texto à largura, cortando ou completando com espaços
+func ajustar(texto string, largura int) string {
+	tamanho := utf8.RuneCountInString(texto)
+	if tamanho > largura {
+		runas := []rune(texto)
+		return string(runas[:max(largura-1, 0)]) + "…"
+	}
+	return texto + strings.Repeat(" ", largura-tamanho)
+}
+
+// Redesenha tudo menos a linha de entrada, preservando o cursor
+func (t *Tela) desenhar() {
+	c := t.carro
+	c.mutex.Lock()
+	lat, lon, bateria, cidade := c.Lat, c.Lon, c.Bateria, c.CidadeAtual
+	c.mutex.Unlock()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	alturaMeio := t.altura - alturaNotificacao - 5 // cabeçalho, separadores, espaço da rolagem e entrada
+	larguraMapa := t.largura * 55 / 100
+	larguraLado := t.largura - larguraMapa - 1
+
+	var b strings.Builder
+	b.WriteString("\x1b7")
+	linha := 1
+	escrever := func(texto string) {
+		fmt.Fprintf(&b, "\x1b[%d;1H%s\x1b[K", linha, texto)
+		linha++
+	}
+
+	porcentagem := bateria / c.CapacidadeBateria * 100
+	cheios := min(max(int(porcentagem/10), 0), 10)
+	barra := strings.Repeat("█", cheios) + strings.Repeat("░", 10-cheios)
+	cabecalho := fmt.Sprintf(" Carro %s · %s · Estado: %s · Bateria %s %3.0f%% (%.1f kWh) · %s (%.4f, %.4f)",
+		c.ID, c.Modelo, c.estado.Estado(), barra, porcentagem, bateria, cidade, lat, lon)
+	escrever("\x1b[7m" + ajustar(cabecalho, t.largura) + corNormal)
+	escrever(strings.Repeat("─", larguraMapa) + "┬" + strings.Repeat("─", larguraLado))
+
+	mapa := t.desenharMapa(larguraMapa, alturaMeio, lat, lon)
+	lado := t.painelLateral(larguraLado)
+	for i := 0; i < alturaMeio; i++ {
+		direita := ""
+		if i < len(lado) {
+			direita = lado[i]
+		}
+		escrever(mapa[i] + "│" + ajustar(direita, larguraLado))
+	}
+
+	escrever(ajustar(strings.Repeat("─", larguraMapa)+"┴─ Notificações ", t.largura))
+	inicio := max(len(t.notificacoes)-alturaNotificacao, 0)
+	for i := 0; i < alturaNotificacao; i++ {
+		texto := ""
+		if inicio+i < len(t.notificacoes) {
+			texto = t.notificacoes[inicio+i]
+		}
+		escrever(" " + ajustar(texto, t.largura-1))
+	}
+	escrever("") // Linha que recebe a rolagem da entrada
+	b.WriteString("\x1b8")
+	fmt.Fprint(t.terminal, b.String())
+}
+
+// Reserva (ou rotas oferecidas) e menu
+func (t *Tela) painelLateral(largura int) []string {
+	c := t.carro
+	var linhas []string
+	switch {
+	case c.Reserva != nil:
+		linhas = append(linhas, fmt.Sprintf(" RESERVA %s", c.Reserva.ID))
+		if c.coordenadorCidade != "" {
+			linhas = append(linhas, fmt.Sprintf(" Coordenador: %s", c.coordenadorCidade))
+		}
+		if len(c.Reserva.Escalas) > 0 {
+			linhas = append(linhas, " Escalas: "+descreverEscalas(c.Reserva.Escalas))
+		}
+		for i, parada := range c.Reserva.Paradas {
+			marcador := " "
+			switch {
+			case i < c.ParadaAtual:
+				marcador = "✓"
+			case i == c.ParadaAtual:
+				marcador = "▶"
+			}
+			linhas = append(linhas, fmt.Sprintf(" %s %d. %s (%s/%s)", marcador, i+1, parada.NomePosto, parada.Cidade, parada.IDConector))
+			detalhe := fmt.Sprintf("      R$ %.2f/kWh, ~R$ %.2f", parada.CustoKW, parada.CustoKW*parada.EnergiaKWh)
+			if !parada.ChegadaPrevista.IsZero() {
+				detalhe += ", chegada " + parada.ChegadaPrevista.Local().Format("15:04")
+			}
+			if estado, ok := t.sessoes[parada.IDPosto]; ok {
+				detalhe += " [" + string(estado) + "]"
+			}
+			linhas = append(linhas, detalhe)
+		}
+	case len(c.ofertas) > 0:
+		linhas = append(linhas, " ROTAS OFERECIDAS")
+		for i, oferta := range c.ofertas {
+			linhas = append(linhas, fmt.Sprintf(" [%d] %s", i, oferta.Nome), "      "+oferta.Totais(c.CapacidadeBateria))
+		}
+	default:
+		linhas = append(linhas, " Sem reserva")
+	}
+	linhas = append(linhas, "", " MENU")
+	for _, opcao := range opcoesMenu {
+		linhas = append(linhas, "  "+opcao)
+	}
+	return linhas
+}
+
+// Mapa ASCII: bordas e nomes das cidades, postos, rota pendente, paradas e o carro
+func (t *Tela) desenharMapa(largura, altura int, latCarro, lonCarro float64) []string {
+	linhasGrade := altura - 1 // Última linha é a legenda
+	grade := make([][]rune, linhasGrade)
+	cores := make([][]string, linhasGrade)
+	for i := range grade {
+		grade[i] = []rune(strings.Repeat(" ", largura))
+		cores[i] = make([]string, largura)
+	}
+	projetar := func(lat, lon float64) (int, int) {
+		linha := int(math.Round((t.latMax - lat) / (t.latMax - t.latMin) * float64(linhasGrade-1)))
+		coluna := int(math.Round((lon - t.lonMin) / (t.lonMax - t.lonMin) * float64(largura-1)))
+		return linha, coluna
+	}
+	marcar := func(linha, coluna int, r rune, cor string) {
+		if linha >= 0 && linha < linhasGrade && coluna >= 0 && coluna < largura {
+			grade[linha][coluna] = r
+			cores[linha][coluna] = cor
+		}
+	}
+	traco := func(l0, c0, l1, c1 int) {
+		passos := max(abs(l1-l0), abs(c1-c0), 1)
+		for i := 0; i <= passos; i++ {
+			marcar(l0+(l1-l0)*i/passos, c0+(c1-c0)*i/passos, '·', corRota)
+		}
+	}
+
+	for _, cidade := range consts.Cidades() {
+		raioLat := cidade.RaioKm / 111
+		raioLon := cidade.RaioKm / (111 * math.Cos(cidade.Centro.Lat*math.Pi/180))
+		for angulo := 0.0; angulo < 2*math.Pi; angulo += math.Pi / 24 {
+			l, col := projetar(cidade.Centro.Lat+raioLat*math.Sin(angulo), cidade.Centro.Lon+raioLon*math.Cos(angulo))
+			marcar(l, col, '.', corBorda)
+		}
+	}
+	for _, posto := range t.postos {
+		l, col := projetar(posto.Lat, posto.Lon)
+		marcar(l, col, '+', corPosto)
+	}
+
+	c := t.carro
+	linhaCarro, colunaCarro := projetar(latCarro, lonCarro)
+	if c.Reserva != nil {
+		l0, c0 := linhaCarro, colunaCarro
+		for i := c.ParadaAtual; i < len(c.Reserva.Paradas); i++ {
+			parada := c.Reserva.Paradas[i]
+			l1, c1 := projetar(parada.Lat, parada.Lon)
+			traco(l0, c0, l1, c1)
+			l0, c0 = l1, c1
+		}
+		for i, parada := range c.Reserva.Paradas {
+			l, col := projetar(parada.Lat, parada.Lon)
+			marcar(l, col, rune('1'+i%9), corParada)
+		}
+	}
+	for _, cidade := range consts.Cidades() {
+		l, col := projetar(cidade.Centro.Lat, cidade.Centro.Lon)
+		for i, r := range cidade.ID {
+			marcar(l, col-len(cidade.ID)/2+i, r, corCidade)
+		}
+	}
+	marcar(linhaCarro, colunaCarro, '@', corCarro)
+
+	linhas := make([]string, 0, altura)
+	for i := range grade {
+		var b strings.Builder
+		for j, r := range grade[i] {
+			if cores[i][j] != "" {
+				b.WriteString(cores[i][j] + string(r) + corNormal)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+		linhas = append(linhas, b.String())
+	}
+	return append(linhas, ajustar(" @ carro  + posto  1-9 paradas  · rota  . área da cidade", largura))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,383 @@
+package main
+
+// Simulador de frota: cria N carros virtuais com IDs distintos que pedem rota e reservam
+// em paralelo, e mede a vazão, a taxa de sucesso das reservas e as latências. Os carros
+// são distribuídos entre -conexoes conexões MQTT (0 = uma conexão por carro).
+
+import (
+	consts "MQTT/utils/Constantes"
+	topics "MQTT/utils/Topicos"
+	clientemqtt "MQTT/utils/mqttLib/ClienteMQTT"
+	router "MQTT/utils/mqttLib/Router"
+	storage "MQTT/utils/storage"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Resultado da viagem de um carro virtual
+const (
+	ResultadoOK      = "ok"
+	ResultadoErro    = "erro"      // 2PC abortado
+	ResultadoSemRota = "sem_rotas" // nenhuma rota viável
+	ResultadoTimeout = "timeout"   // o servidor não respondeu a tempo
+)
+
+type Config struct {
+	Carros    int
+	Conexoes  int
+	Taxa      float64 // carros iniciados por segundo
+	Prefixo   string
+	Politica  string
+	Timeout   time.Duration
+	Manter    time.Duration // tempo com a reserva antes de cancelar
+	Cancelar  bool
+	Saida     string
+	Detalhado bool
+}
+
+// Carro virtual: só o necessário para pedir rota e reservar
+type CarroVirtual struct {
+	Dados   consts.Carro
+	Destino string
+	Client  *clientemqtt.MQTTClient
+	rotas   chan consts.Mensagem
+	status  chan consts.Mensagem
+}
+
+// Medições de uma viagem
+type Medicao struct {
+	CarroID      string        `json:"carro"`
+	Origem       string        `json:"origem"`
+	Destino      string        `json:"destino"`
+	Resultado    string        `json:"resultado"`
+	LatenciaRota time.Duration `json:"latencia_rota_ns"`
+	LatenciaRes  time.Duration `json:"latencia_reserva_ns"`
+	Paradas      int           `json:"paradas"`
+}
+
+// Resumo impresso ao final e opcionalmente salvo em JSON (-saida)
+type Relatorio struct {
+	Carros         int                `json:"carros"`
+	Conexoes       int                `json:"conexoes"`
+	Duracao        string             `json:"duracao"`
+	Resultados     map[string]int     `json:"resultados"`
+	TaxaSucesso    float64            `json:"taxa_sucesso"`
+	ReservasPorSeg float64            `json:"reservas_por_segundo"`
+	LatenciaRota   map[string]float64 `json:"latencia_rota_ms"`
+	LatenciaRes    map[string]float64 `json:"latencia_reserva_ms"`
+	Medicoes       []Medicao          `json:"medicoes,omitempty"`
+}
+
+func lerConfig() Config {
+	var cfg Config
+	flag.IntVar(&cfg.Carros, "carros", 100, "número de carros virtuais")
+	flag.IntVar(&cfg.Conexoes, "conexoes", 0, "conexões MQTT compartilhadas pelos carros (0 = uma por carro)")
+	flag.Float64Var(&cfg.Taxa, "taxa", 50, "carros iniciados por segundo")
+	flag.StringVar(&cfg.Prefixo, "prefixo", "frota", "prefixo dos IDs dos carros")
+	flag.StringVar(&cfg.Politica, "politica", "aleatoria", "escolha da rota: primeira, barata, menos-paradas ou aleatoria")
+	flag.DurationVar(&cfg.Timeout, "timeout", 30*time.Second, "espera máxima por cada resposta do servidor")
+	flag.DurationVar(&cfg.Manter, "manter", 5*time.Second, "tempo com a reserva antes de cancelar")
+	flag.BoolVar(&cfg.Cancelar, "cancelar", true, "cancelar a reserva ao fim para liberar os postos")
+	flag.StringVar(&cfg.Saida, "saida", "", "arquivo JSON para salvar o relatório com as medições")
+	flag.BoolVar(&cfg.Detalhado, "detalhado", false, "mantém os logs das bibliotecas MQTT")
+	flag.Parse()
+	if cfg.Conexoes <= 0 || cfg.Conexoes > cfg.Carros {
+		cfg.Conexoes = cfg.Carros
+	}
+	return cfg
+}
+
+// Origem aleatória em uma cidade do registro e destino em outra
+func novoCarroVirtual(id string) *CarroVirtual {
+	lat, lon := consts.PosicaoAleatoria()
+	origem := consts.CidadeAtualDoCarro(lat, lon)
+	var destinos []string
+	for _, cidade := range consts.IDsCidades() {
+		if cidade != origem {
+			destinos = append(destinos, cidade)
+		}
+	}
+	capacidade := 60.0
+	return &CarroVirtual{
+		Dados: consts.Carro{
+			ID:                id,
+			Bateria:           capacidade * (0.1 + 0.9*rand.Float64()),
+			Lat:               lat,
+			Lon:               lon,
+			CapacidadeBateria: capacidade,
+			Consumobateria:    0.20,
+			Conectores:        []string{consts.ConectorCCS2, consts.ConectorTipo2},
+			TaxaMaxCargaKW:    100.0,
+		},
+		Destino: destinos[rand.Intn(len(destinos))],
+		rotas:   make(chan consts.Mensagem, 1),
+		status:  make(chan consts.Mensagem, 1),
+	}
+}
+
+// Registra os handlers dos carros no roteador da conexão. Deve rodar antes das
+// assinaturas, pois o roteador não é seguro para escrita concorrente.
+func registrarHandlers(r *router.Router, carro *CarroVirtual) {
+	encaminhar := func(destino chan consts.Mensagem) router.HandlerFunc {
+		return func(payload []byte) {
+			var msg consts.Mensagem
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				return
+			}
+			select {
+			case destino <- msg:
+			default: // resposta repetida
+			}
+		}
+	}
+	r.Register(topics.ServerResponteRoutes(carro.Dados.ID, "+"), encaminhar(carro.rotas))
+	r.Register(topics.ServerReserveStatus("+", carro.Dados.ID), encaminhar(carro.status))
+}
+
+// Custo estimado da rota: energia prevista × preço cotado
+func custoEstimado(paradas []consts.Parada) float64 {
+	total := 0.0
+	for _, parada := range paradas {
+		total += parada.EnergiaKWh * parada.CustoKW
+	}
+	return total
+}
+
+func escolherRota(rotas map[string][]consts.Parada, politica string) string {
+	nomes := make([]string, 0, len(rotas))
+	for nome := range rotas {
+		nomes = append(nomes, nome)
+	}
+	if len(nomes) == 0 {
+		return ""
+	}
+	sort.Strings(nomes)
+	if politica == "aleatoria" {
+		return nomes[rand.Intn(len(nomes))]
+	}
+	melhor := nomes[0]
+	for _, nome := range nomes[1:] {
+		paradas, atual := rotas[nome], rotas[melhor]
+		switch politica {
+		case "barata":
+			if custoEstimado(paradas) < custoEstimado(atual) {
+				melhor = nome
+			}
+		case "menos-paradas":
+			if len(paradas) < len(atual) || (len(paradas) == len(atual) && custoEstimado(paradas) < custoEstimado(atual)) {
+				melhor = nome
+			}
+		}
+	}
+	return melhor
+}
+
+// Converte o conteúdo da resposta de rotas em paradas por rota
+func decodificarRotas(msg consts.Mensagem) map[string][]consts.Parada {
+	rotas := make(map[string][]consts.Parada)
+	for nome, valor := range msg.Conteudo {
+		if nome == consts.ChaveResumosRotas {
+			continue
+		}
+		bytes, _ := json.Marshal(valor)
+		var paradas []consts.Parada
+		if err := json.Unmarshal(bytes, &paradas); err == nil && len(paradas) > 0 {
+			rotas[nome] = paradas
+		}
+	}
+	return rotas
+}
+
+// Pede a rota, escolhe conforme a política, reserva e (opcionalmente) cancela
+func (c *CarroVirtual) Viajar(cfg Config) Medicao {
+	medicao := Medicao{CarroID: c.Dados.ID, Origem: consts.CidadeAtualDoCarro(c.Dados.Lat, c.Dados.Lon), Destino: c.Destino}
+
+	trajeto, _ := json.Marshal(consts.Trajeto{CarroMQTT: c.Dados, Inicio: medicao.Origem, Destino: c.Destino})
+	inicio := time.Now()
+	c.Client.Publish(topics.CarroRequestRotas(c.Dados.ID, c.Destino), trajeto)
+	var resposta consts.Mensagem
+	select {
+	case resposta = <-c.rotas:
+		medicao.LatenciaRota = time.Since(inicio)
+	case <-time.After(cfg.Timeout):
+		medicao.Resultado = ResultadoTimeout
+		return medicao
+	}
+
+	rotas := decodificarRotas(resposta)
+	nome := escolherRota(rotas, cfg.Politica)
+	if nome == "" {
+		medicao.Resultado = ResultadoSemRota
+		return medicao
+	}
+	medicao.Paradas = len(rotas[nome])
+
+	reserva, _ := json.Marshal(consts.Reserva{Carro: c.Dados, Paradas: rotas[nome]})
+	inicio = time.Now()
+	c.Client.Publish(topics.CarroRequestReserva(c.Dados.ID, resposta.ID, resposta.Origem), reserva)
+	select {
+	case status := <-c.status:
+		medicao.LatenciaRes = time.Since(inicio)
+		if status.Conteudo["status"] == "OK" {
+			medicao.Resultado = ResultadoOK
+		} else {
+			medicao.Resultado = ResultadoErro
+		}
+	case <-time.After(cfg.Timeout):
+		medicao.Resultado = ResultadoTimeout
+		return medicao
+	}
+
+	if medicao.Resultado == ResultadoOK && cfg.Cancelar {
+		time.Sleep(cfg.Manter)
+		cancelamento, _ := json.Marshal(map[string]string{"IDCarro": c.Dados.ID, "Msg": "Cancelar Reserva"})
+		c.Client.Publish(topics.CarroRequestCancel(c.Dados.ID), cancelamento)
+	}
+	return medicao
+}
+
+// Percentis em milissegundos das latências medidas (zeros são ignorados)
+func percentis(latencias []time.Duration) map[string]float64 {
+	var validas []time.Duration
+	for _, l := range latencias {
+		if l > 0 {
+			validas = append(validas, l)
+		}
+	}
+	resultado := map[string]float64{}
+	if len(validas) == 0 {
+		return resultado
+	}
+	sort.Slice(validas, func(i, j int) bool { return validas[i] < validas[j] })
+	em := func(p float64) float64 {
+		indice := int(math.Ceil(p/100*float64(len(validas)))) - 1
+		indice = max(0, min(indice, len(validas)-1))
+		return float64(validas[indice].Microseconds()) / 1000
+	}
+	resultado["p50"] = em(50)
+	resultado["p90"] = em(90)
+	resultado["p99"] = em(99)
+	resultado["max"] = float64(validas[len(validas)-1].Microseconds()) / 1000
+	return resultado
+}
+
+func montarRelatorio(cfg Config, medicoes []Medicao, duracao time.Duration) Relatorio {
+	relatorio := Relatorio{
+		Carros:     cfg.Carros,
+		Conexoes:   cfg.Conexoes,
+		Duracao:    duracao.Round(time.Millisecond).String(),
+		Resultados: map[string]int{},
+	}
+	var rotas, reservas []time.Duration
+	for _, m := range medicoes {
+		relatorio.Resultados[m.Resultado]++
+		rotas = append(rotas, m.LatenciaRota)
+		reservas = append(reservas, m.LatenciaRes)
+	}
+	if len(medicoes) > 0 {
+		relatorio.TaxaSucesso = float64(relatorio.Resultados[ResultadoOK]) / float64(len(medicoes))
+	}
+	if duracao > 0 {
+		relatorio.ReservasPorSeg = float64(relatorio.Resultados[ResultadoOK]) / duracao.Seconds()
+	}
+	relatorio.LatenciaRota = percentis(rotas)
+	relatorio.LatenciaRes = percentis(reservas)
+	if cfg.Saida != "" {
+		relatorio.Medicoes = medicoes
+	}
+	return relatorio
+}
+
+func imprimirRelatorio(r Relatorio) {
+	fmt.Println("━━━━━━━━━━━━━━ RELATÓRIO DA FROTA ━━━━━━━━━━━━━━")
+	fmt.Printf("Carros: %d em %d conexão(ões), duração %s\n", r.Carros, r.Conexoes, r.Duracao)
+	fmt.Printf("Resultados: ok=%d erro=%d sem_rotas=%d timeout=%d\n", r.Resultados[ResultadoOK], r.Resultados[ResultadoErro], r.Resultados[ResultadoSemRota], r.Resultados[ResultadoTimeout])
+	fmt.Printf("Taxa de sucesso: %.1f%%  Vazão: %.2f reservas/s\n", r.TaxaSucesso*100, r.ReservasPorSeg)
+	fmt.Printf("Latência rota (ms):    p50=%.1f p90=%.1f p99=%.1f max=%.1f\n", r.LatenciaRota["p50"], r.LatenciaRota["p90"], r.LatenciaRota["p99"], r.LatenciaRota["max"])
+	fmt.Printf("Latência reserva (ms): p50=%.1f p90=%.1f p99=%.1f max=%.1f\n", r.LatenciaRes["p50"], r.LatenciaRes["p90"], r.LatenciaRes["p99"], r.LatenciaRes["max"])
+}
+
+func main() {
+	cfg := lerConfig()
+	storage.CarregarCidades()
+	if len(consts.IDsCidades()) < 2 {
+		log.Fatal("[FROTA] São necessárias ao menos duas cidades no registro.")
+	}
+	saidaLog := log.Writer()
+	if !cfg.Detalhado {
+		log.SetOutput(io.Discard) // As bibliotecas registram cada mensagem publicada e recebida
+	}
+	logFrota := log.New(saidaLog, "", log.LstdFlags)
+
+	// Distribui os carros entre as conexões
+	carros := make([]*CarroVirtual, cfg.Carros)
+	porConexao := make([][]*CarroVirtual, cfg.Conexoes)
+	for i := range carros {
+		carros[i] = novoCarroVirtual(fmt.Sprintf("%s-%05d", cfg.Prefixo, i))
+		porConexao[i%cfg.Conexoes] = append(porConexao[i%cfg.Conexoes], carros[i])
+	}
+
+	logFrota.Printf("[FROTA] Conectando %d carros em %d conexão(ões)...", cfg.Carros, cfg.Conexoes)
+	var conexoes []*clientemqtt.MQTTClient
+	for i, grupo := range porConexao {
+		r := router.NewRouter()
+		for _, carro := range grupo {
+			registrarHandlers(r, carro)
+		}
+		// Com uma conexão por carro, o LWT avisa os servidores como no carro real
+		lwt := topics.CarroDesconectado(fmt.Sprintf("%s-conexao-%d", cfg.Prefixo, i))
+		if len(grupo) == 1 {
+			lwt = topics.CarroDesconectado(grupo[0].Dados.ID)
+		}
+		client := clientemqtt.NewClient(string(consts.Broker), r, lwt, fmt.Sprintf("%s-conexao-%d", cfg.Prefixo, i))
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			logFrota.Fatalf("[FROTA] Erro ao conectar ao broker: %v", token.Error())
+		}
+		for _, carro := range grupo {
+			carro.Client = client
+			client.Subscribe(topics.ServerResponteRoutes(carro.Dados.ID, "+"))
+			client.Subscribe(topics.ServerReserveStatus("+", carro.Dados.ID))
+		}
+		conexoes = append(conexoes, client)
+	}
+
+	logFrota.Printf("[FROTA] Iniciando %d viagens a %.0f carros/s (política %s)...", cfg.Carros, cfg.Taxa, cfg.Politica)
+	medicoes := make([]Medicao, len(carros))
+	var wg sync.WaitGroup
+	intervalo := time.Duration(float64(time.Second) / math.Max(cfg.Taxa, 0.001))
+	inicio := time.Now()
+	for i, carro := range carros {
+		wg.Add(1)
+		go func(i int, carro *CarroVirtual) {
+			defer wg.Done()
+			medicoes[i] = carro.Viajar(cfg)
+		}(i, carro)
+		time.Sleep(intervalo)
+	}
+	wg.Wait()
+	duracao := time.Since(inicio)
+
+	relatorio := montarRelatorio(cfg, medicoes, duracao)
+	imprimirRelatorio(relatorio)
+	if cfg.Saida != "" {
+		data, _ := json.MarshalIndent(relatorio, "", "  ")
+		if err := os.WriteFile(cfg.Saida, data, 0644); err != nil {
+			logFrota.Printf("[FROTA] Erro ao salvar o relatório: %v", err)
+		}
+	}
+
+	// Dá tempo para os cancelamentos chegarem ao broker antes de desconectar
+	time.Sleep(time.Second)
+	for _, client := range conexoes {
+		client.Client.Disconnect(250)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+// Importa postos de recarga reais a partir de um arquivo GeoJSON (ex: exportação do
+// OpenStreetMap via Overpass com amenity=charging_station) e gera os arquivos JSON
+// por cidade no mesmo formato lido pelos servidores.
+
+import (
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id"` // Ex: "node/123456" na exportação do Overpass
+	Geometry   Geometria              `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type Geometria struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Mapeamento das tags de soquete do OSM para os tipos de conector do sistema
+var soquetesOSM = map[string]string{
+	"type2":       consts.ConectorTipo2,
+	"type2_combo": consts.ConectorCCS2,
+	"chademo":     consts.ConectorCHAdeMO,
+}
+
+var regexPotencia = regexp.MustCompile(`([0-9]+(?:[.,][0-9]+)?)\s*kW`)
+
+// Extrai latitude e longitude do ponto (GeoJSON usa a ordem [lon, lat])
+func extrairPosicao(g Geometria) (float64, float64, error) {
+	switch g.Type {
+	case "Point":
+		var coords []float64
+		if err := json.Unmarshal(g.Coordinates, &coords); err != nil || len(coords) < 2 {
+			return 0, 0, fmt.Errorf("coordenadas inválidas: %s", string(g.Coordinates))
+		}
+		return coords[1], coords[0], nil
+	case "Polygon":
+		// Usa o centróide simples do anel externo
+		var aneis [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &aneis); err != nil || len(aneis) == 0 || len(aneis[0]) == 0 {
+			return 0, 0, fmt.Errorf("polígono inválido")
+		}
+		var lat, lon float64
+		for _, p := range aneis[0] {
+			lon += p[0]
+			lat += p[1]
+		}
+		n := float64(len(aneis[0]))
+		return lat / n, lon / n, nil
+	}
+	return 0, 0, fmt.Errorf("geometria não suportada: %s", g.Type)
+}
+
+func propriedadeTexto(props map[string]interface{}, chaves ...string) string {
+	for _, chave := range chaves {
+		if v, ok := props[chave]; ok && v != nil {
+			switch valor := v.(type) {
+			case string:
+				if valor != "" {
+					return valor
+				}
+			case float64:
+				return strconv.FormatFloat(valor, 'f', -1, 64)
+			}
+		}
+	}
+	return ""
+}
+
+// ID estável do posto a partir do identificador do OSM (ex: "FSA-node-123456"), para que
+// importar o mesmo arquivo de novo não troque os IDs já usados em reservas. Features sem
+// identificador recebem um ID aleatório como as demais entidades.
+func idDoPosto(cidade string, feature Feature, props map[string]interface{}) string {
+	osm := propriedadeTexto(props, "@id", "id")
+	if osm == "" {
+		osm = propriedadeTexto(map[string]interface{}{"id": feature.ID}, "id")
+	}
+	if osm == "" {
+		return consts.NovoID(cidade)
+	}
+	return cidade + "-" + strings.ReplaceAll(osm, "/", "-")
+}
+
+func lerPotencia(texto string) float64 {
+	m := regexPotencia.FindStringSubmatch(texto)
+	if m == nil {
+		return 0
+	}
+	valor, _ := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	return valor
+}
+
+// Monta os conectores a partir das tags socket:* do OSM. Cada soquete gera um conector.
+func extrairConectores(idPosto string, props map[string]interface{}, potenciaPadrao float64) []consts.Conector {
+	conectores := []consts.Conector{}
+	tagsOrdenadas := make([]string, 0, len(soquetesOSM))
+	for tag := range soquetesOSM {
+		tagsOrdenadas = append(tagsOrdenadas, tag)
+	}
+	sort.Strings(tagsOrdenadas)
+
+	for _, tag := range tagsOrdenadas {
+		quantidade, err := strconv.Atoi(propriedadeTexto(props, "socket:"+tag))
+		if err != nil || quantidade <= 0 {
+			continue
+		}
+		potencia := lerPotencia(propriedadeTexto(props, "socket:"+tag+":output"))
+		if potencia == 0 {
+			potencia = potenciaPadrao
+		}
+		for i := 0; i < quantidade; i++ {
+			conectores = append(conectores, consts.Conector{
+				ID:         fmt.Sprintf("%s-C%d", idPosto, len(conectores)+1),
+				Tipo:       soquetesOSM[tag],
+				PotenciaKW: potencia,
+				Status:     consts.ConectorLivre,
+				Fila:       []consts.Carro{},
+			})
+		}
+	}
+
+	// Sem informação de soquete: assume um conector Tipo 2
+	if len(conectores) == 0 {
+		conectores = append(conectores, consts.Conector{
+			ID:         idPosto + "-C1",
+			Tipo:       consts.ConectorTipo2,
+			PotenciaKW: potenciaPadrao,
+			Status:     consts.ConectorLivre,
+			Fila:       []consts.Carro{},
+		})
+	}
+	return conectores
+}
+
+func main() {
+	entrada := flag.String("entrada", "", "arquivo GeoJSON com os postos de recarga")
+	saida := flag.String("saida", "utils/data", "diretório onde os JSON por cidade serão escritos")
+	arquivoCidades := flag.String("cidades", "utils/data/Cidades.json", "registro de cidades (cobertura e arquivo de postos)")
+	custoPadrao := flag.Float64("custo", 0.90, "custo por kWh usado quando o posto não informa preço")
+	potenciaPadrao := flag.Float64("potencia", 22, "potência (kW) usada quando o soquete não informa saída")
+	flag.Parse()
+
+	if *entrada == "" {
+		log.Fatalf("[IMPORTADOR] Informe o arquivo GeoJSON com -entrada")
+	}
+
+	cidades, err := storage.LerCidades(*arquivoCidades)
+	if err != nil {
+		log.Fatalf("[IMPORTADOR] %v", err)
+	}
+	consts.RegistrarCidades(cidades)
+
+	data, err := os.ReadFile(*entrada)
+	if err != nil {
+		log.Fatalf("[IMPORTADOR] Erro ao ler %s: %v", *entrada, err)
+	}
+
+	var colecao FeatureCollection
+	if err := json.Unmarshal(data, &colecao); err != nil {
+		log.Fatalf("[IMPORTADOR] Erro ao desserializar GeoJSON: %v", err)
+	}
+
+	postosPorCidade := make(map[string][]consts.Posto)
+	ignorados := 0
+	for _, feature := range colecao.Features {
+		lat, lon, err := extrairPosicao(feature.Geometry)
+		if err != nil {
+			log.Printf("[IMPORTADOR] Feature ignorada: %v", err)
+			ignorados++
+			continue
+		}
+		cidade := consts.CidadeDaPosicao(lat, lon)
+		if info, ok := consts.BuscarCidade(cidade); !ok || info.Arquivo == "" {
+			ignorados++
+			continue
+		}
+
+		props := feature.Properties
+		if props == nil {
+			props = map[string]interface{}{}
+		}
+		id := idDoPosto(cidade, feature, props)
+		nome := propriedadeTexto(props, "name", "nome", "operator", "brand")
+		if nome == "" {
+			nome = fmt.Sprintf("Posto %d - %s", len(postosPorCidade[cidade])+1, cidade)
+		}
+		custo, err := strconv.ParseFloat(propriedadeTexto(props, "custokw", "charge:kwh"), 64)
+		if err != nil || custo <= 0 {
+			custo = *custoPadrao
+		}
+
+		postosPorCidade[cidade] = append(postosPorCidade[cidade], consts.Posto{
+			Id:         id,
+			Nome:       nome,
+			Cidade:     cidade,
+			Lat:        lat,
+			Lon:        lon,
+			CustoKW:    custo,
+			Operador:   propriedadeTexto(props, "operator", "brand"),
+			Conectores: extrairConectores(id, props, *potenciaPadrao),
+		})
+	}
+
+	for cidade, postos := range postosPorCidade {
+		info, _ := consts.BuscarCidade(cidade)
+		caminho := filepath.Join(*saida, info.Arquivo)
+		conteudo, err := json.MarshalIndent(map[string][]consts.Posto{cidade: postos}, "", "  ")
+		if err != nil {
+			log.Fatalf("[IMPORTADOR] Erro ao serializar postos de %s: %v", cidade, err)
+		}
+		if err := os.WriteFile(caminho, conteudo, 0644); err != nil {
+			log.Fatalf("[IMPORTADOR] Erro ao escrever %s: %v", caminho, err)
+		}
+		log.Printf("[IMPORTADOR] %d postos de %s gravados em %s", len(postos), cidade, caminho)
+	}
+	log.Printf("[IMPORTADOR] %d features ignoradas (fora de cobertura ou inválidas)", ignorados)
+}
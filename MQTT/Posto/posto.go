@@ -0,0 +1,317 @@
+package main
+
+// Simulador de posto de recarga. Cada posto do arquivo da cidade (ou da lista POSTOS)
+// conecta ao broker, recebe os comandos do servidor em station/<id>/command/*, envia
+// heartbeats em station/<id>/status e publica os eventos de início e fim da recarga.
+
+import (
+	ambiente "MQTT/utils/Ambiente"
+	consts "MQTT/utils/Constantes"
+	topics "MQTT/utils/Topicos"
+	clientemqtt "MQTT/utils/mqttLib/ClienteMQTT"
+	router "MQTT/utils/mqttLib/Router"
+	storage "MQTT/utils/storage"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Recarga em andamento em um conector
+type recarga struct {
+	comando    consts.ComandoPosto
+	potenciaKW float64
+	energiaKWh float64
+	parar      chan struct{}
+	parada     bool // parada já solicitada
+}
+
+type Posto struct {
+	ID         string
+	Client     *clientemqtt.MQTTClient
+	mutex      sync.Mutex
+	conectores map[string]string   // status de cada conector
+	reservas   map[string][]string // sessões reservadas em cada conector, na ordem da fila
+	recargas   map[string]*recarga // recargas em andamento por conector
+	ordem      []string            // ordem dos conectores no status
+}
+
+var (
+	potenciaPadrao     = ambiente.Float("POTENCIA_KW", 0) // 0 usa a potência enviada pelo servidor
+	intervaloHeartbeat = ambiente.Duracao("INTERVALO_HEARTBEAT", 5*time.Second)
+)
+
+const passoSimulacao = time.Second
+
+func NovoPosto(dados consts.Posto) *Posto {
+	p := &Posto{
+		ID:         dados.Id,
+		conectores: make(map[string]string),
+		reservas:   make(map[string][]string),
+		recargas:   make(map[string]*recarga),
+	}
+	for _, conector := range dados.Conectores {
+		p.conectores[conector.ID] = consts.ConectorLivre
+		p.ordem = append(p.ordem, conector.ID)
+	}
+
+	lwt, err := json.Marshal(consts.StatusPosto{ID: p.ID, Online: false})
+	if err != nil {
+		log.Fatalf("[POSTO] Erro ao serializar LWT: %v", err)
+	}
+
+	routerPosto := router.NewRouter()
+	routerPosto.Register(topics.ServerCommandReserve(p.ID), p.comando(p.reservar))
+	routerPosto.Register(topics.ServerCommandCancel(p.ID), p.comando(p.cancelar))
+	routerPosto.Register(topics.ServerCommandStart(p.ID), p.comando(p.iniciar))
+	routerPosto.Register(topics.ServerCommandStop(p.ID), p.comando(p.parar))
+	p.Client = clientemqtt.NewClientWithWill(consts.Broker, routerPosto, topics.StationStatus(p.ID), lwt, false)
+	return p
+}
+
+// Desserializa o comando antes de repassar ao tratador
+func (p *Posto) comando(tratador func(consts.ComandoPosto)) router.HandlerFunc {
+	return func(payload []byte) {
+		var cmd consts.ComandoPosto
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			log.Printf("[POSTO %s] Comando inválido: %v", p.ID, err)
+			return
+		}
+		tratador(cmd)
+	}
+}
+
+func (p *Posto) Conectar() {
+	if token := p.Client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("[POSTO %s] Erro ao conectar: %v", p.ID, token.Error())
+	}
+	for _, topico := range []string{
+		topics.ServerCommandReserve(p.ID),
+		topics.ServerCommandCancel(p.ID),
+		topics.ServerCommandStart(p.ID),
+		topics.ServerCommandStop(p.ID),
+	} {
+		p.Client.Subscribe(topico)
+	}
+	log.Printf("[POSTO %s] Conectado com %d conectores.", p.ID, len(p.ordem))
+}
+
+func (p *Posto) Heartbeat() {
+	p.publicarStatus()
+	for range time.Tick(intervaloHeartbeat) {
+		p.publicarStatus()
+	}
+}
+
+func (p *Posto) publicarStatus() {
+	p.mutex.Lock()
+	status := consts.StatusPosto{ID: p.ID, Online: true, Timestamp: time.Now()}
+	for _, id := range p.ordem {
+		conector := consts.StatusConector{ID: id, Status: p.conectores[id]}
+		if r, ok := p.recargas[id]; ok {
+			conector.SessaoID = r.comando.SessaoID
+			conector.EnergiaKWh = r.energiaKWh
+		} else if fila := p.reservas[id]; len(fila) > 0 {
+			conector.SessaoID = fila[0]
+		}
+		status.Conectores = append(status.Conectores, conector)
+	}
+	p.mutex.Unlock()
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("[POSTO %s] Erro ao serializar status: %v", p.ID, err)
+		return
+	}
+	p.Client.Publish(topics.StationStatus(p.ID), statusJSON)
+}
+
+func (p *Posto) publicarEvento(topico string, evento consts.EventoPosto) {
+	evento.PostoID = p.ID
+	evento.Timestamp = time.Now()
+	eventoJSON, err := json.Marshal(evento)
+	if err != nil {
+		log.Printf("[POSTO %s] Erro ao serializar evento: %v", p.ID, err)
+		return
+	}
+	p.Client.Publish(topico, eventoJSON)
+}
+
+func (p *Posto) reservar(cmd consts.ComandoPosto) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.conectores[cmd.ConectorID]; !ok {
+		log.Printf("[POSTO %s] Conector %s desconhecido.", p.ID, cmd.ConectorID)
+		return
+	}
+	if p.removerReserva(cmd.ConectorID, cmd.SessaoID) {
+		log.Printf("[POSTO %s] Reserva %s repetida no conector %s.", p.ID, cmd.SessaoID, cmd.ConectorID)
+	}
+	p.reservas[cmd.ConectorID] = append(p.reservas[cmd.ConectorID], cmd.SessaoID)
+	p.atualizarStatus(cmd.ConectorID)
+	log.Printf("[POSTO %s] Conector %s reservado para o carro %s (%d na fila).", p.ID, cmd.ConectorID, cmd.CarroID, len(p.reservas[cmd.ConectorID]))
+}
+
+func (p *Posto) cancelar(cmd consts.ComandoPosto) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.removerReserva(cmd.ConectorID, cmd.SessaoID) {
+		return
+	}
+	p.atualizarStatus(cmd.ConectorID)
+	log.Printf("[POSTO %s] Reserva %s do conector %s cancelada.", p.ID, cmd.SessaoID, cmd.ConectorID)
+}
+
+// Tira a sessão da fila de reservas do conector; chamado com p.mutex travado
+func (p *Posto) removerReserva(conectorID, sessaoID string) bool {
+	fila := p.reservas[conectorID]
+	for i, id := range fila {
+		if id == sessaoID {
+			p.reservas[conectorID] = append(fila[:i:i], fila[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Ocupado enquanto houver recarga; senão pendente se houver reserva na fila, ou livre.
+// Chamado com p.mutex travado.
+func (p *Posto) atualizarStatus(conectorID string) {
+	switch {
+	case p.recargas[conectorID] != nil:
+		p.conectores[conectorID] = consts.ConectorOcupado
+	case len(p.reservas[conectorID]) > 0:
+		p.conectores[conectorID] = consts.ConectorPendente
+	default:
+		p.conectores[conectorID] = consts.ConectorLivre
+	}
+}
+
+func (p *Posto) iniciar(cmd consts.ComandoPosto) {
+	p.mutex.Lock()
+	if _, ok := p.conectores[cmd.ConectorID]; !ok {
+		p.mutex.Unlock()
+		log.Printf("[POSTO %s] Conector %s desconhecido.", p.ID, cmd.ConectorID)
+		return
+	}
+	if _, ok := p.recargas[cmd.ConectorID]; ok {
+		p.mutex.Unlock()
+		log.Printf("[POSTO %s] Conector %s já está carregando.", p.ID, cmd.ConectorID)
+		return
+	}
+	potencia := cmd.PotenciaKW
+	if potenciaPadrao > 0 {
+		potencia = potenciaPadrao
+	}
+	r := &recarga{comando: cmd, potenciaKW: potencia, parar: make(chan struct{})}
+	p.recargas[cmd.ConectorID] = r
+	p.removerReserva(cmd.ConectorID, cmd.SessaoID)
+	p.atualizarStatus(cmd.ConectorID)
+	p.mutex.Unlock()
+
+	log.Printf("[POSTO %s] Iniciando recarga do carro %s no conector %s a %.1f kW.", p.ID, cmd.CarroID, cmd.ConectorID, potencia)
+	p.publicarEvento(topics.StationEventStarted(p.ID), consts.EventoPosto{
+		SessaoID:   cmd.SessaoID,
+		ConectorID: cmd.ConectorID,
+		CarroID:    cmd.CarroID,
+	})
+	go p.simular(r)
+}
+
+func (p *Posto) parar(cmd consts.ComandoPosto) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	r, ok := p.recargas[cmd.ConectorID]
+	if !ok || r.comando.SessaoID != cmd.SessaoID {
+		log.Printf("[POSTO %s] Nenhuma recarga da sessão %s no conector %s.", p.ID, cmd.SessaoID, cmd.ConectorID)
+		return
+	}
+	if !r.parada {
+		r.parada = true
+		close(r.parar)
+	}
+}
+
+// Acumula energia a cada passo (acelerado por FATOR_TEMPO) até o comando de parada ou a bateria encher
+func (p *Posto) simular(r *recarga) {
+	ticker := time.NewTicker(passoSimulacao)
+	defer ticker.Stop()
+	passoHoras := passoSimulacao.Hours() * consts.FatorTempo()
+
+simulacao:
+	for {
+		select {
+		case <-r.parar:
+			break simulacao
+		case <-ticker.C:
+			p.mutex.Lock()
+			r.energiaKWh += r.potenciaKW * passoHoras
+			cheia := r.comando.EnergiaMaxKWh > 0 && r.energiaKWh >= r.comando.EnergiaMaxKWh
+			if cheia {
+				r.energiaKWh = r.comando.EnergiaMaxKWh
+			}
+			p.mutex.Unlock()
+			if cheia {
+				log.Printf("[POSTO %s] Bateria do carro %s cheia.", p.ID, r.comando.CarroID)
+				break simulacao
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	energia := r.energiaKWh
+	delete(p.recargas, r.comando.ConectorID)
+	p.atualizarStatus(r.comando.ConectorID)
+	p.mutex.Unlock()
+
+	log.Printf("[POSTO %s] Recarga do carro %s encerrada: %.2f kWh.", p.ID, r.comando.CarroID, energia)
+	p.publicarEvento(topics.StationEventFinished(p.ID), consts.EventoPosto{
+		SessaoID:   r.comando.SessaoID,
+		ConectorID: r.comando.ConectorID,
+		CarroID:    r.comando.CarroID,
+		EnergiaKWh: energia,
+	})
+}
+
+// POSTOS restringe os postos simulados (ex: "FSA01,FSA02"); vazio simula todos os da cidade
+func postosSimulados() []consts.Posto {
+	todos := storage.CarregarPostos()
+	filtro := os.Getenv("POSTOS")
+	if filtro == "" {
+		return todos
+	}
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(filtro, ",") {
+		ids[strings.TrimSpace(id)] = true
+	}
+	var selecionados []consts.Posto
+	for _, posto := range todos {
+		if ids[posto.Id] {
+			selecionados = append(selecionados, posto)
+		}
+	}
+	return selecionados
+}
+
+func main() {
+	dados := postosSimulados()
+	if len(dados) == 0 {
+		log.Fatalf("[POSTO] Nenhum posto para simular (CIDADE=%s, POSTOS=%s)", os.Getenv("CIDADE"), os.Getenv("POSTOS"))
+	}
+
+	for _, d := range dados {
+		posto := NovoPosto(d)
+		posto.Conectar()
+		go posto.Heartbeat()
+	}
+	log.Printf("[POSTO] %d postos simulados (fator de tempo %.0fx).", len(dados), consts.FatorTempo())
+
+	sinal := make(chan os.Signal, 1)
+	signal.Notify(sinal, syscall.SIGINT, syscall.SIGTERM)
+	<-sinal
+	log.Println("[POSTO] Encerrando simulador.")
+}
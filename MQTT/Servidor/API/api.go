@@ -1,23 +1,61 @@
 package api
 
 import (
+	carteira "MQTT/Servidor/Carteira"
+	faturamento "MQTT/Servidor/Faturamento"
+	monitor "MQTT/Servidor/Monitor"
+	precos "MQTT/Servidor/Precos"
+	sessoes "MQTT/Servidor/Sessoes"
 	consts "MQTT/utils/Constantes"
 	storage "MQTT/utils/storage"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 var postosMutex sync.Mutex
 
+// Servidor HTTP em execução, parado por EncerrarHTTP
+var servidorHTTP *http.Server
+
+// Estado do servidor compartilhado com os handlers HTTP
+type Dependencias struct {
+	Cidade  string
+	Sessoes *sessoes.Gerenciador
+	Monitor *monitor.Monitor // Heartbeats dos postos; postos offline ficam fora do planejamento
+	Faturas *faturamento.Faturador
+	Precos  *precos.Motor // Cotações dos postos desta cidade
+	// Quantos carros cada conector aceita na fila (1 = só reserva conectores livres)
+	ProfundidadeFila int
+	// Carteiras dos carros; nil se este não for o servidor das carteiras
+	Carteiras *carteira.Carteiras
+	// Monta a fatura da viagem consultando os servidores participantes da transação
+	ConsolidarViagem func(transacaoID string) consts.FaturaViagem
+	// Chamado para cada sessão criada por um commit (ex: avisar o posto da reserva)
+	AoReservarSessao func(consts.SessaoRecarga)
+	// Chamado para cada sessão abortada por uma liberação (ex: parar o posto e avisar o carro)
+	AoAbortarSessao func(consts.SessaoRecarga)
+	// Chamado quando abre vaga para um carro da lista de espera (ex: avisar o carro)
+	AoPromoverDaEspera func(consts.VagaEspera)
+	// Chamado depois que uma liberação tira o carro de um conector (ex: iniciar a recarga
+	// do próximo da fila e promover a lista de espera)
+	AoLiberarConector func(postoID, conectorID string)
+	// Indica que o servidor está encerrando: novas transações 2PC são recusadas, mas
+	// commit, abort e release das que já começaram continuam sendo atendidos
+	Encerrando func() bool
+}
 
-func ServerAPICommunication(arquivoPontos string) {
+
+func ServerAPICommunication(arquivoPontos string, deps Dependencias) {
 
 	r := gin.Default()
 
@@ -37,15 +75,20 @@ func ServerAPICommunication(arquivoPontos string) {
 	})
 
 	r.GET("/postos/disponiveis", func(c *gin.Context) {
-		postos, err := storage.GetPostosDisponiveis(arquivoPontos)
+		postos, err := storage.GetPostosDisponiveis(arquivoPontos, deps.ProfundidadeFila)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		postos = deps.Monitor.FiltrarOnline(postos)
 		if len(postos) == 0 {
 			c.JSON(http.StatusNotFound, gin.H{"error": "nenhum posto disponível encontrado"})
 			return
 		}
+		for _, p := range postos {
+			cotacao := deps.Precos.Cotar(*p)
+			p.Cotacao = &cotacao
+		}
 		c.JSON(http.StatusOK, postos)
 	})
 
@@ -66,13 +109,15 @@ func ServerAPICommunication(arquivoPontos string) {
 		var postoAtualizado *consts.Posto
 		for _, p := range postos {
 			if p.Id == id {
-				// Verifica se já existe um carro na fila
-				if len(p.Fila) > 0 {
-					c.JSON(http.StatusConflict, gin.H{"error": "Já existe um carro na fila"})
+				// Procura um conector compatível com vaga na fila
+				conector := p.ConectorParaReserva(carro, deps.ProfundidadeFila)
+				if conector == nil {
+					c.JSON(http.StatusConflict, gin.H{"error": "Nenhum conector compatível com vaga"})
 					return
 				}
-				// Adiciona o carro à fila
-				p.Fila = append(p.Fila, carro)
+				// Adiciona o carro à fila do conector
+				conector.Fila = append(conector.Fila, carro)
+				conector.AtualizarStatus()
 				postoAtualizado = p
 				break
 			}
@@ -108,12 +153,8 @@ func ServerAPICommunication(arquivoPontos string) {
 		var postoAtualizado *consts.Posto
 		for _, p := range postos {
 			if p.Id == id {
-				for i, c := range p.Fila {
-					if c.ID == carro.ID {
-						p.Fila = append(p.Fila[:i], p.Fila[i+1:]...)
-						postoAtualizado = p
-						break
-					}
+				if p.RemoverCarro(carro.ID) {
+					postoAtualizado = p
 				}
 				break
 			}
@@ -133,13 +174,26 @@ func ServerAPICommunication(arquivoPontos string) {
 	})
 	r.POST("/2pc/prepare", func(c *gin.Context) {
 		var req struct {
-			PostoID string       `json:"posto_id"`
-			Carro   consts.Carro `json:"carro"`
+			TransacaoID     string       `json:"transacao_id"`
+			PostoID         string       `json:"posto_id"`
+			ConectorID      string       `json:"conector_id"`
+			CotacaoID       string       `json:"cotacao_id"`
+			ChegadaPrevista time.Time    `json:"chegada_prevista"`
+			Carro           consts.Carro `json:"carro"`
+			Motivo          string       `json:"motivo"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"result": "abort", "error": "Dados inválidos"})
 			return
 		}
+		if err := deps.Sessoes.ValidarChegada(req.ChegadaPrevista, time.Now()); err != nil {
+			c.JSON(http.StatusOK, gin.H{"result": "abort", "error": err.Error()})
+			return
+		}
+		if deps.Encerrando != nil && deps.Encerrando() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"result": "abort", "error": "Servidor encerrando"})
+			return
+		}
 
 		postosMutex.Lock()
 		defer postosMutex.Unlock()
@@ -151,14 +205,33 @@ func ServerAPICommunication(arquivoPontos string) {
 
 		for _, p := range postos {
 			if p.Id == req.PostoID {
-				if len(p.Fila) > 0 || p.Pendente != nil {
+				if !deps.Monitor.Online(p.Id) {
+					c.JSON(http.StatusOK, gin.H{"result": "abort", "error": "Posto offline"})
+					return
+				}
+				// Sem conector informado, escolhe o conector compatível com menor espera
+				var conector *consts.Conector
+				if req.ConectorID == "" {
+					conector = p.ConectorParaReserva(req.Carro, deps.ProfundidadeFila)
+				} else {
+					conector = p.BuscarConector(req.ConectorID)
+				}
+				if conector == nil || !conector.AceitaReserva(deps.ProfundidadeFila) || !conector.Compativel(req.Carro) {
 					c.JSON(http.StatusOK, gin.H{"result": "abort"})
 					return
 				}
+				// Trava o preço cotado no planejamento para esta transação
+				preco, err := deps.Precos.Travar(req.CotacaoID, req.TransacaoID, *p)
+				if err != nil {
+					log.Printf("[API - PREPARE] %v", err)
+					c.JSON(http.StatusOK, gin.H{"result": "abort", "error": err.Error()})
+					return
+				}
 				// Marca como pendente
-				p.Pendente = &req.Carro
+				conector.Pendente = &req.Carro
+				conector.AtualizarStatus()
 				storage.AtualizarArquivo(arquivoPontos, postos)
-				c.JSON(http.StatusOK, gin.H{"result": "ok"})
+				c.JSON(http.StatusOK, gin.H{"result": "ok", "conector_id": conector.ID, "preco_kwh": fmt.Sprintf("%.2f", preco)})
 				return
 			}
 		}
@@ -167,8 +240,13 @@ func ServerAPICommunication(arquivoPontos string) {
 	})
 	r.POST("/2pc/commit", func(c *gin.Context) {
 		var req struct {
-			PostoID string       `json:"posto_id"`
-			Carro   consts.Carro `json:"carro"`
+			TransacaoID     string       `json:"transacao_id"`
+			PostoID         string       `json:"posto_id"`
+			ConectorID      string       `json:"conector_id"`
+			CotacaoID       string       `json:"cotacao_id"`
+			ChegadaPrevista time.Time    `json:"chegada_prevista"`
+			Carro           consts.Carro `json:"carro"`
+			Motivo          string       `json:"motivo"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"result": "abort", "error": "Dados inválidos"})
@@ -186,11 +264,27 @@ func ServerAPICommunication(arquivoPontos string) {
 		var postoAtualizado *consts.Posto
 		for _, p := range postos {
 			if p.Id == req.PostoID {
-				// Só faz commit se o pendente for o mesmo carro
-				if p.Pendente != nil && p.Pendente.ID == req.Carro.ID {
-					p.Fila = append(p.Fila, req.Carro)
-					p.Pendente = nil // limpa pendente
-					postoAtualizado = p
+				for i := range p.Conectores {
+					conector := &p.Conectores[i]
+					if req.ConectorID != "" && conector.ID != req.ConectorID {
+						continue
+					}
+					// Só faz commit se o pendente for o mesmo carro
+					if conector.Pendente != nil && conector.Pendente.ID == req.Carro.ID {
+						conector.Fila = append(conector.Fila, req.Carro)
+						conector.Pendente = nil // limpa pendente
+						conector.AtualizarStatus()
+						postoAtualizado = p
+						preco, ok := deps.Precos.Consumir(req.CotacaoID, req.TransacaoID)
+						if !ok {
+							preco = deps.Precos.Cotar(*p).PrecoKWh
+						}
+						sessao := deps.Sessoes.Reservar(req.TransacaoID, deps.Cidade, req.Carro, p, conector, preco, req.ChegadaPrevista)
+						if deps.AoReservarSessao != nil {
+							deps.AoReservarSessao(sessao)
+						}
+						break
+					}
 				}
 				break
 			}
@@ -211,8 +305,12 @@ func ServerAPICommunication(arquivoPontos string) {
 
 	r.POST("/2pc/abort", func(c *gin.Context) {
 		var req struct {
-			PostoID string       `json:"posto_id"`
-			Carro   consts.Carro `json:"carro"`
+			TransacaoID string       `json:"transacao_id"`
+			PostoID     string       `json:"posto_id"`
+			ConectorID  string       `json:"conector_id"`
+			CotacaoID   string       `json:"cotacao_id"`
+			Carro       consts.Carro `json:"carro"`
+			Motivo      string       `json:"motivo"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"result": "abort", "error": "Dados inválidos"})
@@ -220,6 +318,7 @@ func ServerAPICommunication(arquivoPontos string) {
 		}
 		postosMutex.Lock()
 		defer postosMutex.Unlock()
+		deps.Precos.Destravar(req.CotacaoID, req.TransacaoID)
 
 		postos, err := storage.GetPostosFromJSON(arquivoPontos)
 		if err != nil {
@@ -228,45 +327,78 @@ func ServerAPICommunication(arquivoPontos string) {
 		}
 
 		for _, p := range postos {
-			if p.Id == req.PostoID && p.Pendente != nil && p.Pendente.ID == req.Carro.ID {
-				p.Pendente = nil
-				storage.AtualizarArquivo(arquivoPontos, postos)
-				break
+			if p.Id != req.PostoID {
+				continue
 			}
+			for i := range p.Conectores {
+				conector := &p.Conectores[i]
+				if req.ConectorID != "" && conector.ID != req.ConectorID {
+					continue
+				}
+				if conector.Pendente != nil && conector.Pendente.ID == req.Carro.ID {
+					conector.Pendente = nil
+					conector.AtualizarStatus()
+					storage.AtualizarArquivo(arquivoPontos, postos)
+					break
+				}
+			}
+			break
 		}
 		c.JSON(http.StatusOK, gin.H{"result": "aborted"})
 	})
 
 	r.POST("/2pc/release", func(c *gin.Context){
 		var req struct {
-			PostoID string       `json:"posto_id"`
-			Carro   consts.Carro `json:"carro"`
+			TransacaoID string       `json:"transacao_id"`
+			PostoID     string       `json:"posto_id"`
+			ConectorID  string       `json:"conector_id"`
+			CotacaoID   string       `json:"cotacao_id"`
+			Carro       consts.Carro `json:"carro"`
+			Motivo      string       `json:"motivo"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Dados inválidos"})
 			return
 		}
+		postosMutex.Lock()
 	
 		postos, err := storage.GetPostosFromJSON(arquivoPontos)
 		if err != nil {
+			postosMutex.Unlock()
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": "Erro ao ler postos"})
 			return
 		}
 	
 		postoEncontrado := false
+		var liberados []string // Conectores de onde o carro saiu
 		for _, p := range postos {
 			if p.Id == req.PostoID {
-				newFila := []consts.Carro{}
 				removed := false
-				for _, fCarro := range p.Fila {
-					if fCarro.ID == req.Carro.ID { // Remove o carro específico
-						removed = true
-					} else {
-						newFila = append(newFila, fCarro)
+				if conector := p.BuscarConector(req.ConectorID); conector != nil {
+					// Libera apenas o conector reservado
+					for i, fCarro := range conector.Fila {
+						if fCarro.ID == req.Carro.ID {
+							conector.Fila = append(conector.Fila[:i], conector.Fila[i+1:]...)
+							removed = true
+							liberados = append(liberados, conector.ID)
+							break
+						}
 					}
+					conector.AtualizarStatus()
+				} else {
+					liberados = ConectoresDoCarro(p, req.Carro.ID)
+					removed = p.RemoverCarro(req.Carro.ID) // Remove o carro específico
 				}
-				p.Fila = newFila
 				postoEncontrado = true
+				motivo := req.Motivo
+				if motivo == "" {
+					motivo = "reserva liberada"
+				}
+				for _, sessao := range deps.Sessoes.AbortarDoCarro(req.Carro.ID, req.PostoID, req.ConectorID, motivo) {
+					if deps.AoAbortarSessao != nil {
+						deps.AoAbortarSessao(sessao)
+					}
+				}
 				if removed {
 					log.Printf("[API - RELEASE] Carro %s removido do posto %s por requisição de LIBERAÇÃO.\n", req.Carro.ID, req.PostoID)
 				} else {
@@ -277,17 +409,118 @@ func ServerAPICommunication(arquivoPontos string) {
 		}
 	
 		if !postoEncontrado {
+			postosMutex.Unlock()
 			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Posto não encontrado"})
 			return
 		}
 	
-		if err := storage.AtualizarArquivo(arquivoPontos, postos); err != nil {
+		err = storage.AtualizarArquivo(arquivoPontos, postos)
+		postosMutex.Unlock()
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": "Erro ao atualizar o arquivo JSON"})
 			return
 		}
+		if deps.AoLiberarConector == nil {
+			PromoverDaEspera(arquivoPontos, deps, req.PostoID)
+		}
+		for _, conectorID := range liberados {
+			if deps.AoLiberarConector != nil {
+				deps.AoLiberarConector(req.PostoID, conectorID)
+			}
+		}
 		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Posto liberado."})
 	})
 
+	// Lista de espera (opt-in): o carro é promovido para a fila quando um conector liberar
+	r.POST("/postos/:id/espera", func(c *gin.Context) {
+		var carro consts.Carro
+		if err := c.ShouldBindJSON(&carro); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dados inválidos"})
+			return
+		}
+		postosMutex.Lock()
+		defer postosMutex.Unlock()
+
+		postos, err := storage.GetPostosFromJSON(arquivoPontos)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, p := range postos {
+			if p.Id != c.Param("id") {
+				continue
+			}
+			for i, espera := range p.ListaEspera {
+				if espera.ID == carro.ID {
+					c.JSON(http.StatusOK, gin.H{"posicao": i + 1})
+					return
+				}
+			}
+			p.ListaEspera = append(p.ListaEspera, carro)
+			if err := storage.AtualizarArquivo(arquivoPontos, postos); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Erro ao atualizar o arquivo JSON"})
+				return
+			}
+			log.Printf("[API - ESPERA] Carro %s entrou na lista de espera do posto %s (posição %d)", carro.ID, p.Id, len(p.ListaEspera))
+			c.JSON(http.StatusOK, gin.H{"posicao": len(p.ListaEspera)})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Posto não encontrado"})
+	})
+
+	// Sessões do carro neste servidor, com a posição atual na fila do conector;
+	// ?transacao=<id> filtra pela transação da reserva
+	r.GET("/sessoes", func(c *gin.Context) {
+		carroID := c.Query("carro")
+		if carroID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Informe o carro"})
+			return
+		}
+		postosMutex.Lock()
+		postos, err := storage.GetPostosFromJSON(arquivoPontos)
+		postosMutex.Unlock()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		lista := []consts.SessaoRecarga{}
+		for _, sessao := range deps.Sessoes.DoCarro(carroID) {
+			if tx := c.Query("transacao"); tx != "" && sessao.TransacaoID != tx {
+				continue
+			}
+			atualizarPosicaoFila(&sessao, postos)
+			lista = append(lista, sessao)
+		}
+		c.JSON(http.StatusOK, lista)
+	})
+
+	// Faturas emitidas por este servidor; ?carro=<id> filtra por carro
+	r.GET("/faturas", func(c *gin.Context) {
+		if carroID := c.Query("carro"); carroID != "" {
+			c.JSON(http.StatusOK, deps.Faturas.DoCarro(carroID))
+			return
+		}
+		c.JSON(http.StatusOK, deps.Faturas.Todas())
+	})
+
+	r.GET("/faturas/transacao/:id", func(c *gin.Context) {
+		c.JSON(http.StatusOK, deps.Faturas.DaTransacao(c.Param("id")))
+	})
+
+	// Fatura consolidada da viagem, somando as faturas de todas as cidades da rota
+	r.GET("/faturas/viagem/:id", func(c *gin.Context) {
+		viagem := deps.ConsolidarViagem(c.Param("id"))
+		if len(viagem.Faturas) == 0 && len(viagem.Pendentes) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Nenhuma fatura encontrada para a transação"})
+			return
+		}
+		c.JSON(http.StatusOK, viagem)
+	})
+
+	if deps.Carteiras != nil {
+		registrarRotasCarteira(r, deps.Carteiras)
+	}
+
 	r.POST("/reserva", func(c *gin.Context) {
 		var req struct {
 			Carro         consts.Carro             `json:"carro"`
@@ -297,8 +530,12 @@ func ServerAPICommunication(arquivoPontos string) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Dados inválidos"})
 			return
 		}
+		if deps.Encerrando != nil && deps.Encerrando() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Servidor encerrando"})
+			return
+		}
 		log.Println("[API] Iniciando 2PC para adicionar carro aos postos...")
-		err := TwoPhaseCommit(req.Participantes, req.Carro)
+		err := TwoPhaseCommit(consts.NovoID("TX"), req.Participantes, req.Carro)
 		if err != nil {
 			log.Printf("[API] 2PC falhou: %v", err)
 			c.JSON(http.StatusConflict, gin.H{"result": "2PC falhou", "error": err.Error()})
@@ -313,9 +550,212 @@ func ServerAPICommunication(arquivoPontos string) {
 	if porta == "" {
 		log.Fatalf("[SERVIDOR] Erro ao iniciar servidor HTTP com Gin: variável de ambiente PORTA não definida")
 	}
-	r.Run(":" + porta)
+	servidorHTTP = &http.Server{Addr: ":" + porta, Handler: r}
+	if err := servidorHTTP.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("[SERVIDOR] Erro no servidor HTTP: %v", err)
+	}
+}
+
+// Para de aceitar conexões e espera as requisições em andamento terminarem, até o prazo do contexto
+func EncerrarHTTP(ctx context.Context) error {
+	if servidorHTTP == nil {
+		return nil
+	}
+	return servidorHTTP.Shutdown(ctx)
+}
+
+// Conectores dos postos locais com um prepare ainda sem commit nem abort
+func ContarPendentes(arquivoPontos string) (int, error) {
+	postosMutex.Lock()
+	defer postosMutex.Unlock()
+	postos, err := storage.GetPostosFromJSON(arquivoPontos)
+	if err != nil {
+		return 0, err
+	}
+	pendentes := 0
+	for _, p := range postos {
+		for _, conector := range p.Conectores {
+			if conector.Pendente != nil {
+				pendentes++
+			}
+		}
+	}
+	return pendentes, nil
+}
+
+// Aborta os prepares que não receberam commit nem abort do coordenador, para os conectores
+// não ficarem presos no arquivo quando o servidor voltar. Retorna quantos foram abortados.
+func AbortarPendentes(arquivoPontos string) (int, error) {
+	postosMutex.Lock()
+	defer postosMutex.Unlock()
+	postos, err := storage.GetPostosFromJSON(arquivoPontos)
+	if err != nil {
+		return 0, err
+	}
+	limpos := 0
+	for _, p := range postos {
+		for i := range p.Conectores {
+			conector := &p.Conectores[i]
+			if conector.Pendente == nil {
+				continue
+			}
+			log.Printf("[API] Prepare do carro %s no conector %s/%s abortado no encerramento: o coordenador não enviou commit nem abort", conector.Pendente.ID, p.Id, conector.ID)
+			conector.Pendente = nil
+			conector.AtualizarStatus()
+			limpos++
+		}
+	}
+	if limpos == 0 {
+		return 0, nil
+	}
+	return limpos, storage.AtualizarArquivo(arquivoPontos, postos)
+}
+
+
+// Conectores do posto em cuja fila (ou prepare) o carro está
+func ConectoresDoCarro(p *consts.Posto, carroID string) []string {
+	var ids []string
+	for _, conector := range p.Conectores {
+		if conector.Pendente != nil && conector.Pendente.ID == carroID {
+			ids = append(ids, conector.ID)
+			continue
+		}
+		for _, carro := range conector.Fila {
+			if carro.ID == carroID {
+				ids = append(ids, conector.ID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// Tira o carro das filas, prepares e listas de espera dos postos locais (ex: desconexão).
+// Retorna, para cada posto de onde ele saiu, os conectores que liberou.
+func RemoverCarroDosPostos(arquivoPontos, carroID string) (map[string][]string, error) {
+	postosMutex.Lock()
+	defer postosMutex.Unlock()
+	postos, err := storage.GetPostosFromJSON(arquivoPontos)
+	if err != nil {
+		return nil, err
+	}
+	liberados := make(map[string][]string)
+	for _, p := range postos {
+		conectores := ConectoresDoCarro(p, carroID)
+		if p.RemoverCarro(carroID) {
+			liberados[p.Id] = conectores
+		}
+	}
+	if len(liberados) == 0 {
+		return liberados, nil
+	}
+	return liberados, storage.AtualizarArquivo(arquivoPontos, postos)
+}
+
+// Remove o carro do conector ao fim da sessão de recarga
+func LiberarConector(arquivoPontos, postoID, conectorID, carroID string) error {
+	postosMutex.Lock()
+	defer postosMutex.Unlock()
+
+	postos, err := storage.GetPostosFromJSON(arquivoPontos)
+	if err != nil {
+		return err
+	}
+	for _, p := range postos {
+		if p.Id != postoID {
+			continue
+		}
+		conector := p.BuscarConector(conectorID)
+		if conector == nil {
+			return fmt.Errorf("conector %s não encontrado no posto %s", conectorID, postoID)
+		}
+		for i, carro := range conector.Fila {
+			if carro.ID == carroID {
+				conector.Fila = append(conector.Fila[:i], conector.Fila[i+1:]...)
+				break
+			}
+		}
+		conector.AtualizarStatus()
+		return storage.AtualizarArquivo(arquivoPontos, postos)
+	}
+	return fmt.Errorf("posto %s não encontrado", postoID)
 }
 
+// Tira da lista de espera os carros para os quais há vaga em um conector compatível e
+// avisa cada um. Nada é reservado aqui: o carro refaz a reserva pelo 2PC do coordenador,
+// com retenção na carteira, e volta para a lista se a vaga já tiver sido ocupada.
+// Chamado sempre que um conector do posto é liberado.
+func PromoverDaEspera(arquivoPontos string, deps Dependencias, postoID string) []consts.VagaEspera {
+	postosMutex.Lock()
+	defer postosMutex.Unlock()
+
+	postos, err := storage.GetPostosFromJSON(arquivoPontos)
+	if err != nil {
+		log.Printf("[API - ESPERA] Erro ao ler postos: %v", err)
+		return nil
+	}
+	profundidade := max(deps.ProfundidadeFila, 1)
+	var vagas []consts.VagaEspera
+	for _, p := range postos {
+		if p.Id != postoID || len(p.ListaEspera) == 0 {
+			continue
+		}
+		// Vagas já oferecidas nesta rodada, para não oferecer o mesmo lugar a dois carros
+		oferecidas := make(map[string]int)
+		restantes := []consts.Carro{}
+		for _, carro := range p.ListaEspera {
+			var conector *consts.Conector
+			for i := range p.Conectores {
+				c := &p.Conectores[i]
+				if c.Pendente == nil && len(c.Fila)+oferecidas[c.ID] < profundidade && c.Compativel(carro) {
+					conector = c
+					break
+				}
+			}
+			if conector == nil {
+				restantes = append(restantes, carro)
+				continue
+			}
+			oferecidas[conector.ID]++
+			vagas = append(vagas, consts.VagaEspera{CarroID: carro.ID, PostoID: p.Id, ConectorID: conector.ID, Cidade: deps.Cidade})
+			log.Printf("[API - ESPERA] Vaga no conector %s do posto %s oferecida ao carro %s da lista de espera", conector.ID, p.Id, carro.ID)
+		}
+		p.ListaEspera = restantes
+		break
+	}
+	if len(vagas) == 0 {
+		return nil
+	}
+	if err := storage.AtualizarArquivo(arquivoPontos, postos); err != nil {
+		log.Printf("[API - ESPERA] Erro ao atualizar o arquivo JSON: %v", err)
+	}
+	if deps.AoPromoverDaEspera != nil {
+		for _, vaga := range vagas {
+			deps.AoPromoverDaEspera(vaga)
+		}
+	}
+	return vagas
+}
+
+// Coloca o carro na lista de espera de um posto de outro (ou deste) servidor
+func EntrarNaListaEspera(url, postoID string, carro consts.Carro) (int, error) {
+	carroJSON, _ := json.Marshal(carro)
+	resp, err := http.Post(url+"/postos/"+postoID+"/espera", "application/json", strings.NewReader(string(carroJSON)))
+	if err != nil {
+		return 0, fmt.Errorf("erro ao enviar requisição para %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("requisição falhou com status %d", resp.StatusCode)
+	}
+	var res struct {
+		Posicao int `json:"posicao"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, fmt.Errorf("erro ao decodificar resposta JSON: %v", err)
+	}
+	return res.Posicao, nil
+}
 
 func ObterPostosDeOutroServidor(url string) ([]*consts.Posto, error) {
 	//log.Printf("[SERVIDOR] Enviando requisição para %s/postos", url)
@@ -348,48 +788,243 @@ func ObterPostosDeOutroServidor(url string) ([]*consts.Posto, error) {
 
 }
 
-func TwoPhaseCommit(participantes []consts.Participante2PC, carro consts.Carro) error {
-	payloadTemplate := `{"posto_id":"%s","carro":%s}`
+func ObterFaturasDaTransacao(url, transacaoID string) ([]consts.Fatura, error) {
+	resp, err := http.Get(url + "/faturas/transacao/" + transacaoID)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao enviar requisição para %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requisição falhou com status %d", resp.StatusCode)
+	}
+
+	var faturas []consts.Fatura
+	if err := json.NewDecoder(resp.Body).Decode(&faturas); err != nil {
+		return nil, fmt.Errorf("erro ao decodificar resposta JSON: %v", err)
+	}
+	return faturas, nil
+}
+
+// Recalcula a posição e a espera de uma sessão ainda não iniciada a partir da fila atual
+func atualizarPosicaoFila(sessao *consts.SessaoRecarga, postos []*consts.Posto) {
+	if sessao.Estado != consts.SessaoReservada && sessao.Estado != consts.SessaoCarroChegou {
+		return
+	}
+	for _, p := range postos {
+		if p.Id != sessao.PostoID {
+			continue
+		}
+		conector := p.BuscarConector(sessao.ConectorID)
+		if conector == nil {
+			return
+		}
+		for i, carro := range conector.Fila {
+			if carro.ID == sessao.CarroID {
+				sessao.PosicaoFila = i
+				sessao.EsperaEstimadaMin = conector.EsperaEstimadaMin(i)
+				return
+			}
+		}
+		return
+	}
+}
+
+// Sessões de uma transação do carro no servidor indicado pela url
+func ObterSessoesDoCarro(url, carroID, transacaoID string) ([]consts.SessaoRecarga, error) {
+	resp, err := http.Get(url + "/sessoes?carro=" + carroID + "&transacao=" + transacaoID)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao enviar requisição para %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requisição falhou com status %d", resp.StatusCode)
+	}
+
+	var lista []consts.SessaoRecarga
+	if err := json.NewDecoder(resp.Body).Decode(&lista); err != nil {
+		return nil, fmt.Errorf("erro ao decodificar resposta JSON: %v", err)
+	}
+	return lista, nil
+}
+
+// Endpoint do participante para a fase do 2PC (a carteira atende em /carteira/2pc)
+func EndpointParticipante(p consts.Participante2PC, fase string) string {
+	if p.Recurso == consts.RecursoCarteira {
+		return p.URL + "/carteira/2pc/" + fase
+	}
+	return p.URL + "/2pc/" + fase
+}
+
+func PayloadParticipante(transacaoID string, p consts.Participante2PC, carro consts.Carro) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"transacao_id":     transacaoID,
+		"posto_id":         p.PostoID,
+		"conector_id":      p.ConectorID,
+		"cotacao_id":       p.CotacaoID,
+		"carro":            carro,
+		"valor":            p.Valor,
+		"chegada_prevista": p.ChegadaPrevista,
+	})
+	return string(payload)
+}
+
+// Envia a liberação (fim da reserva) ao participante, informando o motivo
+func LiberarParticipante(transacaoID string, p consts.Participante2PC, carro consts.Carro, motivo string) error {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"transacao_id": transacaoID,
+		"posto_id":     p.PostoID,
+		"conector_id":  p.ConectorID,
+		"carro":        carro,
+		"motivo":       motivo,
+	})
+	resp, err := http.Post(EndpointParticipante(p, "release"), "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("liberação falhou com status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func TwoPhaseCommit(transacaoID string, participantes []consts.Participante2PC, carro consts.Carro) error {
+	return AlterarReserva(transacaoID, participantes, nil, carro, "")
+}
+
+// 2PC de alteração de uma reserva comitada: prepara os novos participantes e, se todos
+// aceitarem, confirma cada um conferindo a resposta do commit. Os antigos só são liberados
+// depois que a nova reserva foi confirmada por inteiro; um participante presente nas duas
+// listas (mesmo posto e conector) continua reservado como está. Se algum prepare ou commit
+// falhar, os novos são desfeitos e os antigos continuam reservados.
+func AlterarReserva(transacaoID string, novos, antigos []consts.Participante2PC, carro consts.Carro, motivo string) error {
+	chave := func(p consts.Participante2PC) string {
+		return p.Recurso + "/" + p.PostoID + "/" + p.ConectorID
+	}
+	antigosPorChave := make(map[string]consts.Participante2PC)
+	for _, p := range antigos {
+		antigosPorChave[chave(p)] = p
+	}
+	mantidos := make(map[string]bool)
+	var preparar []int // Índices dos novos que passam pelo 2PC
+	for i, p := range novos {
+		if antigo, ok := antigosPorChave[chave(p)]; ok {
+			novos[i].PrecoKWh = antigo.PrecoKWh // Mantém o preço travado na reserva
+			mantidos[chave(p)] = true
+			continue
+		}
+		preparar = append(preparar, i)
+	}
 
 	// Fase 1: Prepare
-	okCount := 0
-	for _, p := range participantes {
-		carroJSON, _ := json.Marshal(carro)
-		payload := fmt.Sprintf(payloadTemplate, p.PostoID, string(carroJSON))
-		resp, err := http.Post(p.URL+"/2pc/prepare", "application/json", strings.NewReader(payload))
+	var recusa *RecusaParticipante
+	for _, i := range preparar {
+		// A carteira vem depois dos postos: retém o valor pelos preços que eles travaram
+		if novos[i].Recurso == consts.RecursoCarteira {
+			novos[i].Valor = carteira.ValorRetencao(novos[:i])
+		}
+		p := novos[i]
+		payload := PayloadParticipante(transacaoID, p, carro)
+		resp, err := http.Post(EndpointParticipante(p, "prepare"), "application/json", strings.NewReader(payload))
 		if err != nil {
 			log.Printf("[2PC] Erro ao enviar prepare para %s: %v", p.URL, err)
+			recusa = &RecusaParticipante{Participante: p, Motivo: err.Error(), Inacessivel: true}
 			break
 		}
-		defer resp.Body.Close()
 		var res map[string]string
 		json.NewDecoder(resp.Body).Decode(&res)
-		if res["result"] == "ok" {
-			okCount++
-		} else {
+		resp.Body.Close()
+		if res["result"] != "ok" {
+			recusa = &RecusaParticipante{Participante: p, Motivo: res["error"]}
 			break
 		}
+		if preco, err := strconv.ParseFloat(res["preco_kwh"], 64); err == nil {
+			novos[i].PrecoKWh = preco
+		}
 	}
 
-	// Se todos aceitaram, commit
-	if okCount == len(participantes) {
-		for _, p := range participantes {
-			carroJSON, _ := json.Marshal(carro)
-			payload := fmt.Sprintf(payloadTemplate, p.PostoID, string(carroJSON))
-			http.Post(p.URL+"/2pc/commit", "application/json", strings.NewReader(payload))
+	// Se algum abortou, abort para todos
+	if recusa != nil {
+		for _, i := range preparar {
+			abortarParticipante(transacaoID, novos[i], carro)
 		}
-		log.Println("[2PC] Commit enviado para todos os participantes")
-		return nil
+		log.Println("[2PC] Abort enviado para todos os participantes")
+		return recusa
 	}
 
-	// Se algum abortou, abort para todos
-	for _, p := range participantes {
-		carroJSON, _ := json.Marshal(carro)
-		payload := fmt.Sprintf(payloadTemplate, p.PostoID, string(carroJSON))
-		http.Post(p.URL+"/2pc/abort", "application/json", strings.NewReader(payload))
+	// Fase 2: Commit, conferindo a resposta de cada participante
+	for n, i := range preparar {
+		if err := confirmarParticipante(transacaoID, novos[i], carro); err != nil {
+			log.Printf("[2PC] Commit falhou em %s: %v. Desfazendo a transação %s", novos[i].URL, err, transacaoID)
+			for _, j := range preparar[:n] {
+				if err := LiberarParticipante(transacaoID, novos[j], carro, "falha no commit da transação"); err != nil {
+					log.Printf("[2PC] Erro ao liberar %s em %s: %v", novos[j].PostoID, novos[j].URL, err)
+				}
+			}
+			for _, j := range preparar[n:] {
+				abortarParticipante(transacaoID, novos[j], carro)
+			}
+			return &RecusaParticipante{Participante: novos[i], Motivo: err.Error()}
+		}
+	}
+
+	// Só com a nova reserva confirmada os participantes antigos são liberados
+	for _, p := range antigos {
+		if mantidos[chave(p)] {
+			continue
+		}
+		if err := LiberarParticipante(transacaoID, p, carro, motivo); err != nil {
+			log.Printf("[2PC] Erro ao liberar %s em %s: %v", p.PostoID, p.URL, err)
+		}
+	}
+	log.Println("[2PC] Commit confirmado por todos os participantes")
+	return nil
+}
+
+// Envia o commit ao participante e confere se ele confirmou
+func confirmarParticipante(transacaoID string, p consts.Participante2PC, carro consts.Carro) error {
+	payload := PayloadParticipante(transacaoID, p, carro)
+	resp, err := http.Post(EndpointParticipante(p, "commit"), "application/json", strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res map[string]string
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK || res["result"] != "committed" {
+		return fmt.Errorf("commit recusado com status %d: %s", resp.StatusCode, res["error"])
+	}
+	return nil
+}
+
+func abortarParticipante(transacaoID string, p consts.Participante2PC, carro consts.Carro) {
+	payload := PayloadParticipante(transacaoID, p, carro)
+	resp, err := http.Post(EndpointParticipante(p, "abort"), "application/json", strings.NewReader(payload))
+	if err != nil {
+		log.Printf("[2PC] Erro ao enviar abort para %s: %v", p.URL, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Erro de um 2PC abortado, com o participante que recusou o prepare
+type RecusaParticipante struct {
+	Participante consts.Participante2PC
+	Motivo       string
+	Inacessivel  bool // O prepare nem chegou ao participante
+}
+
+func (r *RecusaParticipante) Error() string {
+	recurso := "posto " + r.Participante.PostoID
+	if r.Participante.Recurso == consts.RecursoCarteira {
+		recurso = "carteira"
+	}
+	if r.Motivo == "" {
+		return fmt.Sprintf("2PC abortado: %s recusou o prepare", recurso)
 	}
-	log.Println("[2PC] Abort enviado para todos os participantes")
-	return fmt.Errorf("2PC abortado por algum participante")
+	return fmt.Sprintf("2PC abortado: %s recusou o prepare (%s)", recurso, r.Motivo)
 }
 
 
@@ -0,0 +1,50 @@
+package api
+
+import (
+	ambiente "MQTT/utils/Ambiente"
+	consts "MQTT/utils/Constantes"
+	"log"
+	"sync"
+	"time"
+)
+
+// Cache dos postos disponíveis de outros servidores, indexado pela URL do servidor
+type entradaCachePostos struct {
+	postos   []*consts.Posto
+	obtidoEm time.Time
+}
+
+var (
+	cachePostos      = make(map[string]entradaCachePostos)
+	cachePostosMutex sync.Mutex
+	// CACHE_POSTOS_TTL aceita durações do Go (ex: "3s"). O padrão é curto porque a
+	// disponibilidade muda a cada reserva.
+	ttlCachePostos = ambiente.Duracao("CACHE_POSTOS_TTL", 5*time.Second)
+)
+
+// Retorna os postos disponíveis do servidor, consultando-o apenas se o cache expirou
+func ObterPostosComCache(url string) ([]*consts.Posto, error) {
+	cachePostosMutex.Lock()
+	entrada, ok := cachePostos[url]
+	cachePostosMutex.Unlock()
+	if ok && time.Since(entrada.obtidoEm) < ttlCachePostos {
+		log.Printf("[CACHE] Postos de %s servidos do cache", url)
+		return entrada.postos, nil
+	}
+
+	postos, err := ObterPostosDeOutroServidor(url)
+	if err != nil {
+		return nil, err
+	}
+	cachePostosMutex.Lock()
+	cachePostos[url] = entradaCachePostos{postos: postos, obtidoEm: time.Now()}
+	cachePostosMutex.Unlock()
+	return postos, nil
+}
+
+// Descarta o cache do servidor (ex: após uma reserva que alterou seus postos)
+func InvalidarCachePostos(url string) {
+	cachePostosMutex.Lock()
+	delete(cachePostos, url)
+	cachePostosMutex.Unlock()
+}
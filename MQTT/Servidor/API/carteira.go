@@ -0,0 +1,144 @@
+package api
+
+import (
+	carteira "MQTT/Servidor/Carteira"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Requisição das fases do 2PC e da captura na carteira
+type requisicaoCarteira struct {
+	TransacaoID string `json:"transacao_id"`
+	Carro       struct {
+		ID string `json:"id"`
+	} `json:"carro"`
+	Valor float64 `json:"valor"`
+}
+
+// Endpoints da carteira, montados apenas no servidor que mantém as carteiras
+func registrarRotasCarteira(r *gin.Engine, carteiras *carteira.Carteiras) {
+	r.GET("/carteira/:carro", func(c *gin.Context) {
+		c.JSON(http.StatusOK, carteiras.Consultar(c.Param("carro")))
+	})
+
+	r.POST("/carteira/:carro/deposito", func(c *gin.Context) {
+		var req struct {
+			Valor float64 `json:"valor"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dados inválidos"})
+			return
+		}
+		saldo, err := carteiras.Depositar(c.Param("carro"), req.Valor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, saldo)
+	})
+
+	r.POST("/carteira/2pc/prepare", func(c *gin.Context) {
+		var req requisicaoCarteira
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"result": "abort", "error": "Dados inválidos"})
+			return
+		}
+		if err := carteiras.Reter(req.TransacaoID, req.Carro.ID, req.Valor); err != nil {
+			log.Printf("[API - CARTEIRA] Prepare recusado para o carro %s: %v", req.Carro.ID, err)
+			c.JSON(http.StatusOK, gin.H{"result": "abort", "error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"result": "ok"})
+	})
+
+	r.POST("/carteira/2pc/commit", func(c *gin.Context) {
+		var req requisicaoCarteira
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"result": "abort", "error": "Dados inválidos"})
+			return
+		}
+		carteiras.Confirmar(req.TransacaoID, req.Carro.ID)
+		c.JSON(http.StatusOK, gin.H{"result": "committed"})
+	})
+
+	// Abort e liberação devolvem o valor retido
+	liberar := func(c *gin.Context) {
+		var req requisicaoCarteira
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Dados inválidos"})
+			return
+		}
+		carteiras.Liberar(req.TransacaoID, req.Carro.ID)
+		c.JSON(http.StatusOK, gin.H{"result": "aborted", "status": "success"})
+	}
+	r.POST("/carteira/2pc/abort", liberar)
+	r.POST("/carteira/2pc/release", liberar)
+
+	r.POST("/carteira/captura", func(c *gin.Context) {
+		var req requisicaoCarteira
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dados inválidos"})
+			return
+		}
+		c.JSON(http.StatusOK, carteiras.Capturar(req.TransacaoID, req.Carro.ID, req.Valor))
+	})
+
+	// Valor é a diferença a somar (ou descontar) da retenção de uma reserva alterada
+	r.POST("/carteira/ajuste", func(c *gin.Context) {
+		var req requisicaoCarteira
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dados inválidos"})
+			return
+		}
+		if err := carteiras.Ajustar(req.TransacaoID, req.Carro.ID, req.Valor); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, carteiras.Consultar(req.Carro.ID))
+	})
+}
+
+// Cobra o valor de uma fatura na carteira do carro (servidor indicado pela url)
+func CapturarNaCarteira(url, transacaoID, carroID string, valor float64) error {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"transacao_id": transacaoID,
+		"carro":        map[string]string{"id": carroID},
+		"valor":        valor,
+	})
+	resp, err := http.Post(url+"/carteira/captura", "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		return fmt.Errorf("erro ao enviar captura para %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captura falhou com status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Ajusta a retenção da reserva na carteira do carro pela diferença de valor estimado
+func AjustarNaCarteira(url, transacaoID, carroID string, diferenca float64) error {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"transacao_id": transacaoID,
+		"carro":        map[string]string{"id": carroID},
+		"valor":        diferenca,
+	})
+	resp, err := http.Post(url+"/carteira/ajuste", "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		return fmt.Errorf("erro ao enviar ajuste para %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var erro struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&erro)
+		return fmt.Errorf("ajuste falhou com status %d: %s", resp.StatusCode, erro.Error)
+	}
+	return nil
+}
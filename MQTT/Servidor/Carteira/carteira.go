@@ -0,0 +1,187 @@
+package carteira
+
+import (
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Gerencia os saldos pré-pagos dos carros e os valores retidos por reservas.
+// Só o servidor da cidade marcada como "carteira" no registro mantém as carteiras.
+type Carteiras struct {
+	mutex        sync.Mutex
+	arquivo      string // vazio mantém as carteiras apenas em memória
+	saldoInicial float64
+	carteiras    map[string]*consts.Carteira
+}
+
+func NovasCarteiras(arquivo string, saldoInicial float64) *Carteiras {
+	c := &Carteiras{arquivo: arquivo, saldoInicial: saldoInicial, carteiras: make(map[string]*consts.Carteira)}
+	if arquivo == "" {
+		log.Println("[CARTEIRA] ARQUIVO_JSON_CARTEIRAS não definido. Carteiras mantidas apenas em memória.")
+		return c
+	}
+	carteiras, err := storage.LerCarteiras(arquivo)
+	if err != nil {
+		log.Printf("[CARTEIRA] %v. Iniciando sem carteiras.", err)
+		return c
+	}
+	c.carteiras = carteiras
+	return c
+}
+
+// Valor estimado de uma rota: energia prevista de cada parada × preço do posto
+func EstimarValor(paradas []consts.Parada) float64 {
+	total := 0.0
+	for _, parada := range paradas {
+		total += parada.EnergiaKWh * parada.CustoKW
+	}
+	return consts.Arredondar(total)
+}
+
+// Valor a reter para uma reserva: energia prevista pelo coordenador em cada posto × preço
+// travado no prepare do posto
+func ValorRetencao(participantes []consts.Participante2PC) float64 {
+	total := 0.0
+	for _, p := range participantes {
+		if p.Recurso == consts.RecursoPosto {
+			total += p.EnergiaKWh * p.PrecoKWh
+		}
+	}
+	return consts.Arredondar(total)
+}
+
+// Carteira do carro, criada com o saldo inicial no primeiro acesso
+func (c *Carteiras) carteira(carroID string) *consts.Carteira {
+	carteira, ok := c.carteiras[carroID]
+	if !ok {
+		carteira = &consts.Carteira{CarroID: carroID, Saldo: c.saldoInicial, Retencoes: make(map[string]consts.Retencao)}
+		c.carteiras[carroID] = carteira
+	}
+	if carteira.Retencoes == nil {
+		carteira.Retencoes = make(map[string]consts.Retencao)
+	}
+	return carteira
+}
+
+func (c *Carteiras) salvar() {
+	if c.arquivo == "" {
+		return
+	}
+	if err := storage.SalvarCarteiras(c.arquivo, c.carteiras); err != nil {
+		log.Printf("[CARTEIRA] Erro ao salvar carteiras: %v", err)
+	}
+}
+
+func disponivel(carteira *consts.Carteira) float64 {
+	retido := 0.0
+	for _, retencao := range carteira.Retencoes {
+		retido += retencao.Valor
+	}
+	return carteira.Saldo - retido
+}
+
+func (c *Carteiras) Consultar(carroID string) consts.Carteira {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	carteira := *c.carteira(carroID)
+	carteira.Disponivel = consts.Arredondar(disponivel(&carteira))
+	return carteira
+}
+
+func (c *Carteiras) Depositar(carroID string, valor float64) (consts.Carteira, error) {
+	if valor <= 0 {
+		return consts.Carteira{}, fmt.Errorf("valor de depósito inválido: %.2f", valor)
+	}
+	c.mutex.Lock()
+	carteira := c.carteira(carroID)
+	carteira.Saldo = consts.Arredondar(carteira.Saldo + valor)
+	c.salvar()
+	c.mutex.Unlock()
+	log.Printf("[CARTEIRA] Depósito de R$ %.2f para o carro %s", valor, carroID)
+	return c.Consultar(carroID), nil
+}
+
+// Fase de prepare: retém o valor se o saldo disponível cobrir a rota inteira
+func (c *Carteiras) Reter(transacaoID, carroID string, valor float64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	carteira := c.carteira(carroID)
+	if _, ok := carteira.Retencoes[transacaoID]; ok {
+		return nil // prepare repetido
+	}
+	if livre := disponivel(carteira); livre < valor {
+		return fmt.Errorf("saldo insuficiente: disponível R$ %.2f, necessário R$ %.2f", livre, valor)
+	}
+	carteira.Retencoes[transacaoID] = consts.Retencao{Valor: consts.Arredondar(valor), CriadaEm: time.Now()}
+	c.salvar()
+	log.Printf("[CARTEIRA] R$ %.2f retidos do carro %s (transação %s, pendente)", valor, carroID, transacaoID)
+	return nil
+}
+
+// Fase de commit: a retenção passa a valer até a captura ou liberação
+func (c *Carteiras) Confirmar(transacaoID, carroID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	carteira := c.carteira(carroID)
+	if retencao, ok := carteira.Retencoes[transacaoID]; ok {
+		retencao.Confirmada = true
+		carteira.Retencoes[transacaoID] = retencao
+		c.salvar()
+	}
+}
+
+// Abort do 2PC, cancelamento ou desconexão: devolve o que ainda estava retido
+func (c *Carteiras) Liberar(transacaoID, carroID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	carteira := c.carteira(carroID)
+	if retencao, ok := carteira.Retencoes[transacaoID]; ok {
+		delete(carteira.Retencoes, transacaoID)
+		c.salvar()
+		log.Printf("[CARTEIRA] Retenção de R$ %.2f do carro %s liberada (transação %s)", retencao.Valor, carroID, transacaoID)
+	}
+}
+
+// Debita o valor de uma fatura, consumindo primeiro o valor retido da transação.
+// A cobrança é feita mesmo sem retenção (ex: taxa de no-show após o cancelamento).
+func (c *Carteiras) Capturar(transacaoID, carroID string, valor float64) consts.Carteira {
+	c.mutex.Lock()
+	carteira := c.carteira(carroID)
+	carteira.Saldo = consts.Arredondar(carteira.Saldo - valor)
+	if retencao, ok := carteira.Retencoes[transacaoID]; ok {
+		retencao.Valor = consts.Arredondar(retencao.Valor - valor)
+		if retencao.Valor <= 0 {
+			delete(carteira.Retencoes, transacaoID)
+		} else {
+			carteira.Retencoes[transacaoID] = retencao
+		}
+	}
+	c.salvar()
+	c.mutex.Unlock()
+	log.Printf("[CARTEIRA] R$ %.2f capturados do carro %s (transação %s)", valor, carroID, transacaoID)
+	return c.Consultar(carroID)
+}
+
+// Ajusta a retenção de uma reserva alterada pela diferença entre o valor estimado das
+// paradas novas e o das liberadas. Um aumento precisa caber no saldo disponível.
+func (c *Carteiras) Ajustar(transacaoID, carroID string, diferenca float64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	carteira := c.carteira(carroID)
+	retencao, ok := carteira.Retencoes[transacaoID]
+	if !ok {
+		return fmt.Errorf("nenhuma retenção para a transação %s", transacaoID)
+	}
+	if livre := disponivel(carteira); diferenca > livre {
+		return fmt.Errorf("saldo insuficiente: disponível R$ %.2f, necessário R$ %.2f", livre, diferenca)
+	}
+	retencao.Valor = consts.Arredondar(max(retencao.Valor+diferenca, 0))
+	carteira.Retencoes[transacaoID] = retencao
+	c.salvar()
+	log.Printf("[CARTEIRA] Retenção do carro %s ajustada em R$ %.2f para R$ %.2f (transação %s)", carroID, diferenca, retencao.Valor, transacaoID)
+	return nil
+}
@@ -0,0 +1,164 @@
+package faturamento
+
+import (
+	ambiente "MQTT/utils/Ambiente"
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Regras de cobrança além da energia (kWh × preço do posto)
+type Tarifas struct {
+	TaxaOciosidadeMin    float64       // R$ por minuto conectado além do necessário para a energia entregue
+	ToleranciaOciosidade time.Duration // Tempo ocioso sem cobrança
+	TaxaNoShow           float64       // R$ cobrado quando o carro não comparece à reserva
+}
+
+// Lê TAXA_OCIOSIDADE_MIN, TOLERANCIA_OCIOSIDADE e TAXA_NO_SHOW, com valores padrão
+func TarifasDoAmbiente() Tarifas {
+	return Tarifas{
+		TaxaOciosidadeMin:    ambiente.Float("TAXA_OCIOSIDADE_MIN", 0.50),
+		ToleranciaOciosidade: ambiente.Duracao("TOLERANCIA_OCIOSIDADE", 10*time.Minute),
+		TaxaNoShow:           ambiente.Float("TAXA_NO_SHOW", 10.00),
+	}
+}
+
+// Calcula a cobrança da sessão. Sessões finalizadas pagam energia e ociosidade;
+// sessões abortadas por no-show pagam apenas a taxa de no-show.
+func Calcular(sessao consts.SessaoRecarga, tarifas Tarifas) consts.Fatura {
+	fatura := consts.Fatura{
+		ID:          consts.NovoID("FAT"),
+		SessaoID:    sessao.ID,
+		TransacaoID: sessao.TransacaoID,
+		CarroID:     sessao.CarroID,
+		PostoID:     sessao.PostoID,
+		ConectorID:  sessao.ConectorID,
+		Cidade:      sessao.Cidade,
+		EnergiaKWh:  sessao.EnergiaKWh,
+		PrecoKWh:    sessao.PrecoKWh,
+		EmitidaEm:   time.Now(),
+	}
+
+	switch sessao.Estado {
+	case consts.SessaoFinalizada:
+		fatura.ValorEnergia = consts.Arredondar(sessao.EnergiaKWh * sessao.PrecoKWh)
+		// Ocioso: tempo conectado além do que a potência do conector precisaria para a energia entregue
+		necessarioMin := 0.0
+		if sessao.PotenciaKW > 0 {
+			necessarioMin = sessao.EnergiaKWh / sessao.PotenciaKW * 60
+		}
+		ocioso := sessao.DuracaoMin - necessarioMin - tarifas.ToleranciaOciosidade.Minutes()
+		if ocioso > 0 {
+			fatura.OciosidadeMin = math.Round(ocioso*10) / 10
+			fatura.TaxaOciosidade = consts.Arredondar(ocioso * tarifas.TaxaOciosidadeMin)
+		}
+	case consts.SessaoAbortada:
+		if sessao.Motivo == consts.MotivoNoShow {
+			fatura.TaxaNoShow = consts.Arredondar(tarifas.TaxaNoShow)
+		}
+	}
+	fatura.Total = consts.Arredondar(fatura.ValorEnergia + fatura.TaxaOciosidade + fatura.TaxaNoShow)
+	return fatura
+}
+
+// Emite e guarda as faturas das sessões deste servidor
+type Faturador struct {
+	mutex   sync.Mutex
+	arquivo string // vazio mantém as faturas apenas em memória
+	tarifas Tarifas
+	faturas map[string][]consts.Fatura // por carro
+}
+
+func NovoFaturador(arquivo string, tarifas Tarifas) *Faturador {
+	f := &Faturador{arquivo: arquivo, tarifas: tarifas, faturas: make(map[string][]consts.Fatura)}
+	if arquivo == "" {
+		log.Println("[FATURAMENTO] ARQUIVO_JSON_FATURAS não definido. Faturas mantidas apenas em memória.")
+		return f
+	}
+	faturas, err := storage.LerFaturas(arquivo)
+	if err != nil {
+		log.Printf("[FATURAMENTO] %v. Iniciando sem faturas.", err)
+		return f
+	}
+	f.faturas = faturas
+	return f
+}
+
+// Emite a fatura da sessão encerrada. Retorna false para sessões que não geram cobrança
+// (abortadas por outro motivo que não no-show) ou já faturadas.
+func (f *Faturador) Emitir(sessao consts.SessaoRecarga) (consts.Fatura, bool) {
+	if sessao.Estado != consts.SessaoFinalizada && sessao.Motivo != consts.MotivoNoShow {
+		return consts.Fatura{}, false
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, existente := range f.faturas[sessao.CarroID] {
+		if existente.SessaoID == sessao.ID {
+			return existente, false
+		}
+	}
+
+	fatura := Calcular(sessao, f.tarifas)
+	if sessao.Estado == consts.SessaoAbortada && fatura.Total == 0 {
+		return consts.Fatura{}, false // Taxa de no-show desativada (TAXA_NO_SHOW=0)
+	}
+	f.faturas[sessao.CarroID] = append(f.faturas[sessao.CarroID], fatura)
+	if f.arquivo != "" {
+		if err := storage.SalvarFaturas(f.arquivo, f.faturas); err != nil {
+			log.Printf("[FATURAMENTO] Erro ao salvar faturas: %v", err)
+		}
+	}
+	log.Printf("[FATURAMENTO] Fatura %s emitida para o carro %s: R$ %.2f", fatura.ID, fatura.CarroID, fatura.Total)
+	return fatura, true
+}
+
+func (f *Faturador) DoCarro(carroID string) []consts.Fatura {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]consts.Fatura{}, f.faturas[carroID]...)
+}
+
+func (f *Faturador) Todas() []consts.Fatura {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	todas := []consts.Fatura{}
+	for _, faturas := range f.faturas {
+		todas = append(todas, faturas...)
+	}
+	sort.Slice(todas, func(i, j int) bool { return todas[i].EmitidaEm.Before(todas[j].EmitidaEm) })
+	return todas
+}
+
+func (f *Faturador) DaTransacao(transacaoID string) []consts.Fatura {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	lista := []consts.Fatura{}
+	for _, faturas := range f.faturas {
+		for _, fatura := range faturas {
+			if fatura.TransacaoID == transacaoID {
+				lista = append(lista, fatura)
+			}
+		}
+	}
+	return lista
+}
+
+// Soma as faturas de uma transação vindas de todos os servidores participantes
+func Consolidar(transacaoID string, faturas []consts.Fatura) consts.FaturaViagem {
+	viagem := consts.FaturaViagem{TransacaoID: transacaoID, Faturas: []consts.Fatura{}}
+	for _, fatura := range faturas {
+		viagem.CarroID = fatura.CarroID
+		viagem.Faturas = append(viagem.Faturas, fatura)
+		viagem.Total += fatura.Total
+	}
+	sort.Slice(viagem.Faturas, func(i, j int) bool {
+		return viagem.Faturas[i].EmitidaEm.Before(viagem.Faturas[j].EmitidaEm)
+	})
+	viagem.Total = consts.Arredondar(viagem.Total)
+	return viagem
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	consts "MQTT/utils/Constantes"
+	"log"
+	"sync"
+	"time"
+)
+
+// Acompanha os heartbeats dos postos. Um posto que nunca enviou heartbeat é considerado
+// sem telemetria (e continua disponível); um que parou de enviar fica offline.
+type Monitor struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	ultimo  map[string]time.Time
+	offline map[string]bool
+}
+
+func NovoMonitor(timeout time.Duration) *Monitor {
+	return &Monitor{
+		timeout: timeout,
+		ultimo:  make(map[string]time.Time),
+		offline: make(map[string]bool),
+	}
+}
+
+// Registra um heartbeat (ou o LWT, com Online=false) do posto
+func (m *Monitor) RegistrarStatus(status consts.StatusPosto) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !status.Online {
+		if !m.offline[status.ID] {
+			log.Printf("[MONITOR] Posto %s desconectou (LWT).", status.ID)
+		}
+		m.offline[status.ID] = true
+		return
+	}
+	if m.offline[status.ID] {
+		log.Printf("[MONITOR] Posto %s voltou a ficar online.", status.ID)
+	}
+	m.ultimo[status.ID] = time.Now()
+	m.offline[status.ID] = false
+}
+
+func (m *Monitor) Online(postoID string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return !m.offline[postoID]
+}
+
+// Marca como offline os postos sem heartbeat dentro do timeout e retorna os que acabaram de cair
+func (m *Monitor) VerificarExpirados() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var expirados []string
+	for id, ultimo := range m.ultimo {
+		if !m.offline[id] && time.Since(ultimo) > m.timeout {
+			m.offline[id] = true
+			expirados = append(expirados, id)
+			log.Printf("[MONITOR] Posto %s sem heartbeat há %s. Marcado como offline.", id, time.Since(ultimo).Round(time.Second))
+		}
+	}
+	return expirados
+}
+
+// Remove da lista os postos offline
+func (m *Monitor) FiltrarOnline(postos []*consts.Posto) []*consts.Posto {
+	var online []*consts.Posto
+	for _, posto := range postos {
+		if m.Online(posto.Id) {
+			online = append(online, posto)
+		}
+	}
+	return online
+}
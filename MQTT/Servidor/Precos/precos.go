@@ -0,0 +1,205 @@
+package precos
+
+import (
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Motor de preços dinâmicos dos postos deste servidor. Guarda as cotações emitidas
+// para que o prepare do 2PC trave o preço que o carro viu no planejamento.
+type Motor struct {
+	mutex    sync.Mutex
+	regras   consts.RegrasPreco
+	fuso     *time.Location
+	validade time.Duration
+	cotacoes map[string]consts.Cotacao
+	travadas map[string]map[string]bool // cotação -> transações que a travaram
+}
+
+const validadePadrao = 15 * time.Minute
+
+func NovoMotor(regras consts.RegrasPreco) *Motor {
+	validade := time.Duration(regras.ValidadeCotacaoMin * float64(time.Minute))
+	if validade <= 0 {
+		validade = validadePadrao
+	}
+	return &Motor{
+		regras:   regras,
+		fuso:     time.FixedZone("local", regras.FusoHorario*3600),
+		validade: validade,
+		cotacoes: make(map[string]consts.Cotacao),
+		travadas: make(map[string]map[string]bool),
+	}
+}
+
+// Lê as regras de ARQUIVO_JSON_PRECOS; sem arquivo, o preço é o CustoKW estático do posto
+func MotorDoArquivo(arquivo string) *Motor {
+	if arquivo == "" {
+		log.Println("[PRECOS] ARQUIVO_JSON_PRECOS não definido. Usando os preços estáticos dos postos.")
+		return NovoMotor(consts.RegrasPreco{})
+	}
+	regras, err := storage.LerRegrasPreco(arquivo)
+	if err != nil {
+		log.Printf("[PRECOS] %v. Usando os preços estáticos dos postos.", err)
+		return NovoMotor(consts.RegrasPreco{})
+	}
+	return NovoMotor(regras)
+}
+
+// Converte "HH:MM" em minutos desde a meia-noite
+func minutosDoDia(hora string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(hora, "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("horário inválido: %s", hora)
+	}
+	return h*60 + m, nil
+}
+
+func (m *Motor) tarifaHorario(instante time.Time) (consts.TarifaHorario, bool) {
+	local := instante.In(m.fuso)
+	minuto := local.Hour()*60 + local.Minute()
+	for _, tarifa := range m.regras.Horarios {
+		inicio, err1 := minutosDoDia(tarifa.Inicio)
+		fim, err2 := minutosDoDia(tarifa.Fim)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		dentro := minuto >= inicio && minuto < fim
+		if inicio > fim { // atravessa a meia-noite
+			dentro = minuto >= inicio || minuto < fim
+		}
+		if dentro {
+			return tarifa, true
+		}
+	}
+	return consts.TarifaHorario{}, false
+}
+
+// Fração dos conectores do posto que não estão livres
+func ocupacao(posto consts.Posto) float64 {
+	if len(posto.Conectores) == 0 {
+		return 0
+	}
+	ocupados := 0
+	for _, conector := range posto.Conectores {
+		if !conector.Livre() {
+			ocupados++
+		}
+	}
+	return float64(ocupados) / float64(len(posto.Conectores))
+}
+
+// Calcula o preço atual do posto e guarda a cotação
+func (m *Motor) Cotar(posto consts.Posto) consts.Cotacao {
+	agora := time.Now()
+	preco := posto.CustoKW
+	var regras []string
+
+	if tarifa, ok := m.tarifaHorario(agora); ok && tarifa.Multiplicador > 0 {
+		preco *= tarifa.Multiplicador
+		regras = append(regras, fmt.Sprintf("horário %s x%.2f", tarifa.Nome, tarifa.Multiplicador))
+	}
+
+	// Usa a faixa de ocupação mais alta atingida
+	taxaOcupacao := ocupacao(posto)
+	var faixa *consts.TarifaOcupacao
+	for i := range m.regras.Ocupacao {
+		f := &m.regras.Ocupacao[i]
+		if taxaOcupacao >= f.Minima && (faixa == nil || f.Minima > faixa.Minima) {
+			faixa = f
+		}
+	}
+	if faixa != nil && faixa.Multiplicador > 0 {
+		preco *= faixa.Multiplicador
+		regras = append(regras, fmt.Sprintf("ocupação %.0f%% x%.2f", taxaOcupacao*100, faixa.Multiplicador))
+	}
+
+	if desconto, ok := m.regras.DescontosOperador[posto.Operador]; ok && desconto > 0 && desconto < 1 {
+		preco *= 1 - desconto
+		regras = append(regras, fmt.Sprintf("desconto %s %.0f%%", posto.Operador, desconto*100))
+	}
+
+	cotacao := consts.Cotacao{
+		ID:        consts.NovoID("COT"),
+		PostoID:   posto.Id,
+		PrecoBase: posto.CustoKW,
+		PrecoKWh:  consts.Arredondar(preco),
+		Regras:    regras,
+		EmitidaEm: agora,
+		ValidaAte: agora.Add(m.validade),
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removerExpiradas(agora)
+	m.cotacoes[cotacao.ID] = cotacao
+	return cotacao
+}
+
+// Descarta as cotações vencidas que não foram travadas por nenhuma transação
+func (m *Motor) removerExpiradas(agora time.Time) {
+	for id, cotacao := range m.cotacoes {
+		if len(m.travadas[id]) == 0 && agora.After(cotacao.ValidaAte) {
+			delete(m.cotacoes, id)
+		}
+	}
+}
+
+// Prepare do 2PC: trava a cotação para a transação e devolve o preço cotado. A mesma
+// cotação pode ser travada por várias transações (os postos remotos ficam em cache e
+// carros que planejam juntos recebem a mesma), mas só uma vez por transação.
+// Sem cotação informada, cota o preço atual.
+func (m *Motor) Travar(cotacaoID, transacaoID string, posto consts.Posto) (float64, error) {
+	if cotacaoID == "" {
+		return m.Cotar(posto).PrecoKWh, nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cotacao, ok := m.cotacoes[cotacaoID]
+	if !ok || cotacao.PostoID != posto.Id {
+		return 0, fmt.Errorf("cotação %s desconhecida para o posto %s", cotacaoID, posto.Id)
+	}
+	if m.travadas[cotacaoID][transacaoID] {
+		return cotacao.PrecoKWh, nil // prepare repetido
+	}
+	if time.Now().After(cotacao.ValidaAte) {
+		return 0, fmt.Errorf("cotação %s expirou em %s", cotacaoID, cotacao.ValidaAte.Format(time.RFC3339))
+	}
+	if m.travadas[cotacaoID] == nil {
+		m.travadas[cotacaoID] = make(map[string]bool)
+	}
+	m.travadas[cotacaoID][transacaoID] = true
+	return cotacao.PrecoKWh, nil
+}
+
+// Abort do 2PC: a transação solta a cotação, que continua valendo para as demais
+func (m *Motor) Destravar(cotacaoID, transacaoID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.soltar(cotacaoID, transacaoID)
+}
+
+// Commit do 2PC: devolve o preço travado pela transação, que a partir daqui fica guardado
+// na sessão. A cotação continua disponível até vencer.
+func (m *Motor) Consumir(cotacaoID, transacaoID string) (float64, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.travadas[cotacaoID][transacaoID] {
+		return 0, false
+	}
+	preco := m.cotacoes[cotacaoID].PrecoKWh
+	m.soltar(cotacaoID, transacaoID)
+	return preco, true
+}
+
+// Remove a trava da transação; chamado com m.mutex travado
+func (m *Motor) soltar(cotacaoID, transacaoID string) {
+	delete(m.travadas[cotacaoID], transacaoID)
+	if len(m.travadas[cotacaoID]) == 0 {
+		delete(m.travadas, cotacaoID)
+	}
+}
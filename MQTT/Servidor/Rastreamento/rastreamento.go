@@ -0,0 +1,65 @@
+package rastreamento
+
+import (
+	ambiente "MQTT/utils/Ambiente"
+	consts "MQTT/utils/Constantes"
+	rotaslib "MQTT/utils/Rotas"
+	"fmt"
+	"time"
+)
+
+// Quanto a viagem pode se afastar do plano antes de o coordenador propor um replanejamento
+type Limites struct {
+	AtrasoMaximo time.Duration // Atraso tolerado na chegada à próxima parada
+	FatorConsumo float64       // Consumo real tolerado, em múltiplos do Consumobateria do carro
+	DistanciaMin float64       // km percorridos entre duas telemetrias para medir o consumo
+}
+
+// Lê ATRASO_MAXIMO e FATOR_CONSUMO, com valores padrão
+func LimitesDoAmbiente() Limites {
+	return Limites{
+		AtrasoMaximo: ambiente.Duracao("ATRASO_MAXIMO", 15*time.Minute),
+		FatorConsumo: ambiente.FloatAcimaDe("FATOR_CONSUMO", 1, 1.2),
+		DistanciaMin: 1,
+	}
+}
+
+// Compara a telemetria com as paradas pendentes da reserva. Retorna o motivo para
+// replanejar, ou "" se a viagem segue o plano. online indica se um posto está no ar.
+func Avaliar(carro consts.Carro, anterior *consts.Telemetria, atual consts.Telemetria, paradas []consts.Parada, online func(postoID string) bool, limites Limites, agora time.Time) string {
+	if atual.ParadaAtual < 0 || atual.ParadaAtual >= len(paradas) {
+		return ""
+	}
+	for _, parada := range paradas[atual.ParadaAtual:] {
+		if !online(parada.IDPosto) {
+			return fmt.Sprintf("o posto %s está offline", parada.NomePosto)
+		}
+	}
+
+	posicao := consts.Coordenadas{Lat: atual.Lat, Lon: atual.Lon}
+	proxima := paradas[atual.ParadaAtual]
+	distancia := consts.CalcularDistancia(posicao, consts.Coordenadas{Lat: proxima.Lat, Lon: proxima.Lon})
+
+	if carro.Consumobateria > 0 && distancia*carro.Consumobateria > atual.Bateria {
+		return fmt.Sprintf("bateria insuficiente para chegar a %s (%.1f kWh, necessários %.1f kWh)", proxima.NomePosto, atual.Bateria, distancia*carro.Consumobateria)
+	}
+
+	if anterior != nil && carro.Consumobateria > 0 {
+		percorrida := consts.CalcularDistancia(consts.Coordenadas{Lat: anterior.Lat, Lon: anterior.Lon}, posicao)
+		consumida := anterior.Bateria - atual.Bateria
+		if percorrida >= limites.DistanciaMin && consumida > 0 {
+			if consumo := consumida / percorrida; consumo > carro.Consumobateria*limites.FatorConsumo {
+				return fmt.Sprintf("consumo de %.3f kWh/km acima do previsto (%.3f kWh/km)", consumo, carro.Consumobateria)
+			}
+		}
+	}
+
+	if !proxima.ChegadaPrevista.IsZero() {
+		// A chegada prevista é do relógio real; o atraso é comparado em tempo simulado
+		chegada := agora.Add(consts.TempoReal(time.Duration(distancia / rotaslib.VelocidadeMediaKmH * float64(time.Hour))))
+		if atraso := consts.TempoSimulado(chegada.Sub(proxima.ChegadaPrevista)); atraso > limites.AtrasoMaximo {
+			return fmt.Sprintf("atraso previsto de %.0f min até %s", atraso.Minutes(), proxima.NomePosto)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,342 @@
+package sessoes
+
+import (
+	consts "MQTT/utils/Constantes"
+	storage "MQTT/utils/storage"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Transições permitidas da máquina de estados da sessão de recarga
+var transicoes = map[consts.EstadoSessao][]consts.EstadoSessao{
+	consts.SessaoReservada:   {consts.SessaoCarroChegou, consts.SessaoAbortada},
+	consts.SessaoCarroChegou: {consts.SessaoCarregando, consts.SessaoFinalizada, consts.SessaoAbortada},
+	consts.SessaoCarregando:  {consts.SessaoFinalizada, consts.SessaoAbortada},
+}
+
+// Gerenciador das sessões de recarga dos postos deste servidor
+type Gerenciador struct {
+	mutex   sync.Mutex
+	arquivo string // vazio mantém as sessões apenas em memória
+	sessoes map[string]*consts.SessaoRecarga
+	// Prazo de chegada: horário previsto (ou reserva + janela, sem previsão) mais a tolerância
+	janela     time.Duration
+	tolerancia time.Duration
+}
+
+// Carrega as sessões salvas em arquivo para que reservas e recargas em andamento
+// sobrevivam a um reinício do servidor
+func NovoGerenciador(arquivo string, janela, tolerancia time.Duration) *Gerenciador {
+	g := &Gerenciador{
+		arquivo:    arquivo,
+		sessoes:    make(map[string]*consts.SessaoRecarga),
+		janela:     janela,
+		tolerancia: tolerancia,
+	}
+	if arquivo == "" {
+		log.Println("[SESSAO] ARQUIVO_JSON_SESSOES não definido. Sessões mantidas apenas em memória.")
+		return g
+	}
+	sessoes, err := storage.LerSessoes(arquivo)
+	if err != nil {
+		log.Printf("[SESSAO] %v. Iniciando sem sessões.", err)
+		return g
+	}
+	g.sessoes = sessoes
+	ativas := 0
+	for _, sessao := range sessoes {
+		if !Terminal(sessao.Estado) {
+			ativas++
+		}
+	}
+	log.Printf("[SESSAO] %d sessão(ões) carregada(s) de %s, %d ativa(s)", len(sessoes), arquivo, ativas)
+	return g
+}
+
+// Grava as sessões no arquivo; chamado com g.mutex travado depois de cada mudança
+func (g *Gerenciador) salvar() {
+	if g.arquivo == "" {
+		return
+	}
+	if err := storage.SalvarSessoes(g.arquivo, g.sessoes); err != nil {
+		log.Printf("[SESSAO] Erro ao salvar sessões: %v", err)
+	}
+}
+
+func Terminal(estado consts.EstadoSessao) bool {
+	return estado == consts.SessaoFinalizada || estado == consts.SessaoAbortada
+}
+
+func podeTransicionar(de, para consts.EstadoSessao) bool {
+	for _, permitido := range transicoes[de] {
+		if permitido == para {
+			return true
+		}
+	}
+	return false
+}
+
+// Recusa no prepare uma chegada prevista que já passou. Sem previsão, vale a janela de reserva.
+func (g *Gerenciador) ValidarChegada(chegadaPrevista, agora time.Time) error {
+	if !chegadaPrevista.IsZero() && chegadaPrevista.Before(agora) {
+		return fmt.Errorf("chegada prevista (%s) já passou", chegadaPrevista.Format("15:04:05"))
+	}
+	return nil
+}
+
+// Cria a sessão no estado "reservada" quando o commit do 2PC é aplicado no posto,
+// com o preço travado na cotação e o prazo de chegada. A chegada prevista fica limitada
+// à janela de reserva a partir de agora.
+func (g *Gerenciador) Reservar(transacaoID, cidade string, carro consts.Carro, posto *consts.Posto, conector *consts.Conector, precoKWh float64, chegadaPrevista time.Time) consts.SessaoRecarga {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	agora := time.Now()
+	limite := agora.Add(g.janela)
+	switch {
+	case chegadaPrevista.IsZero() || chegadaPrevista.After(limite):
+		chegadaPrevista = limite
+	case chegadaPrevista.Before(agora):
+		chegadaPrevista = agora // Validada no prepare; passou entre o prepare e o commit
+	}
+
+	sessao := &consts.SessaoRecarga{
+		ID:                consts.NovoID("SES"),
+		TransacaoID:       transacaoID,
+		CarroID:           carro.ID,
+		PostoID:           posto.Id,
+		ConectorID:        conector.ID,
+		Cidade:            cidade,
+		Estado:            consts.SessaoReservada,
+		PotenciaKW:        consts.PotenciaEfetiva(*conector, carro),
+		PrecoKWh:          precoKWh,
+		BateriaInicial:    carro.Bateria,
+		CapacidadeBateria: carro.CapacidadeBateria,
+		ReservadaEm:       agora,
+		ExpiraEm:          chegadaPrevista.Add(g.tolerancia),
+	}
+	// O carro acabou de entrar no fim da fila do conector
+	if posicao := len(conector.Fila) - 1; posicao > 0 {
+		sessao.PosicaoFila = posicao
+		sessao.EsperaEstimadaMin = conector.EsperaEstimadaMin(posicao)
+	}
+	g.sessoes[sessao.ID] = sessao
+	g.salvar()
+	log.Printf("[SESSAO] %s reservada: carro %s no posto %s (%s)", sessao.ID, carro.ID, posto.Id, conector.ID)
+	return *sessao
+}
+
+func (g *Gerenciador) Buscar(id string) (consts.SessaoRecarga, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sessao, ok := g.sessoes[id]
+	if !ok {
+		return consts.SessaoRecarga{}, false
+	}
+	return *sessao, true
+}
+
+// Sessão ainda não encerrada do carro. Com postoID vazio, considera qualquer posto.
+func (g *Gerenciador) BuscarAtiva(carroID, postoID string) (consts.SessaoRecarga, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sessao := g.buscarAtiva(carroID, postoID)
+	if sessao == nil {
+		return consts.SessaoRecarga{}, false
+	}
+	return *sessao, true
+}
+
+func (g *Gerenciador) buscarAtiva(carroID, postoID string) *consts.SessaoRecarga {
+	var escolhida *consts.SessaoRecarga
+	for _, sessao := range g.sessoes {
+		if sessao.CarroID != carroID || Terminal(sessao.Estado) {
+			continue
+		}
+		if postoID != "" && sessao.PostoID != postoID {
+			continue
+		}
+		// Prioriza a sessão mais avançada (ex: a que já está carregando)
+		if escolhida == nil || ordemEstado(sessao.Estado) > ordemEstado(escolhida.Estado) {
+			escolhida = sessao
+		}
+	}
+	return escolhida
+}
+
+func ordemEstado(estado consts.EstadoSessao) int {
+	switch estado {
+	case consts.SessaoCarroChegou:
+		return 1
+	case consts.SessaoCarregando:
+		return 2
+	}
+	return 0
+}
+
+// Todas as sessões do carro neste servidor (inclusive encerradas)
+func (g *Gerenciador) DoCarro(carroID string) []consts.SessaoRecarga {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var lista []consts.SessaoRecarga
+	for _, sessao := range g.sessoes {
+		if sessao.CarroID == carroID {
+			lista = append(lista, *sessao)
+		}
+	}
+	return lista
+}
+
+func (g *Gerenciador) transicionar(sessao *consts.SessaoRecarga, para consts.EstadoSessao) error {
+	if !podeTransicionar(sessao.Estado, para) {
+		return fmt.Errorf("transição inválida da sessão %s: %s → %s", sessao.ID, sessao.Estado, para)
+	}
+	log.Printf("[SESSAO] %s: %s → %s", sessao.ID, sessao.Estado, para)
+	sessao.Estado = para
+	return nil
+}
+
+// O carro sinalizou que chegou ao posto reservado, informando a bateria atual (0 mantém a da reserva)
+func (g *Gerenciador) RegistrarChegada(carroID, postoID string, bateria float64) (consts.SessaoRecarga, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sessao := g.buscarAtiva(carroID, postoID)
+	if sessao == nil {
+		return consts.SessaoRecarga{}, fmt.Errorf("carro %s não tem reserva ativa no posto %s", carroID, postoID)
+	}
+	if err := g.transicionar(sessao, consts.SessaoCarroChegou); err != nil {
+		return *sessao, err
+	}
+	sessao.ChegadaEm = time.Now()
+	if bateria > 0 {
+		sessao.BateriaInicial = bateria
+	}
+	g.salvar()
+	return *sessao, nil
+}
+
+// O posto confirmou o início da recarga
+func (g *Gerenciador) RegistrarInicio(sessaoID string) (consts.SessaoRecarga, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sessao, ok := g.sessoes[sessaoID]
+	if !ok {
+		return consts.SessaoRecarga{}, fmt.Errorf("sessão %s não encontrada", sessaoID)
+	}
+	if err := g.transicionar(sessao, consts.SessaoCarregando); err != nil {
+		return *sessao, err
+	}
+	sessao.InicioEm = time.Now()
+	g.salvar()
+	return *sessao, nil
+}
+
+// Encerra a sessão com a energia medida pelo posto. Energia negativa indica que o posto
+// não informou a medição e ela deve ser estimada pelo tempo conectado.
+func (g *Gerenciador) Finalizar(sessaoID string, energiaKWh float64) (consts.SessaoRecarga, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sessao, ok := g.sessoes[sessaoID]
+	if !ok {
+		return consts.SessaoRecarga{}, fmt.Errorf("sessão %s não encontrada", sessaoID)
+	}
+	if err := g.transicionar(sessao, consts.SessaoFinalizada); err != nil {
+		return *sessao, err
+	}
+	sessao.FimEm = time.Now()
+	inicio := sessao.InicioEm
+	if inicio.IsZero() {
+		inicio = sessao.ChegadaEm
+	}
+	// O posto carrega em tempo simulado: duração e energia estimada usam a mesma escala
+	conectado := consts.TempoSimulado(sessao.FimEm.Sub(inicio))
+	sessao.DuracaoMin = conectado.Minutes()
+	if energiaKWh < 0 {
+		energiaKWh = EstimarEnergia(*sessao, conectado)
+	}
+	sessao.EnergiaKWh = energiaKWh
+	g.salvar()
+	log.Printf("[SESSAO] %s finalizada: %.2f kWh em %.1f min", sessao.ID, sessao.EnergiaKWh, sessao.DuracaoMin)
+	return *sessao, nil
+}
+
+// Aborta a sessão (cancelamento, desconexão, liberação pelo coordenador)
+func (g *Gerenciador) Abortar(sessaoID, motivo string) (consts.SessaoRecarga, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sessao, ok := g.sessoes[sessaoID]
+	if !ok {
+		return consts.SessaoRecarga{}, fmt.Errorf("sessão %s não encontrada", sessaoID)
+	}
+	if err := g.transicionar(sessao, consts.SessaoAbortada); err != nil {
+		return *sessao, err
+	}
+	sessao.FimEm = time.Now()
+	sessao.Motivo = motivo
+	g.salvar()
+	return *sessao, nil
+}
+
+// Aborta por no-show as reservas cujo carro não sinalizou a chegada dentro do prazo
+func (g *Gerenciador) Expiradas(agora time.Time) []consts.SessaoRecarga {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var expiradas []consts.SessaoRecarga
+	for _, sessao := range g.sessoes {
+		if sessao.Estado != consts.SessaoReservada || sessao.ExpiraEm.IsZero() || agora.Before(sessao.ExpiraEm) {
+			continue
+		}
+		if err := g.transicionar(sessao, consts.SessaoAbortada); err != nil {
+			continue
+		}
+		sessao.FimEm = agora
+		sessao.Motivo = consts.MotivoNoShow
+		expiradas = append(expiradas, *sessao)
+	}
+	if len(expiradas) > 0 {
+		g.salvar()
+	}
+	return expiradas
+}
+
+// Aborta todas as sessões ativas do carro (em um posto e conector específicos, se não
+// forem vazios)
+func (g *Gerenciador) AbortarDoCarro(carroID, postoID, conectorID, motivo string) []consts.SessaoRecarga {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var abortadas []consts.SessaoRecarga
+	for _, sessao := range g.sessoes {
+		if sessao.CarroID != carroID || Terminal(sessao.Estado) {
+			continue
+		}
+		if postoID != "" && sessao.PostoID != postoID {
+			continue
+		}
+		if conectorID != "" && sessao.ConectorID != conectorID {
+			continue
+		}
+		if err := g.transicionar(sessao, consts.SessaoAbortada); err != nil {
+			continue
+		}
+		sessao.FimEm = time.Now()
+		sessao.Motivo = motivo
+		abortadas = append(abortadas, *sessao)
+	}
+	if len(abortadas) > 0 {
+		g.salvar()
+	}
+	return abortadas
+}
+
+// Energia entregue estimada pela potência efetiva em uma duração simulada, limitada ao
+// que faltava na bateria
+func EstimarEnergia(sessao consts.SessaoRecarga, duracao time.Duration) float64 {
+	energia := sessao.PotenciaKW * duracao.Hours()
+	if sessao.CapacidadeBateria > 0 {
+		energia = math.Min(energia, sessao.CapacidadeBateria-sessao.BateriaInicial)
+	}
+	return math.Max(energia, 0)
+}
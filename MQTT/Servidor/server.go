@@ -2,19 +2,31 @@ package main
 
 import (
 	api "MQTT/Servidor/API"
+	carteira "MQTT/Servidor/Carteira"
+	faturamento "MQTT/Servidor/Faturamento"
+	monitor "MQTT/Servidor/Monitor"
+	precos "MQTT/Servidor/Precos"
+	rastreamento "MQTT/Servidor/Rastreamento"
+	sessoes "MQTT/Servidor/Sessoes"
+	ambiente "MQTT/utils/Ambiente"
 	consts "MQTT/utils/Constantes"
 	rotaslib "MQTT/utils/Rotas"
 	topics "MQTT/utils/Topicos"
 	clientemqtt "MQTT/utils/mqttLib/ClienteMQTT"
 	router "MQTT/utils/mqttLib/Router"
 	storage "MQTT/utils/storage"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -22,18 +34,48 @@ type Servidor struct {
 	IP     string
 	ID     string
 	Cidade string
+	URL    string // Endpoint HTTP anunciado aos outros servidores
 	Client clientemqtt.MQTTClient
 	Pontos map[string][]*consts.Posto
 	carrosConectados map[string]*ConnectedCarStatus
 	carrosConectadosMutex sync.Mutex
+	peers      map[string]consts.AnuncioServidor // Servidores descobertos, por cidade
+	peersMutex sync.RWMutex
+	Sessoes    *sessoes.Gerenciador // Sessões de recarga dos postos desta cidade
+	Monitor    *monitor.Monitor     // Heartbeats dos postos
+	Faturas    *faturamento.Faturador
+	Carteiras  *carteira.Carteiras // Apenas no servidor da cidade marcada como carteira
+	Precos     *precos.Motor       // Preços dinâmicos dos postos desta cidade
+	Limites    rastreamento.Limites // Desvios da viagem que disparam um replanejamento
+	ProfundidadeFila int           // Carros aceitos na fila de cada conector
+	viagens      map[string][]string // URLs dos participantes de cada transação coordenada
+	viagensMutex sync.Mutex
+	ToleranciaDesconexao time.Duration // Espera pela reconexão do carro antes de liberar as reservas
+	desconexoes      map[string]*time.Timer // Limpezas agendadas pelo LWT, canceladas pela reconexão
+	reconexoes       map[string]time.Time   // Último anúncio de reconexão de cada carro
+	desconexoesMutex sync.Mutex
+	encerrando        bool           // Recusa novas transações 2PC durante o encerramento
+	transacoes        sync.WaitGroup // Transações 2PC coordenadas em andamento
+	encerramentoMutex sync.Mutex
 
 }
 
+const VersaoServidor = "1.1.0"
+
+// Funcionalidades expostas pela API HTTP deste servidor
+var capacidadesServidor = []string{"postos", "2pc", "release", "conectores", "sessoes", "heartbeat-postos", "faturas", "carteira", "cotacoes"}
+
+// Tempo que o servidor espera o posto confirmar o fim da recarga antes de estimar a energia
+const tempoEsperaPosto = 10 * time.Second
+
 type ConnectedCarStatus struct {
     LastActivity       time.Time
     ReservedPostoID    string // Primeiro posto ou posto local
     CommittedReserva   *consts.Reserva // A reserva completa que foi comitada
     Participantes2PC   []consts.Participante2PC // Os participantes originais do 2PC
+    Telemetria         *consts.Telemetria // Última posição e bateria informadas pelo carro
+    Proposta           []consts.Parada    // Replanejamento aguardando a resposta do carro
+    UltimaProposta     time.Time
 }
 
 
@@ -41,16 +83,6 @@ var (
 	arquivoPontos = os.Getenv("ARQUIVO_JSON")
 )
 
-// Mapa de cidades para containers e portas
-var cidadeConfig = map[string]struct {
-	Container string
-	Porta     string
-}{
-	"FSA": {"feiradesantana", "8080"},
-	"ILH": {"ilheus", "8081"},
-	"SSA": {"salvador", "8082"},
-}
-
 // A variavel solicitação é para concatenar a string ao topico evitando multiplas condições
 func (s *Servidor) ResponderCarro(carID string, conteudoJSON []byte) {
 	topic := topics.ServerResponseToCar(carID)
@@ -63,9 +95,20 @@ func (s *Servidor) AssinarEventosDoCarro() {
 		topics.CarroRequestReserva("+", s.IP, s.Cidade),
 		topics.CarroRequestStatus("+", s.IP, s.Cidade),
 		topics.CarroRequestCancel("+"),
+		topics.CarroRequestAlteracao("+", s.IP, s.Cidade),
+		topics.CarroRequestReplanejamento("+", s.IP, s.Cidade),
+		topics.CarroTelemetria("+"),
 		topics.CarroRequestRotas("+", s.Cidade),
 		topics.CarroDesconectado("+"),
+		topics.CarroReconectado("+"),
+		topics.CarroSendsRechargeStart("+", s.IP, s.Cidade),
 		topics.CarroSendsRechargeFinish("+"),
+		topics.StationEventStarted("+"),
+		topics.StationEventFinished("+"),
+		topics.StationStatus("+"),
+		topics.ServerAnuncio("+"),
+		topics.ServerReservaExpirada("+"),
+		topics.ServerParadaConcluida("+"),
 	}
 	for _, topic := range topicsToSubscribe {
 		log.Printf("[SERVIDOR] Assinando tópico: %s", topic)
@@ -105,8 +148,8 @@ func (s *Servidor) adicionarAoArquivo(path string, novoDado interface{}) error {
 		if posto.Id == idNovoPosto {
 			// Atualizar as informações do posto
 			postos[i].Nome = novoPosto["name"].(string)
-			postos[i].X = novoPosto["x"].(float64)
-			postos[i].Y = novoPosto["y"].(float64)
+			postos[i].Lat = novoPosto["lat"].(float64)
+			postos[i].Lon = novoPosto["lon"].(float64)
 			postos[i].CustoKW = novoPosto["custoKW"].(float64)
 			postoAtualizado = true
 			break
@@ -118,8 +161,8 @@ func (s *Servidor) adicionarAoArquivo(path string, novoDado interface{}) error {
 		novoPostoStruturado := consts.Posto{
 			Id:      idNovoPosto,
 			Nome:    novoPosto["name"].(string),
-			X:       novoPosto["x"].(float64),
-			Y:       novoPosto["y"].(float64),
+			Lat:     novoPosto["lat"].(float64),
+			Lon:     novoPosto["lon"].(float64),
 			CustoKW: novoPosto["custoKW"].(float64),
 		}
 		postos = append(postos, novoPostoStruturado)
@@ -148,8 +191,10 @@ func inicializarServidor() Servidor {
 	}
 	
 	routerServidor := router.NewRouter()
+	cidade := os.Getenv("CIDADE")
 
-	mqttClient := *clientemqtt.NewClient(string(consts.Broker), routerServidor, topics.ServerDesconectado(ip), ip)
+	// O LWT apaga o anúncio retido, então os outros servidores deixam de usar este endpoint
+	mqttClient := *clientemqtt.NewClientWithWill(string(consts.Broker), routerServidor, topics.ServerAnuncio(cidade), []byte{}, true)
 
 	token := mqttClient.Connect()
 	if token.Wait() && token.Error() != nil {
@@ -161,9 +206,159 @@ func inicializarServidor() Servidor {
 	return Servidor{
 		IP:     ip,
 		Client: mqttClient,
-		Cidade: os.Getenv("CIDADE"),
+		Cidade: cidade,
+		URL:    urlPublica(cidade),
 		carrosConectados: make(map[string]*ConnectedCarStatus),
+		peers:            make(map[string]consts.AnuncioServidor),
+		Sessoes:          sessoes.NovoGerenciador(os.Getenv("ARQUIVO_JSON_SESSOES"), consts.TempoReal(ambiente.Duracao("JANELA_RESERVA", 2*time.Hour)), consts.TempoReal(ambiente.Duracao("TOLERANCIA_CHEGADA", 30*time.Minute))),
+		Monitor:          monitor.NovoMonitor(ambiente.Duracao("TIMEOUT_HEARTBEAT_POSTO", 15*time.Second)),
+		Faturas:          faturamento.NovoFaturador(os.Getenv("ARQUIVO_JSON_FATURAS"), faturamento.TarifasDoAmbiente()),
+		viagens:          make(map[string][]string),
+		Carteiras:        carteirasDoServidor(cidade),
+		Precos:           precos.MotorDoArquivo(os.Getenv("ARQUIVO_JSON_PRECOS")),
+		ProfundidadeFila: ambiente.Inteiro("PROFUNDIDADE_FILA", 3),
+		Limites:          rastreamento.LimitesDoAmbiente(),
+		ToleranciaDesconexao: ambiente.Duracao("TOLERANCIA_DESCONEXAO", 30*time.Second),
+		desconexoes:          make(map[string]*time.Timer),
+		reconexoes:           make(map[string]time.Time),
+	}
+}
+
+// Só o servidor da cidade marcada como "carteira" no registro mantém os saldos (SALDO_INICIAL para carros novos)
+func carteirasDoServidor(cidade string) *carteira.Carteiras {
+	cidadeCarteira, ok := consts.CidadeCarteira()
+	if !ok || cidadeCarteira.ID != cidade {
+		return nil
+	}
+	saldoInicial := ambiente.Float("SALDO_INICIAL", 500)
+	log.Printf("[SERVIDOR] Este servidor mantém as carteiras dos carros (saldo inicial R$ %.2f)", saldoInicial)
+	return carteira.NovasCarteiras(os.Getenv("ARQUIVO_JSON_CARTEIRAS"), saldoInicial)
+}
+
+// Dependências da API HTTP ligadas às sessões e aos callbacks deste servidor
+func (s *Servidor) dependencias() api.Dependencias {
+	return api.Dependencias{
+		Cidade:             s.Cidade,
+		Sessoes:            s.Sessoes,
+		Monitor:            s.Monitor,
+		Faturas:            s.Faturas,
+		Precos:             s.Precos,
+		ProfundidadeFila:   s.ProfundidadeFila,
+		Carteiras:          s.Carteiras,
+		ConsolidarViagem:   s.consolidarViagem,
+		AoReservarSessao:   s.sessaoReservada,
+		AoAbortarSessao:    s.sessaoAbortada,
+		AoPromoverDaEspera: s.vagaNaEspera,
+		AoLiberarConector:  s.conectorLiberado,
+		Encerrando:         s.estaEncerrando,
+	}
+}
+
+// Verifica periodicamente quais postos pararam de enviar heartbeat
+func (s *Servidor) MonitorarPostos() {
+	for range time.Tick(5 * time.Second) {
+		s.Monitor.VerificarExpirados()
+	}
+}
+
+// Aborta as reservas dos postos locais cujo carro não chegou no prazo (no-show)
+func (s *Servidor) ExpirarReservas() {
+	for range time.Tick(30 * time.Second) {
+		for _, sessao := range s.Sessoes.Expiradas(time.Now()) {
+			log.Printf("[SESSAO] Carro %s não chegou ao posto %s até %s. Reserva expirada.", sessao.CarroID, sessao.PostoID, sessao.ExpiraEm.Format("15:04:05"))
+			if err := api.LiberarConector(arquivoPontos, sessao.PostoID, sessao.ConectorID, sessao.CarroID); err != nil {
+				log.Printf("[SESSAO] Erro ao liberar conector: %v", err)
+			}
+			s.sessaoAbortada(sessao)
+			s.conectorLiberado(sessao.PostoID, sessao.ConectorID)
+
+			// O coordenador da transação libera as demais paradas da reserva
+			aviso, _ := json.Marshal(consts.ReservaExpirada{
+				TransacaoID: sessao.TransacaoID,
+				SessaoID:    sessao.ID,
+				CarroID:     sessao.CarroID,
+				PostoID:     sessao.PostoID,
+			})
+			s.Client.Publish(topics.ServerReservaExpirada(sessao.TransacaoID), aviso)
+		}
+	}
+}
+
+// URL_SERVIDOR tem prioridade; senão usa o nome do container e a porta, e por último o registro de cidades
+func urlPublica(cidade string) string {
+	if url := os.Getenv("URL_SERVIDOR"); url != "" {
+		return url
 	}
+	container, porta := os.Getenv("CONTAINER"), os.Getenv("PORTA")
+	if container != "" && porta != "" {
+		return fmt.Sprintf("http://%s:%s", container, porta)
+	}
+	info, _ := consts.BuscarCidade(cidade)
+	return info.Servidor
+}
+
+// Publica o anúncio retido deste servidor para que os outros o descubram
+func (s *Servidor) Anunciar() {
+	anuncio := consts.AnuncioServidor{
+		ID:          s.IP,
+		Cidade:      s.Cidade,
+		URL:         s.URL,
+		Capacidades: capacidadesServidor,
+		Versao:      VersaoServidor,
+		Inicio:      time.Now(),
+	}
+	anuncioJSON, err := json.Marshal(anuncio)
+	if err != nil {
+		log.Printf("[SERVIDOR] Erro ao serializar anúncio: %v", err)
+		return
+	}
+	s.Client.PublishRetained(topics.ServerAnuncio(s.Cidade), anuncioJSON)
+	log.Printf("[SERVIDOR] Anunciado em %s: %s", topics.ServerAnuncio(s.Cidade), s.URL)
+}
+
+// Anúncios de qualquer cidade, inclusive as que não estão no registro local. O payload vazio
+// é o anúncio apagado pelo LWT (ou desligamento) do servidor; a cidade vem do tópico.
+func (s *Servidor) handleAnuncioServidor(topico string, payload []byte) {
+	if len(payload) == 0 {
+		s.removerPeer(topics.CidadeDoAnuncio(topico))
+		return
+	}
+	var anuncio consts.AnuncioServidor
+	if err := json.Unmarshal(payload, &anuncio); err != nil {
+		log.Printf("[SERVIDOR] Anúncio inválido: %v", err)
+		return
+	}
+	if anuncio.Cidade == "" {
+		anuncio.Cidade = topics.CidadeDoAnuncio(topico)
+	}
+	s.peersMutex.Lock()
+	s.peers[strings.ToUpper(anuncio.Cidade)] = anuncio
+	s.peersMutex.Unlock()
+	log.Printf("[SERVIDOR] Servidor descoberto: %s -> %s (v%s, %v)", anuncio.Cidade, anuncio.URL, anuncio.Versao, anuncio.Capacidades)
+}
+
+// Remove o servidor da cidade cujo anúncio foi apagado
+func (s *Servidor) removerPeer(cidade string) {
+	s.peersMutex.Lock()
+	defer s.peersMutex.Unlock()
+	if _, ok := s.peers[cidade]; ok {
+		delete(s.peers, cidade)
+		log.Printf("[SERVIDOR] Servidor de %s saiu do ar (anúncio removido)", cidade)
+	}
+}
+
+// URL do servidor responsável pela cidade: anúncios descobertos primeiro, registro de cidades como reserva
+func (s *Servidor) urlServidor(cidade string) (string, bool) {
+	s.peersMutex.RLock()
+	anuncio, ok := s.peers[strings.ToUpper(cidade)]
+	s.peersMutex.RUnlock()
+	if ok && anuncio.URL != "" {
+		return anuncio.URL, true
+	}
+	if info, ok := consts.BuscarCidade(cidade); ok && info.Servidor != "" {
+		return info.Servidor, true
+	}
+	return "", false
 }
 
 func serializarMensagem(msg consts.Mensagem) []byte {
@@ -185,26 +380,48 @@ func (S *Servidor) regitrarHandlersMQTT() {
 			return
 		}
 		log.Printf("Reserva recebida: %+v\n", reserva)
+		if !S.iniciarTransacao() {
+			log.Printf("[SERVIDOR] Reserva do carro %s recusada: servidor encerrando.\n", reserva.Carro.ID)
+			S.Client.Publish(topics.ServerReserveStatus(S.IP, reserva.Carro.ID), serializarMensagem(consts.Mensagem{
+				Conteudo: map[string]interface{}{"status": "ERRO"},
+				Origem:   S.Cidade,
+				ID:       S.IP,
+			}))
+			return
+		}
+		defer S.transacoes.Done()
+
+		// Uma viagem por vez: a reserva comitada precisa ser concluída ou cancelada antes
+		S.carrosConectadosMutex.Lock()
+		anterior, temAnterior := S.carrosConectados[reserva.Carro.ID]
+		temAnterior = temAnterior && anterior.CommittedReserva != nil
+		S.carrosConectadosMutex.Unlock()
+		if temAnterior {
+			log.Printf("[SERVIDOR] Reserva do carro %s recusada: a reserva %s ainda está ativa.\n", reserva.Carro.ID, anterior.CommittedReserva.ID)
+			S.Client.Publish(topics.ServerReserveStatus(S.IP, reserva.Carro.ID), serializarMensagem(consts.Mensagem{
+				Conteudo: map[string]interface{}{
+					"status":   "ERRO",
+					"mensagem": fmt.Sprintf("O carro já tem a reserva %s ativa; cancele-a antes de reservar outra viagem.", anterior.CommittedReserva.ID),
+				},
+				Origem: S.Cidade,
+				ID:     S.IP,
+			}))
+			return
+		}
 
 		// MONTAR URL QUE VAI FAZER PARTE DE PARTICIPANTE2PC EX: "http//:servidor-ip/config.container/portas"
 		// Aqui eu tenho que montar um slice dos participantes do 2PC. Cada posto é gerenciado por um servidor especifico.
 		// Ex de um PARTICIPANTE2PC a reserva vai passar as cidades que estão presentes nas paradas em postos da rota selecionada
 		// Desse modo eu preciso iterar pelo slice de paradas recebido? E então montar as urls e começar a gerar o participante2PC?
-		serverURLs := make(map[string]string)
-		for cidade, configs := range cidadeConfig {
-			// parada agora tem a cidade na struct
-			serverURLs[cidade] = fmt.Sprintf("http://servidor-%s:%s", configs.Container, configs.Porta)
-		}
-
 		var participantes []consts.Participante2PC
 
 		// Itera sobre as paradas da reserva que já contêm as informações necessárias
-		for _, parada := range reserva.Paradas {
-			if serverURL, ok := serverURLs[parada.Cidade]; ok {
-				participantes = append(participantes, consts.Participante2PC{
-					URL:     serverURL,
-					PostoID: parada.IDPosto,
-				})
+		energias := S.energiaDasParadas(reserva.Carro, reserva.Paradas)
+		for i, parada := range reserva.Paradas {
+			// parada agora tem a cidade na struct
+			if participante, ok := S.participanteDaParada(parada); ok {
+				participante.EnergiaKWh = energias[i]
+				participantes = append(participantes, participante)
 			} else {
 				log.Printf("[ERRO] URL do servidor para a cidade '%s' não encontrada na configuração. Abortando 2PC.\n", parada.Cidade)
 				// Enviar uma resposta de erro para o carro aqui.
@@ -212,18 +429,38 @@ func (S *Servidor) regitrarHandlersMQTT() {
 			}
 		}
 
+		// A carteira é o último recurso do 2PC: retém o valor estimado da rota inteira
+		if participanteCarteira, ok := S.participanteCarteira(); ok {
+			participantes = append(participantes, participanteCarteira)
+		}
+
 		// Executa o algoritmo Two-Phase Commit
 		topic := topics.ServerReserveStatus(S.IP, reserva.Carro.ID)
+		reserva.ID = consts.NovoID("TX")
 
-		if err := api.TwoPhaseCommit(participantes, reserva.Carro); err != nil {
+		err := api.TwoPhaseCommit(reserva.ID, participantes, reserva.Carro)
+		// A disponibilidade dos participantes mudou (ou pode ter mudado): descarta o cache deles
+		for _, p := range participantes {
+			if p.Recurso == consts.RecursoPosto {
+				api.InvalidarCachePostos(p.URL)
+			}
+		}
+		if err != nil {
 			log.Printf("[ERRO] Two-Phase Commit falhou: %v\n", err)
 			// Lidar com a falha (notificar o carro, etc.)
+			conteudo := map[string]interface{}{
+				"status": "ERRO",
+			}
+			if reserva.ListaEspera {
+				if postoID, posicao, ok := S.entrarNaListaEspera(reserva, err); ok {
+					conteudo["lista_espera"] = postoID
+					conteudo["posicao"] = strconv.Itoa(posicao)
+				}
+			}
 			msg := consts.Mensagem{
-				Conteudo: map[string]interface{}{
-					"status": "ERRO",
-				},
-				Origem: S.Cidade,
-				ID:     S.IP,
+				Conteudo: conteudo,
+				Origem:   S.Cidade,
+				ID:       S.IP,
 			}
 			S.Client.Publish(topic, serializarMensagem(msg))
 		} else {
@@ -232,12 +469,14 @@ func (S *Servidor) regitrarHandlersMQTT() {
 
 			msg := consts.Mensagem{
 				Conteudo: map[string]interface{}{
-					"status": "OK",
+					"status":    "OK",
+					"transacao": reserva.ID,
 				},
 				Origem: S.Cidade,
 				ID:     S.IP,
 			}
 			S.Client.Publish(topic, serializarMensagem(msg))
+			S.registrarViagem(reserva.ID, participantes)
 			// --- CHAVE: Armazenar o estado da reserva no Coordenador após o COMMIT ---
 			S.carrosConectadosMutex.Lock()
 			if _, ok := S.carrosConectados[reserva.Carro.ID]; !ok {
@@ -252,6 +491,38 @@ func (S *Servidor) regitrarHandlersMQTT() {
 		log.Println("Publicou no topico: ", topic)
 
 	})
+	routerServidor.Register(topics.CarroRequestStatus("+", S.IP, S.Cidade), func(payload []byte) {
+		var msg map[string]string
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			log.Printf("[ERRO] Erro ao decodificar mensagem: %v\n", err)
+			return
+		}
+		S.responderStatusReserva(msg["IDCarro"])
+	})
+	routerServidor.Register(topics.CarroRequestAlteracao("+", S.IP, S.Cidade), func(payload []byte) {
+		var alteracao consts.AlteracaoReserva
+		if err := json.Unmarshal(payload, &alteracao); err != nil {
+			log.Printf("[ERRO] Erro ao decodificar alteração de reserva: %v\n", err)
+			return
+		}
+		S.processAlteracaoReserva(alteracao)
+	})
+	routerServidor.Register(topics.CarroTelemetria("+"), func(payload []byte) {
+		var telemetria consts.Telemetria
+		if err := json.Unmarshal(payload, &telemetria); err != nil || telemetria.CarroID == "" {
+			log.Printf("[ERRO] Telemetria inválida: %s\n", string(payload))
+			return
+		}
+		S.processTelemetria(telemetria)
+	})
+	routerServidor.Register(topics.CarroRequestReplanejamento("+", S.IP, S.Cidade), func(payload []byte) {
+		var msg map[string]string
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			log.Printf("[ERRO] Erro ao decodificar mensagem: %v\n", err)
+			return
+		}
+		S.processRespostaReplanejamento(msg["IDCarro"], msg["Aceitar"] == "sim")
+	})
 	routerServidor.Register(topics.CarroRequestCancel("+"), func(payload []byte) {
 		log.Println("[DEBUG] Carro cancelou reserva")
 		var msg map[string]string
@@ -261,7 +532,7 @@ func (S *Servidor) regitrarHandlersMQTT() {
 			return 
 		}
 		idCarro := msg["IDCarro"]
-		log.Printf("MensageM: %f", msg["Msg"])
+		log.Printf("MensageM: %s", msg["Msg"])
 		S.processCarroDisconnected(idCarro)
 
 	})
@@ -270,52 +541,15 @@ func (S *Servidor) regitrarHandlersMQTT() {
 		if err := json.Unmarshal(payload, &conteudoMsg); err != nil {
 			log.Println("Erro ao decodificar mensagem:", err)
 		}
-		dadosRotas := storage.LerRotas()
-		rotasValidas := rotaslib.GetRotasValidas(dadosRotas.Rotas, conteudoMsg)
-		log.Println("Rotas válidas: ", rotasValidas)
-		var mapaCompleto = make(map[string][]consts.Posto) // Inicializa o mapa
-		paradas := make(map[string][]consts.Parada)
-		for nome, rota := range rotasValidas {
-			for _, cidade := range rota {
-				if cidade == S.Cidade {
-					mapaCompleto[cidade] = storage.CarregarPostos() // esse metodo é local
-				} else {
-					config, exists := cidadeConfig[cidade]
-					if !exists {
-						log.Printf("Configuração não encontrada para a cidade: %s", cidade)
-						continue
-					}
-					url := "http://servidor-" + config.Container + ":" + config.Porta
-					log.Printf("URL: %s", url)
-					postos, err := api.ObterPostosDeOutroServidor(url) // obter a partir do http
-					if err != nil {
-						log.Printf("Erro ao obter postos de outro servidor: %v", err)
-						continue
-					}
-					// Adiciona os postos ao mapa no formato esperado
-					var postosSemPonteiro []consts.Posto
-					for _, posto := range postos {
-						postosSemPonteiro = append(postosSemPonteiro, *posto)
-					}
-					mapaCompleto[cidade] = postosSemPonteiro
-				}
-			}
-
-			log.Println("Checando Paradas para a Rota: ", rota)
-			paradasArray := rotaslib.GerarRotas(conteudoMsg.CarroMQTT, rota, dadosRotas.Cidades, mapaCompleto)
-			if len(paradasArray) != 0 {
-				paradas[nome] = paradasArray
-			} else {
-				log.Printf("⚠️  Rota %s descartada (nenhuma parada válida encontrada).", nome)
-			}
-			log.Println("Paradas: ", paradas)
-
-		}
+		paradas, resumos := S.planejarRotas(conteudoMsg)
+		log.Println("Paradas: ", paradas)
 
 		mapInterface := make(map[string]interface{})
 		for nome, slice := range paradas {
 			mapInterface[nome] = slice
 		}
+		// Totais de cada rota, para o carro comparar as ofertas
+		mapInterface[consts.ChaveResumosRotas] = resumos
 
 		msg, err := json.Marshal((consts.Mensagem{ID: S.IP, Origem: S.Cidade, Conteudo: mapInterface}))
 		if err != nil {
@@ -327,6 +561,19 @@ func (S *Servidor) regitrarHandlersMQTT() {
 		S.Client.Publish(topic, msg)
 		log.Println("[DEBUG] JSON final enviado:", string(msg))
 	})
+	routerServidor.Register(topics.CarroSendsRechargeStart("+", S.IP, S.Cidade), func(payload []byte) {
+		var msg struct {
+			IDCarro string  `json:"IDCarro"`
+			IDPosto string  `json:"IDPosto"`
+			Bateria float64 `json:"Bateria"`
+		}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			log.Printf("[ERRO] Erro ao decodificar mensagem: %v\n", err)
+			return
+		}
+		log.Printf("[SESSAO] Carro %s informou chegada ao posto %s", msg.IDCarro, msg.IDPosto)
+		S.iniciarRecarga(msg.IDCarro, msg.IDPosto, msg.Bateria)
+	})
 	routerServidor.Register(topics.CarroSendsRechargeFinish("+"), func(payload []byte) {
 		log.Println("[DEBUG] Carro informou fim de recarga")
 		var msg map[string]string
@@ -335,14 +582,582 @@ func (S *Servidor) regitrarHandlersMQTT() {
 			// Retorna uma MsgServer vazia ou com erro sinalizado
 			return 
 		}
-		idCarro := msg["IDCarro"]
-		log.Printf("MensageM: %f", msg["Msg"])
-		S.processCarroDisconnected(idCarro)
+		log.Printf("MensageM: %s", msg["Msg"])
+		S.finalizarRecarga(msg["IDCarro"], msg["IDPosto"])
+	})
+	routerServidor.Register(topics.StationEventStarted("+"), func(payload []byte) {
+		var evento consts.EventoPosto
+		if err := json.Unmarshal(payload, &evento); err != nil {
+			log.Printf("[ERRO] Evento de posto inválido: %v\n", err)
+			return
+		}
+		if _, ok := S.Sessoes.Buscar(evento.SessaoID); !ok {
+			return // Sessão de outro servidor
+		}
+		sessao, err := S.Sessoes.RegistrarInicio(evento.SessaoID)
+		if err != nil {
+			log.Printf("[SESSAO] %v", err)
+			return
+		}
+		S.notificarSessao(sessao)
+	})
+	routerServidor.Register(topics.StationStatus("+"), func(payload []byte) {
+		var status consts.StatusPosto
+		if err := json.Unmarshal(payload, &status); err != nil || status.ID == "" {
+			log.Printf("[ERRO] Status de posto inválido: %s\n", string(payload))
+			return
+		}
+		S.Monitor.RegistrarStatus(status)
+	})
+	routerServidor.Register(topics.StationEventFinished("+"), func(payload []byte) {
+		var evento consts.EventoPosto
+		if err := json.Unmarshal(payload, &evento); err != nil {
+			log.Printf("[ERRO] Evento de posto inválido: %v\n", err)
+			return
+		}
+		if _, ok := S.Sessoes.Buscar(evento.SessaoID); !ok {
+			return // Sessão de outro servidor
+		}
+		S.encerrarSessao(evento.SessaoID, evento.EnergiaKWh)
+	})
+	routerServidor.Register(topics.ServerReservaExpirada("+"), func(payload []byte) {
+		var aviso consts.ReservaExpirada
+		if err := json.Unmarshal(payload, &aviso); err != nil {
+			log.Printf("[ERRO] Aviso de reserva expirada inválido: %v\n", err)
+			return
+		}
+		S.processReservaExpirada(aviso)
+	})
+	routerServidor.Register(topics.ServerParadaConcluida("+"), func(payload []byte) {
+		var aviso consts.ParadaConcluida
+		if err := json.Unmarshal(payload, &aviso); err != nil {
+			log.Printf("[ERRO] Aviso de parada concluída inválido: %v\n", err)
+			return
+		}
+		S.processParadaConcluida(aviso)
 	})
 	routerServidor.Register(topics.CarroDesconectado("+"), func(payload []byte){
 		S.handleCarroDisconnectedMQTT(payload)
 	})
+	routerServidor.Register(topics.CarroReconectado("+"), func(payload []byte) {
+		var msg map[string]string
+		if err := json.Unmarshal(payload, &msg); err != nil || msg["ID"] == "" {
+			log.Printf("[ERRO] Anúncio de reconexão inválido: %s\n", string(payload))
+			return
+		}
+		S.processCarroReconectado(msg["ID"])
+	})
+	routerServidor.RegisterComTopico(topics.ServerAnuncio("+"), func(topico string, payload []byte) {
+		S.handleAnuncioServidor(topico, payload)
+	})
+
+}
+
+// Limite de combinações de rotas planejadas para uma viagem com escalas
+const maxCombinacoesViagem = 16
+
+// Planeja as paradas de cada rota válida para o trajeto, em paralelo, com os totais
+// de cada uma. Com escalas, cada opção combina uma rota por perna e é reservada como
+// uma viagem só. Rotas sem parada viável ficam de fora.
+func (s *Servidor) planejarRotas(trajeto consts.Trajeto) (map[string][]consts.Parada, map[string]consts.ResumoRota) {
+	dadosRotas := storage.LerRotas()
+	var rotasPorPerna []map[string][]string
+	for _, perna := range trajeto.Pernas() {
+		rotasPorPerna = append(rotasPorPerna, rotaslib.GetRotasValidas(dadosRotas.Rotas, perna))
+	}
+	viagens := rotaslib.CombinarPernas(rotasPorPerna, maxCombinacoesViagem)
+	permanencias := make([]float64, 0, len(trajeto.Escalas))
+	for _, escala := range trajeto.Escalas {
+		permanencias = append(permanencias, escala.PermanenciaMin)
+	}
+
+	// Todas as cidades da viagem, para consultar os postos de cada uma uma única vez
+	rotasValidas := make(map[string][]string)
+	for nome, pernas := range viagens {
+		for _, rota := range pernas {
+			rotasValidas[nome] = append(rotasValidas[nome], rota...)
+		}
+	}
+	log.Println("Rotas válidas: ", rotasValidas)
+
+	// Cada cidade é consultada uma única vez por requisição, em paralelo
+	mapaCompleto := s.obterPostosDasCidades(rotasValidas)
+
+	paradas := make(map[string][]consts.Parada)
+	resumos := make(map[string]consts.ResumoRota)
+	var paradasMutex sync.Mutex
+	var wg sync.WaitGroup
+	for nome, rota := range rotasValidas {
+		wg.Add(1)
+		go func(nome string, rota []string) {
+			defer wg.Done()
+			postosDaRota := make(map[string][]consts.Posto)
+			for _, cidade := range rota {
+				if postos, ok := mapaCompleto[cidade]; ok {
+					postosDaRota[cidade] = postos
+				}
+			}
 
+			log.Println("Checando Paradas para a Rota: ", rota)
+			paradasArray, resumo := rotaslib.PlanejarViagem(trajeto.CarroMQTT, viagens[nome], permanencias, consts.CentrosCidades(), postosDaRota)
+			if len(paradasArray) == 0 {
+				log.Printf("⚠️  Rota %s descartada (nenhuma parada válida encontrada).", nome)
+				return
+			}
+			paradasMutex.Lock()
+			paradas[nome] = paradasArray
+			resumos[nome] = resumo
+			paradasMutex.Unlock()
+		}(nome, rota)
+	}
+	wg.Wait()
+	return paradas, resumos
+}
+
+// Busca os postos de todas as cidades presentes nas rotas: os locais do arquivo e os remotos
+// via HTTP (com cache), disparando as consultas remotas em paralelo.
+func (s *Servidor) obterPostosDasCidades(rotas map[string][]string) map[string][]consts.Posto {
+	cidades := make(map[string]bool)
+	for _, rota := range rotas {
+		for _, cidade := range rota {
+			cidades[cidade] = true
+		}
+	}
+
+	mapaCompleto := make(map[string][]consts.Posto)
+	var mapaMutex sync.Mutex
+	var wg sync.WaitGroup
+	for cidade := range cidades {
+		if cidade == s.Cidade {
+			var postosLocais []consts.Posto
+			for _, posto := range storage.CarregarPostos() { // esse metodo é local
+				if s.Monitor.Online(posto.Id) && posto.AceitaReservas(s.ProfundidadeFila) {
+					posto.ProfundidadeFila = s.ProfundidadeFila
+					cotacao := s.Precos.Cotar(posto)
+					posto.Cotacao = &cotacao
+					postosLocais = append(postosLocais, posto)
+				}
+			}
+			mapaMutex.Lock()
+			mapaCompleto[cidade] = postosLocais
+			mapaMutex.Unlock()
+			continue
+		}
+		url, exists := s.urlServidor(cidade)
+		if !exists {
+			log.Printf("Configuração não encontrada para a cidade: %s", cidade)
+			continue
+		}
+		wg.Add(1)
+		go func(cidade, url string) {
+			defer wg.Done()
+			log.Printf("URL: %s", url)
+			postos, err := api.ObterPostosComCache(url) // obter a partir do http
+			if err != nil {
+				log.Printf("Erro ao obter postos de outro servidor: %v", err)
+				return
+			}
+			// Adiciona os postos ao mapa no formato esperado
+			var postosSemPonteiro []consts.Posto
+			for _, posto := range postos {
+				postosSemPonteiro = append(postosSemPonteiro, *posto)
+			}
+			mapaMutex.Lock()
+			mapaCompleto[cidade] = postosSemPonteiro
+			mapaMutex.Unlock()
+		}(cidade, url)
+	}
+	wg.Wait()
+	return mapaCompleto
+}
+
+// Publica uma notificação para o carro em ServerNotifyCar
+func (s *Servidor) notificarCarro(carroID string, conteudo map[string]interface{}) {
+	msg := consts.Mensagem{Conteudo: conteudo, Origem: s.Cidade, ID: s.IP}
+	s.Client.Publish(topics.ServerNotifyCar(s.IP, carroID), serializarMensagem(msg))
+}
+
+func (s *Servidor) notificarSessao(sessao consts.SessaoRecarga) {
+	s.notificarCarro(sessao.CarroID, map[string]interface{}{
+		"tipo":   "sessao",
+		"sessao": sessao,
+	})
+}
+
+// Emite a fatura da sessão encerrada (se houver cobrança) e envia o resumo junto com a sessão
+func (s *Servidor) notificarEncerramento(sessao consts.SessaoRecarga) {
+	conteudo := map[string]interface{}{
+		"tipo":   "sessao",
+		"sessao": sessao,
+	}
+	if fatura, ok := s.Faturas.Emitir(sessao); ok {
+		conteudo["fatura"] = fatura
+		s.cobrarFatura(fatura)
+	}
+	s.notificarCarro(sessao.CarroID, conteudo)
+}
+
+func (s *Servidor) enviarComandoPosto(topic string, sessao consts.SessaoRecarga) {
+	comando := consts.ComandoPosto{
+		SessaoID:      sessao.ID,
+		CarroID:       sessao.CarroID,
+		ConectorID:    sessao.ConectorID,
+		PotenciaKW:    sessao.PotenciaKW,
+		EnergiaMaxKWh: sessao.CapacidadeBateria - sessao.BateriaInicial,
+	}
+	comandoJSON, err := json.Marshal(comando)
+	if err != nil {
+		log.Printf("[SESSAO] Erro ao serializar comando: %v", err)
+		return
+	}
+	s.Client.Publish(topic, comandoJSON)
+}
+
+// O carro chegou ao posto: a sessão avança e o posto recebe o comando de início
+func (s *Servidor) iniciarRecarga(carroID, postoID string, bateria float64) {
+	sessao, err := s.Sessoes.RegistrarChegada(carroID, postoID, bateria)
+	if err != nil {
+		log.Printf("[SESSAO] %v", err)
+		s.notificarCarro(carroID, map[string]interface{}{
+			"tipo":     "erro",
+			"mensagem": err.Error(),
+		})
+		return
+	}
+	// Com outros carros à frente no conector, o carro aguarda a vez; a recarga começa
+	// quando o conector for liberado (conectorLiberado)
+	if posicao, espera := s.posicaoNaFila(sessao); posicao > 0 {
+		log.Printf("[SESSAO] Carro %s chegou ao posto %s e aguarda na posição %d da fila", carroID, postoID, posicao)
+		s.notificarSessao(sessao)
+		s.notificarCarro(carroID, map[string]interface{}{
+			"tipo":       "fila",
+			"posicao":    posicao,
+			"espera_min": espera,
+			"mensagem":   fmt.Sprintf("%d carro(s) à frente no conector %s, espera prevista de %.0f min", posicao, sessao.ConectorID, espera),
+		})
+		return
+	}
+	s.enviarComandoPosto(topics.ServerCommandStart(postoID), sessao)
+	s.notificarSessao(sessao)
+}
+
+// Carros à frente do carro da sessão na fila do conector e a espera prevista por eles
+func (s *Servidor) posicaoNaFila(sessao consts.SessaoRecarga) (int, float64) {
+	conector, ok := s.conectorLocal(sessao.PostoID, sessao.ConectorID)
+	if !ok {
+		return 0, 0
+	}
+	for i, carro := range conector.Fila {
+		if carro.ID == sessao.CarroID {
+			return i, conector.EsperaEstimadaMin(i)
+		}
+	}
+	return 0, 0
+}
+
+func (s *Servidor) conectorLocal(postoID, conectorID string) (consts.Conector, bool) {
+	postos, err := storage.GetPostosFromJSON(arquivoPontos)
+	if err != nil {
+		log.Printf("[SESSAO] Erro ao ler postos: %v", err)
+		return consts.Conector{}, false
+	}
+	for _, p := range postos {
+		if p.Id == postoID {
+			if conector := p.BuscarConector(conectorID); conector != nil {
+				return *conector, true
+			}
+		}
+	}
+	return consts.Conector{}, false
+}
+
+// Um conector local foi liberado: inicia a recarga do próximo carro da fila se ele já
+// chegou ao posto e promove carros da lista de espera para as vagas abertas
+func (s *Servidor) conectorLiberado(postoID, conectorID string) {
+	api.InvalidarCachePostos(s.URL)
+	if conector, ok := s.conectorLocal(postoID, conectorID); ok && len(conector.Fila) > 0 {
+		proximo := conector.Fila[0]
+		if sessao, ok := s.Sessoes.BuscarAtiva(proximo.ID, postoID); ok && sessao.Estado == consts.SessaoCarroChegou {
+			log.Printf("[SESSAO] Conector %s liberado. Iniciando a recarga do carro %s", conectorID, proximo.ID)
+			s.enviarComandoPosto(topics.ServerCommandStart(postoID), sessao)
+			s.notificarSessao(sessao)
+		}
+	}
+	api.PromoverDaEspera(arquivoPontos, s.dependencias(), postoID)
+}
+
+// Reserva recusada: coloca o carro na lista de espera do posto que recusou o prepare.
+// Recusas da carteira ou de um servidor fora do ar não têm lista de espera.
+func (s *Servidor) entrarNaListaEspera(reserva consts.Reserva, erro2PC error) (string, int, bool) {
+	var recusa *api.RecusaParticipante
+	if !errors.As(erro2PC, &recusa) || recusa.Inacessivel || recusa.Participante.Recurso != consts.RecursoPosto {
+		return "", 0, false
+	}
+	p := recusa.Participante
+	posicao, err := api.EntrarNaListaEspera(p.URL, p.PostoID, reserva.Carro)
+	if err != nil {
+		log.Printf("[ESPERA] Erro ao colocar o carro %s na lista de espera do posto %s: %v", reserva.Carro.ID, p.PostoID, err)
+		return "", 0, false
+	}
+	log.Printf("[ESPERA] Carro %s na posição %d da lista de espera do posto %s", reserva.Carro.ID, posicao, p.PostoID)
+	return p.PostoID, posicao, true
+}
+
+// O carro pediu para finalizar a recarga. Só o servidor dono do posto tem a sessão ativa.
+func (s *Servidor) finalizarRecarga(carroID, postoID string) {
+	sessao, ok := s.Sessoes.BuscarAtiva(carroID, postoID)
+	if !ok {
+		log.Printf("[SESSAO] Carro %s não tem sessão ativa em postos deste servidor.", carroID)
+		return
+	}
+
+	switch sessao.Estado {
+	case consts.SessaoCarregando:
+		// O evento finished do posto encerra a sessão com a energia medida
+		s.enviarComandoPosto(topics.ServerCommandStop(sessao.PostoID), sessao)
+		time.AfterFunc(tempoEsperaPosto, func() {
+			if atual, ok := s.Sessoes.Buscar(sessao.ID); ok && atual.Estado == consts.SessaoCarregando {
+				log.Printf("[SESSAO] Posto %s não confirmou o fim da sessão %s. Estimando energia.", sessao.PostoID, sessao.ID)
+				s.encerrarSessao(sessao.ID, -1)
+			}
+		})
+	case consts.SessaoCarroChegou:
+		// O posto nunca confirmou o início: encerra estimando a energia pelo tempo conectado
+		s.encerrarSessao(sessao.ID, -1)
+	case consts.SessaoReservada:
+		// O carro não chegou ao posto, então não há recarga a encerrar: só libera o conector
+		abortada, err := s.Sessoes.Abortar(sessao.ID, "recarga finalizada sem chegada ao posto")
+		if err != nil {
+			log.Printf("[SESSAO] %v", err)
+			return
+		}
+		if err := api.LiberarConector(arquivoPontos, abortada.PostoID, abortada.ConectorID, carroID); err != nil {
+			log.Printf("[SESSAO] Erro ao liberar conector: %v", err)
+		}
+		s.notificarSessao(abortada)
+		s.conectorLiberado(abortada.PostoID, abortada.ConectorID)
+	}
+}
+
+// Finaliza a sessão, libera o conector e envia o resumo ao carro
+func (s *Servidor) encerrarSessao(sessaoID string, energiaKWh float64) {
+	sessao, err := s.Sessoes.Finalizar(sessaoID, energiaKWh)
+	if err != nil {
+		log.Printf("[SESSAO] %v", err)
+		return
+	}
+	if err := api.LiberarConector(arquivoPontos, sessao.PostoID, sessao.ConectorID, sessao.CarroID); err != nil {
+		log.Printf("[SESSAO] Erro ao liberar conector: %v", err)
+	}
+	s.notificarEncerramento(sessao)
+	s.conectorLiberado(sessao.PostoID, sessao.ConectorID)
+
+	// O coordenador da transação encerra a viagem quando esta for a última parada
+	aviso, _ := json.Marshal(consts.ParadaConcluida{
+		TransacaoID: sessao.TransacaoID,
+		SessaoID:    sessao.ID,
+		CarroID:     sessao.CarroID,
+		PostoID:     sessao.PostoID,
+		ConectorID:  sessao.ConectorID,
+	})
+	s.Client.Publish(topics.ServerParadaConcluida(sessao.TransacaoID), aviso)
+}
+
+// Avisa o posto que o conector foi reservado e o carro da posição na fila
+func (s *Servidor) sessaoReservada(sessao consts.SessaoRecarga) {
+	s.enviarComandoPosto(topics.ServerCommandReserve(sessao.PostoID), sessao)
+	s.notificarSessao(sessao)
+}
+
+// Abriu vaga para um carro da lista de espera: ele refaz a reserva da rota pelo 2PC
+func (s *Servidor) vagaNaEspera(vaga consts.VagaEspera) {
+	s.notificarCarro(vaga.CarroID, map[string]interface{}{
+		"tipo": "promovido",
+		"vaga": vaga,
+	})
+}
+
+// O posto para de carregar se a recarga já tinha começado; senão apenas cancela a reserva
+func (s *Servidor) sessaoAbortada(sessao consts.SessaoRecarga) {
+	if !sessao.InicioEm.IsZero() {
+		s.enviarComandoPosto(topics.ServerCommandStop(sessao.PostoID), sessao)
+	} else {
+		s.enviarComandoPosto(topics.ServerCommandCancel(sessao.PostoID), sessao)
+	}
+	s.notificarEncerramento(sessao)
+}
+
+// Participante do 2PC para o posto da parada, no servidor da cidade dela
+func (s *Servidor) participanteDaParada(parada consts.Parada) (consts.Participante2PC, bool) {
+	serverURL, ok := s.urlServidor(parada.Cidade)
+	if !ok {
+		return consts.Participante2PC{}, false
+	}
+	participante := consts.Participante2PC{
+		URL:             serverURL,
+		PostoID:         parada.IDPosto,
+		ConectorID:      parada.IDConector,
+		ChegadaPrevista: parada.ChegadaPrevista,
+	}
+	if parada.Cotacao != nil {
+		participante.CotacaoID = parada.Cotacao.ID
+	}
+	return participante, true
+}
+
+// Participante do 2PC que retém na carteira o valor estimado das paradas. O valor é
+// calculado no prepare, com os preços travados pelos postos (api.AlterarReserva).
+func (s *Servidor) participanteCarteira() (consts.Participante2PC, bool) {
+	cidade, ok := consts.CidadeCarteira()
+	if !ok {
+		return consts.Participante2PC{}, false // Sem carteiras configuradas: reservas não são cobradas antecipadamente
+	}
+	url, ok := s.urlServidor(cidade.ID)
+	if !ok {
+		return consts.Participante2PC{}, false
+	}
+	return consts.Participante2PC{
+		URL:     url,
+		Recurso: consts.RecursoCarteira,
+	}, true
+}
+
+// Energia prevista de cada parada, recalculada pelo coordenador em vez de confiar na
+// enviada pelo carro: entre o mínimo para completar a bateria depois do trecho em linha
+// reta desde a parada anterior (nas coordenadas dos dados do posto) e a capacidade da bateria
+func (s *Servidor) energiaDasParadas(carro consts.Carro, paradas []consts.Parada) []float64 {
+	cidades := []string{}
+	for _, parada := range paradas {
+		cidades = append(cidades, parada.Cidade)
+	}
+	posicoes := make(map[string]consts.Coordenadas)
+	for _, postos := range s.obterPostosDasCidades(map[string][]string{"reserva": cidades}) {
+		for _, posto := range postos {
+			posicoes[posto.Id] = consts.Coordenadas{Lat: posto.Lat, Lon: posto.Lon}
+		}
+	}
+
+	energias := make([]float64, len(paradas))
+	posicao := consts.Coordenadas{Lat: carro.Lat, Lon: carro.Lon}
+	bateria := carro.Bateria
+	for i, parada := range paradas {
+		destino, ok := posicoes[parada.IDPosto]
+		if !ok {
+			destino = consts.Coordenadas{Lat: parada.Lat, Lon: parada.Lon}
+		}
+		bateria -= consts.CalcularDistancia(destino, posicao) * carro.Consumobateria
+		minimo := math.Max(carro.CapacidadeBateria-bateria, 0)
+		energias[i] = math.Min(math.Max(parada.EnergiaKWh, minimo), carro.CapacidadeBateria)
+		bateria = carro.CapacidadeBateria
+		posicao = destino
+	}
+	return energias
+}
+
+// Ajusta a retenção da carteira depois de uma alteração comitada: soma o valor estimado
+// das paradas novas e desconta o das liberadas, sem mexer no que as faturas já capturaram
+func (s *Servidor) ajustarRetencao(reserva consts.Reserva, participantes, liberados, novos []consts.Participante2PC) {
+	diferenca := carteira.ValorRetencao(novos) - carteira.ValorRetencao(liberados)
+	if diferenca == 0 {
+		return
+	}
+	for _, p := range participantes {
+		if p.Recurso != consts.RecursoCarteira {
+			continue
+		}
+		if err := api.AjustarNaCarteira(p.URL, reserva.ID, reserva.Carro.ID, diferenca); err != nil {
+			log.Printf("[CARTEIRA] Erro ao ajustar a retenção da reserva %s em R$ %.2f: %v", reserva.ID, diferenca, err)
+		}
+	}
+}
+
+// Captura o valor da fatura na carteira do carro, consumindo a retenção da transação
+func (s *Servidor) cobrarFatura(fatura consts.Fatura) {
+	if fatura.Total <= 0 {
+		return
+	}
+	if s.Carteiras != nil {
+		s.Carteiras.Capturar(fatura.TransacaoID, fatura.CarroID, fatura.Total)
+		return
+	}
+	cidade, ok := consts.CidadeCarteira()
+	if !ok {
+		return
+	}
+	url, ok := s.urlServidor(cidade.ID)
+	if !ok {
+		return
+	}
+	if err := api.CapturarNaCarteira(url, fatura.TransacaoID, fatura.CarroID, fatura.Total); err != nil {
+		log.Printf("[CARTEIRA] Erro ao cobrar a fatura %s: %v", fatura.ID, err)
+	}
+}
+
+// Guarda os servidores participantes da transação para consolidar a fatura da viagem
+func (s *Servidor) registrarViagem(transacaoID string, participantes []consts.Participante2PC) {
+	urls := []string{}
+	vistos := make(map[string]bool)
+	for _, p := range participantes {
+		if !vistos[p.URL] {
+			vistos[p.URL] = true
+			urls = append(urls, p.URL)
+		}
+	}
+	s.viagensMutex.Lock()
+	s.viagens[transacaoID] = urls
+	s.viagensMutex.Unlock()
+}
+
+// Consulta as faturas da transação em cada servidor participante. Transações que este
+// servidor não coordenou são buscadas em todos os servidores conhecidos.
+func (s *Servidor) consolidarViagem(transacaoID string) consts.FaturaViagem {
+	s.viagensMutex.Lock()
+	urls, ok := s.viagens[transacaoID]
+	s.viagensMutex.Unlock()
+	if !ok {
+		for _, cidade := range consts.IDsCidades() {
+			if cidade == s.Cidade {
+				continue
+			}
+			if url, ok := s.urlServidor(cidade); ok {
+				urls = append(urls, url)
+			}
+		}
+		urls = append(urls, s.URL)
+	}
+
+	var (
+		faturas   []consts.Fatura
+		pendentes []string
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+	)
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			var lista []consts.Fatura
+			var err error
+			if url == s.URL {
+				lista = s.Faturas.DaTransacao(transacaoID)
+			} else {
+				lista, err = api.ObterFaturasDaTransacao(url, transacaoID)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Printf("[FATURAMENTO] Erro ao buscar faturas em %s: %v", url, err)
+				pendentes = append(pendentes, url)
+				return
+			}
+			faturas = append(faturas, lista...)
+		}(url)
+	}
+	wg.Wait()
+
+	viagem := faturamento.Consolidar(transacaoID, faturas)
+	viagem.Pendentes = pendentes
+	return viagem
 }
 
 func (s *Servidor) handleCarroDisconnectedMQTT(payload []byte) {
@@ -355,95 +1170,635 @@ func (s *Servidor) handleCarroDisconnectedMQTT(payload []byte) {
 	carroID := disconnectedCarPayload["ID"]
 	log.Printf("Carro ID: %s", carroID)
 	if carroID != "" {
+		s.agendarLimpezaCarro(carroID)
+	}
+}
+
+// Um LWT que chega logo depois do anúncio de reconexão é o da conexão anterior: o broker
+// o publica ao passar a sessão para a nova conexão com o mesmo client ID
+const janelaLWTAtrasado = 5 * time.Second
+
+// Adia a limpeza das reservas do carro pela tolerância de desconexão; a reconexão
+// anunciada dentro do prazo a cancela. Tolerância zero limpa na hora.
+func (s *Servidor) agendarLimpezaCarro(carroID string) {
+	if s.ToleranciaDesconexao <= 0 {
 		log.Printf("[SERVIDOR] Carro %s desconectado inesperadamente. Iniciando processo de limpeza de reservas...\n", carroID)
-		s.processCarroDisconnected(carroID) // Chama a lógica de limpeza
+		s.processCarroDisconnected(carroID)
+		return
 	}
+	s.desconexoesMutex.Lock()
+	defer s.desconexoesMutex.Unlock()
+	if time.Since(s.reconexoes[carroID]) < janelaLWTAtrasado {
+		log.Printf("[SERVIDOR] LWT do carro %s ignorado: o carro acabou de anunciar a reconexão.\n", carroID)
+		return
+	}
+	delete(s.reconexoes, carroID)
+	if _, pendente := s.desconexoes[carroID]; pendente {
+		return
+	}
+	log.Printf("[SERVIDOR] Carro %s desconectado. Reservas mantidas por %s aguardando a reconexão.\n", carroID, s.ToleranciaDesconexao)
+	var timer *time.Timer
+	timer = time.AfterFunc(s.ToleranciaDesconexao, func() {
+		s.desconexoesMutex.Lock()
+		if s.desconexoes[carroID] != timer {
+			s.desconexoesMutex.Unlock()
+			return // Cancelada pela reconexão enquanto o timer disparava
+		}
+		delete(s.desconexoes, carroID)
+		s.desconexoesMutex.Unlock()
+		log.Printf("[SERVIDOR] Carro %s não reconectou em %s. Iniciando processo de limpeza de reservas...\n", carroID, s.ToleranciaDesconexao)
+		s.processCarroDisconnected(carroID)
+	})
+	s.desconexoes[carroID] = timer
 }
 
-func (s *Servidor) processCarroDisconnected(carroID string) {
+// O carro voltou: cancela a limpeza agendada pelo LWT. O carro confere a reserva em
+// seguida com a consulta de status.
+func (s *Servidor) processCarroReconectado(carroID string) {
+	s.desconexoesMutex.Lock()
+	s.reconexoes[carroID] = time.Now()
+	timer, pendente := s.desconexoes[carroID]
+	if pendente {
+		timer.Stop()
+		delete(s.desconexoes, carroID)
+	}
+	s.desconexoesMutex.Unlock()
+
 	s.carrosConectadosMutex.Lock()
-	carStatus, exists := s.carrosConectados[carroID]
-	if !exists {
+	if carStatus, ok := s.carrosConectados[carroID]; ok {
+		carStatus.LastActivity = time.Now()
+	}
+	s.carrosConectadosMutex.Unlock()
+	if pendente {
+		log.Printf("[SERVIDOR] Carro %s reconectou dentro da tolerância. Reservas mantidas.\n", carroID)
+	}
+}
+
+// Envia a liberação para todos os participantes da reserva comitada por este coordenador
+func (s *Servidor) liberarParticipantes(carStatus *ConnectedCarStatus, motivo string) {
+	reserva := carStatus.CommittedReserva
+	for _, p := range carStatus.Participantes2PC {
+		if err := api.LiberarParticipante(reserva.ID, p, reserva.Carro, motivo); err != nil {
+			log.Printf("[SERVIDOR] ERRO: Falha ao enviar requisição de LIBERAÇÃO para %s (posto %s): %v\n", p.URL, p.PostoID, err)
+			continue
+		}
+		if p.Recurso == consts.RecursoPosto {
+			api.InvalidarCachePostos(p.URL)
+		}
+		log.Printf("[SERVIDOR] Enviado LIBERAÇÃO para %s (posto %s) para carro %s.\n", p.URL, p.PostoID, reserva.Carro.ID)
+	}
+}
+
+// Troca ou remove uma parada da reserva comitada por este coordenador. A troca é um novo
+// 2PC na mesma transação que confirma o novo posto antes de liberar o antigo; as demais
+// paradas não são tocadas. A retenção da carteira é ajustada pela diferença estimada.
+func (s *Servidor) processAlteracaoReserva(alteracao consts.AlteracaoReserva) {
+	carroID := alteracao.Carro.ID
+	responder := func(status, mensagem string, reserva *consts.Reserva) {
+		conteudo := map[string]interface{}{
+			"tipo":     "alteracao",
+			"status":   status,
+			"mensagem": mensagem,
+		}
+		if reserva != nil {
+			conteudo["reserva"] = reserva
+		}
+		s.notificarCarro(carroID, conteudo)
+	}
+
+	s.carrosConectadosMutex.Lock()
+	carStatus, ok := s.carrosConectados[carroID]
+	if !ok || carStatus.CommittedReserva == nil || carStatus.CommittedReserva.ID != alteracao.TransacaoID {
 		s.carrosConectadosMutex.Unlock()
-		log.Printf("[SERVIDOR] Carro %s desconectado, mas não tinha reserva ativa registrada por ESTE COORDENADOR.\n", carroID)
+		responder("ERRO", "reserva não encontrada neste coordenador", nil)
 		return
 	}
-	delete(s.carrosConectados, carroID) // Remove do mapa de carros ativos
-	s.carrosConectadosMutex.Unlock()        // Libera o lock cedo se a operação remota for demorada
+	reserva := *carStatus.CommittedReserva
+	participantes := append([]consts.Participante2PC{}, carStatus.Participantes2PC...)
+	s.carrosConectadosMutex.Unlock()
 
-	log.Printf("[SERVIDOR] Carro %s desconectado inesperadamente. Iniciando limpeza de reserva comitada.\n", carroID)
+	if !s.iniciarTransacao() {
+		responder("ERRO", "servidor encerrando; a reserva original foi mantida", nil)
+		return
+	}
+	defer s.transacoes.Done()
 
-	// Se a reserva foi comitada por ESTE coordenador
-	if carStatus.CommittedReserva != nil && len(carStatus.Participantes2PC) > 0 {
-		log.Println("Entrou")
-		for _, p := range carStatus.Participantes2PC {
-			releasePayload := map[string]interface{}{
-				"posto_id": p.PostoID,
-				"carro":    carStatus.CommittedReserva.Carro,
-			}
-			releaseJSON, _ := json.Marshal(releasePayload)
+	if alteracao.IndiceParada < 0 || alteracao.IndiceParada >= len(reserva.Paradas) {
+		responder("ERRO", "parada inexistente na reserva", nil)
+		return
+	}
+	antiga := reserva.Paradas[alteracao.IndiceParada]
+	indiceAntigo := -1
+	for i, p := range participantes {
+		if p.Recurso == consts.RecursoPosto && p.PostoID == antiga.IDPosto && p.ConectorID == antiga.IDConector {
+			indiceAntigo = i
+			break
+		}
+	}
+	if indiceAntigo < 0 {
+		responder("ERRO", "participante da parada não encontrado", nil)
+		return
+	}
+	participanteAntigo := participantes[indiceAntigo]
 
-			// CORREÇÃO: Enviar requisição HTTP para o endpoint /2pc/release
-			resp, err := http.Post(p.URL + "/2pc/release", "application/json", strings.NewReader(string(releaseJSON)))
-			if err != nil {
-				log.Printf("[SERVIDOR] ERRO: Falha ao enviar requisição de LIBERAÇÃO para %s (posto %s): %v\n", p.URL, p.PostoID, err)
-			} else {
-				resp.Body.Close()
-				log.Printf("[SERVIDOR] Enviado LIBERAÇÃO para %s (posto %s) para carro %s. Resposta: %s\n", p.URL, p.PostoID, carroID, resp.Status)
+	// Só paradas que ainda não começaram podem ser alteradas
+	if lista, err := api.ObterSessoesDoCarro(participanteAntigo.URL, carroID, reserva.ID); err == nil {
+		for _, sessao := range lista {
+			if sessao.PostoID == antiga.IDPosto && sessao.Estado != consts.SessaoReservada && sessao.Estado != consts.SessaoAbortada {
+				responder("ERRO", fmt.Sprintf("a parada em %s já está em andamento (%s)", antiga.NomePosto, sessao.Estado), nil)
+				return
 			}
 		}
+	}
+
+	paradas := append([]consts.Parada{}, reserva.Paradas...)
+	var novosParticipantes []consts.Participante2PC
+	if alteracao.NovaParada == nil {
+		if err := api.LiberarParticipante(reserva.ID, participanteAntigo, reserva.Carro, "parada removida pelo carro"); err != nil {
+			responder("ERRO", fmt.Sprintf("erro ao liberar %s: %v", antiga.NomePosto, err), nil)
+			return
+		}
+		paradas = append(paradas[:alteracao.IndiceParada], paradas[alteracao.IndiceParada+1:]...)
+		participantes = append(participantes[:indiceAntigo], participantes[indiceAntigo+1:]...)
+		s.ajustarRetencao(reserva, participantes, []consts.Participante2PC{participanteAntigo}, nil)
+		log.Printf("[ALTERACAO] Parada %s removida da reserva %s do carro %s", antiga.IDPosto, reserva.ID, carroID)
 	} else {
-		log.Printf("[SERVIDOR] Carro %s desconectado, mas não tinha reserva multi-servidor comitada ativa neste coordenador.\n", carroID)
+		novoParticipante, ok := s.participanteDaParada(*alteracao.NovaParada)
+		if !ok {
+			responder("ERRO", fmt.Sprintf("servidor da cidade %s não encontrado", alteracao.NovaParada.Cidade), nil)
+			return
+		}
+		paradas[alteracao.IndiceParada] = *alteracao.NovaParada
+		novoParticipante.EnergiaKWh = s.energiaDasParadas(reserva.Carro, paradas)[alteracao.IndiceParada]
+		novosParticipantes = []consts.Participante2PC{novoParticipante}
+		antigos := []consts.Participante2PC{participanteAntigo}
+		if err := api.AlterarReserva(reserva.ID, novosParticipantes, antigos, reserva.Carro, "parada substituída pelo carro"); err != nil {
+			api.InvalidarCachePostos(novoParticipante.URL)
+			responder("ERRO", fmt.Sprintf("o posto %s recusou a reserva; a parada original foi mantida", alteracao.NovaParada.NomePosto), nil)
+			return
+		}
+		participantes[indiceAntigo] = novosParticipantes[0]
+		s.ajustarRetencao(reserva, participantes, antigos, novosParticipantes)
+		log.Printf("[ALTERACAO] Parada %s trocada por %s na reserva %s do carro %s", antiga.IDPosto, novoParticipante.PostoID, reserva.ID, carroID)
+	}
+	api.InvalidarCachePostos(participanteAntigo.URL)
+	for _, p := range novosParticipantes {
+		api.InvalidarCachePostos(p.URL)
 	}
 
-	// Lógica para liberar postos LOCAIS que este servidor gerencia (se o carro estava em um deles)
-	// Isso é necessário porque o LWT chega a TODOS os servidores assinados no tópico LWT.
-	// Cada servidor deve verificar se o carro estava em UM POSTO QUE ELE GERENCIA.
-	postosLocais, err := storage.GetPostosFromJSON(os.Getenv("ARQUIVO_JSON")) // Use a variável global
+	reserva.Paradas = paradas
+	s.carrosConectadosMutex.Lock()
+	if atual, ok := s.carrosConectados[carroID]; ok {
+		atual.CommittedReserva = &reserva
+		atual.Participantes2PC = participantes
+		atual.LastActivity = time.Now()
+	}
+	s.carrosConectadosMutex.Unlock()
+	// Mantém o servidor antigo na viagem: a fatura consolidada ainda pode consultá-lo
+	s.registrarViagem(reserva.ID, append(participantes, participanteAntigo))
+	responder("OK", "reserva alterada", &reserva)
+}
+
+// Intervalo mínimo entre duas propostas de replanejamento para o mesmo carro
+const intervaloReplanejamento = 5 * time.Minute
+
+// Acompanha a viagem das reservas coordenadas por este servidor. Se o carro se afasta
+// do plano (atraso, consumo acima do previsto ou posto offline), propõe novas paradas
+// a partir da posição atual; o carro aceita ou recusa em CarroRequestReplanejamento.
+func (s *Servidor) processTelemetria(telemetria consts.Telemetria) {
+	s.carrosConectadosMutex.Lock()
+	carStatus, ok := s.carrosConectados[telemetria.CarroID]
+	if !ok || carStatus.CommittedReserva == nil {
+		s.carrosConectadosMutex.Unlock()
+		return // Reserva de outro coordenador
+	}
+	reserva := *carStatus.CommittedReserva
+	// O índice vem do carro: fora da reserva, vale a parada válida mais próxima
+	telemetria.ParadaAtual = max(0, min(telemetria.ParadaAtual, len(reserva.Paradas)))
+	anterior := carStatus.Telemetria
+	carStatus.Telemetria = &telemetria
+	carStatus.LastActivity = time.Now()
+	aguardando := carStatus.Proposta != nil || time.Since(carStatus.UltimaProposta) < intervaloReplanejamento
+	s.carrosConectadosMutex.Unlock()
+
+	if aguardando {
+		return
+	}
+	motivo := rastreamento.Avaliar(reserva.Carro, anterior, telemetria, reserva.Paradas, s.Monitor.Online, s.Limites, time.Now())
+	if motivo == "" {
+		return
+	}
+	log.Printf("[RASTREAMENTO] Carro %s fora do plano: %s. Replanejando.", telemetria.CarroID, motivo)
+
+	// Replaneja a partir da posição e bateria atuais até o destino (a cidade deste coordenador),
+	// passando pelas escalas ainda não alcançadas: as da perna da próxima parada em diante
+	carro := reserva.Carro
+	carro.Lat, carro.Lon, carro.Bateria = telemetria.Lat, telemetria.Lon, telemetria.Bateria
+	perna := 0
+	if proxima := min(telemetria.ParadaAtual, len(reserva.Paradas)-1); proxima >= 0 {
+		perna = max(0, min(reserva.Paradas[proxima].Perna, len(reserva.Escalas)))
+	}
+	rotas, _ := s.planejarRotas(consts.Trajeto{
+		CarroMQTT: carro,
+		Inicio:    consts.CidadeAtualDoCarro(carro.Lat, carro.Lon),
+		Destino:   s.Cidade,
+		Escalas:   reserva.Escalas[perna:],
+	})
+	proposta := melhorProposta(rotas)
+	for i := range proposta {
+		proposta[i].Perna += perna // Pernas contadas desde o início da viagem
+	}
+
+	s.carrosConectadosMutex.Lock()
+	if atual, ok := s.carrosConectados[telemetria.CarroID]; ok {
+		atual.UltimaProposta = time.Now()
+		atual.Proposta = proposta
+	}
+	s.carrosConectadosMutex.Unlock()
+
+	conteudo := map[string]interface{}{
+		"tipo":   "replanejamento",
+		"motivo": motivo,
+	}
+	if proposta != nil {
+		conteudo["paradas"] = proposta
+	}
+	s.notificarCarro(telemetria.CarroID, conteudo)
+}
+
+// Entre as rotas replanejadas, a que tem menos paradas (empate: menor custo estimado)
+func melhorProposta(rotas map[string][]consts.Parada) []consts.Parada {
+	var melhor []consts.Parada
+	for _, paradas := range rotas {
+		if melhor == nil || len(paradas) < len(melhor) ||
+			(len(paradas) == len(melhor) && carteira.EstimarValor(paradas) < carteira.EstimarValor(melhor)) {
+			melhor = paradas
+		}
+	}
+	return melhor
+}
+
+// O carro respondeu à proposta: aceitar troca as paradas pendentes pelas propostas em
+// um novo 2PC na mesma transação; se algum posto recusar, a reserva original é mantida
+func (s *Servidor) processRespostaReplanejamento(carroID string, aceitar bool) {
+	s.carrosConectadosMutex.Lock()
+	carStatus, ok := s.carrosConectados[carroID]
+	if !ok || carStatus.CommittedReserva == nil || carStatus.Proposta == nil {
+		s.carrosConectadosMutex.Unlock()
+		return
+	}
+	proposta := carStatus.Proposta
+	carStatus.Proposta = nil
+	reserva := *carStatus.CommittedReserva
+	participantes := append([]consts.Participante2PC{}, carStatus.Participantes2PC...)
+	paradaAtual := 0
+	carro := reserva.Carro
+	if carStatus.Telemetria != nil {
+		paradaAtual = max(0, min(carStatus.Telemetria.ParadaAtual, len(reserva.Paradas)))
+		carro.Lat, carro.Lon, carro.Bateria = carStatus.Telemetria.Lat, carStatus.Telemetria.Lon, carStatus.Telemetria.Bateria
+	}
+	s.carrosConectadosMutex.Unlock()
+
+	if !aceitar {
+		log.Printf("[RASTREAMENTO] Carro %s recusou o replanejamento.", carroID)
+		return
+	}
+	if !s.iniciarTransacao() {
+		s.notificarCarro(carroID, map[string]interface{}{
+			"tipo":     "alteracao",
+			"status":   "ERRO",
+			"mensagem": "servidor encerrando; a reserva original foi mantida",
+		})
+		return
+	}
+	defer s.transacoes.Done()
+
+	// Paradas pendentes são liberadas; as já concluídas e a carteira continuam na reserva
+	pendentes := make(map[string]bool)
+	for _, parada := range reserva.Paradas[paradaAtual:] {
+		pendentes[parada.IDPosto+"/"+parada.IDConector] = true
+	}
+	var mantidos, antigos, novos []consts.Participante2PC
+	for _, p := range participantes {
+		if p.Recurso == consts.RecursoPosto && pendentes[p.PostoID+"/"+p.ConectorID] {
+			antigos = append(antigos, p)
+		} else {
+			mantidos = append(mantidos, p)
+		}
+	}
+	energias := s.energiaDasParadas(carro, proposta)
+	for i, parada := range proposta {
+		participante, ok := s.participanteDaParada(parada)
+		if !ok {
+			log.Printf("[RASTREAMENTO] Servidor da cidade %s não encontrado. Replanejamento cancelado.", parada.Cidade)
+			return
+		}
+		participante.EnergiaKWh = energias[i]
+		novos = append(novos, participante)
+	}
+
+	err := api.AlterarReserva(reserva.ID, novos, antigos, reserva.Carro, "reserva replanejada")
+	for _, p := range append(antigos, novos...) {
+		api.InvalidarCachePostos(p.URL)
+	}
 	if err != nil {
-		log.Printf("[SERVIDOR] Erro ao ler postos locais para limpeza de %s: %v\n", carroID, err)
+		s.notificarCarro(carroID, map[string]interface{}{
+			"tipo":     "alteracao",
+			"status":   "ERRO",
+			"mensagem": "um dos postos recusou o replanejamento; a reserva original foi mantida",
+		})
 		return
 	}
 
-	postoLocalAtualizado := false
-	for _, p := range postosLocais {
-		// Verifica se o carro está na fila deste posto local
-		newFila := []consts.Carro{}
-		carRemovedFromLocalFila := false
-		for _, c := range p.Fila {
-			if c.ID != carroID {
-				newFila = append(newFila, c)
-			} else {
-				carRemovedFromLocalFila = true
-			}
+	reserva.Paradas = append(append([]consts.Parada{}, reserva.Paradas[:paradaAtual]...), proposta...)
+	s.carrosConectadosMutex.Lock()
+	if atual, ok := s.carrosConectados[carroID]; ok {
+		atual.CommittedReserva = &reserva
+		atual.Participantes2PC = append(mantidos, novos...)
+	}
+	s.carrosConectadosMutex.Unlock()
+	s.ajustarRetencao(reserva, participantes, antigos, novos)
+	s.registrarViagem(reserva.ID, append(participantes, novos...))
+	log.Printf("[RASTREAMENTO] Reserva %s do carro %s replanejada com %d parada(s).", reserva.ID, carroID, len(proposta))
+	s.notificarCarro(carroID, map[string]interface{}{
+		"tipo":     "alteracao",
+		"status":   "OK",
+		"mensagem": "reserva replanejada",
+		"reserva":  reserva,
+	})
+}
+
+// Responde ao carro com a reserva comitada por este coordenador e o estado de cada
+// parada, consultando as sessões no servidor dono de cada posto
+func (s *Servidor) responderStatusReserva(carroID string) {
+	s.carrosConectadosMutex.Lock()
+	carStatus, ok := s.carrosConectados[carroID]
+	var reserva *consts.Reserva
+	var participantes []consts.Participante2PC
+	if ok && carStatus.CommittedReserva != nil {
+		reserva = carStatus.CommittedReserva
+		participantes = carStatus.Participantes2PC
+	}
+	s.carrosConectadosMutex.Unlock()
+
+	if reserva == nil {
+		s.notificarCarro(carroID, map[string]interface{}{"tipo": "reservas"})
+		return
+	}
+
+	// Uma consulta por servidor participante
+	sessoesPorPosto := make(map[string]consts.SessaoRecarga)
+	falhas := make(map[string]string)
+	consultados := make(map[string]bool)
+	for _, p := range participantes {
+		if p.Recurso != consts.RecursoPosto || consultados[p.URL] {
+			continue
+		}
+		consultados[p.URL] = true
+		lista, err := api.ObterSessoesDoCarro(p.URL, carroID, reserva.ID)
+		if err != nil {
+			log.Printf("[SERVIDOR] Erro ao consultar sessões do carro %s em %s: %v", carroID, p.URL, err)
+			falhas[p.URL] = err.Error()
+			continue
 		}
-		if carRemovedFromLocalFila {
-			p.Fila = newFila
-			postoLocalAtualizado = true
-			log.Printf("[SERVIDOR] Carro %s removido da fila do posto LOCAL %s (%s) devido à desconexão.\n", carroID, p.Nome, p.Id)
+		for _, sessao := range lista {
+			sessoesPorPosto[sessao.PostoID] = sessao
 		}
 	}
 
-	if postoLocalAtualizado {
-		if err := storage.AtualizarArquivo(os.Getenv("ARQUIVO_JSON"), postosLocais); err != nil {
-			log.Printf("[SERVIDOR] Erro ao atualizar posto local após desconexão de %s: %v\n", carroID, err)
+	status := consts.StatusReserva{TransacaoID: reserva.ID}
+	for _, parada := range reserva.Paradas {
+		item := consts.StatusParada{Parada: parada}
+		if sessao, ok := sessoesPorPosto[parada.IDPosto]; ok {
+			item.Sessao = &sessao
 		} else {
-			log.Printf("[SERVIDOR] Arquivo de postos locais atualizado após limpeza para carro %s.", carroID)
+			for _, p := range participantes {
+				if p.PostoID == parada.IDPosto {
+					item.Erro = falhas[p.URL]
+				}
+			}
+		}
+		status.Paradas = append(status.Paradas, item)
+	}
+	s.notificarCarro(carroID, map[string]interface{}{
+		"tipo":     "reservas",
+		"reservas": status,
+	})
+}
+
+// O carro não compareceu a uma parada: se esta é a transação que coordenamos,
+// libera as demais paradas e a retenção da carteira
+func (s *Servidor) processReservaExpirada(aviso consts.ReservaExpirada) {
+	s.carrosConectadosMutex.Lock()
+	carStatus, ok := s.carrosConectados[aviso.CarroID]
+	if !ok || carStatus.CommittedReserva == nil || carStatus.CommittedReserva.ID != aviso.TransacaoID {
+		s.carrosConectadosMutex.Unlock()
+		return // Transação coordenada por outro servidor
+	}
+	delete(s.carrosConectados, aviso.CarroID)
+	s.carrosConectadosMutex.Unlock()
+
+	log.Printf("[SERVIDOR] Reserva %s expirada por no-show no posto %s. Liberando participantes.", aviso.TransacaoID, aviso.PostoID)
+	s.liberarParticipantes(carStatus, fmt.Sprintf("reserva expirada: carro não compareceu ao posto %s", aviso.PostoID))
+	s.notificarCarro(aviso.CarroID, map[string]interface{}{
+		"tipo":      "reserva_expirada",
+		"transacao": aviso.TransacaoID,
+		"posto":     aviso.PostoID,
+		"mensagem":  fmt.Sprintf("Reserva cancelada: o carro não chegou ao posto %s no prazo.", aviso.PostoID),
+	})
+}
+
+// A sessão de uma parada foi finalizada: se esta é a transação que coordenamos e a parada
+// é a última da reserva, a viagem terminou e o registro do carro é descartado
+func (s *Servidor) processParadaConcluida(aviso consts.ParadaConcluida) {
+	s.carrosConectadosMutex.Lock()
+	carStatus, ok := s.carrosConectados[aviso.CarroID]
+	if !ok || carStatus.CommittedReserva == nil || carStatus.CommittedReserva.ID != aviso.TransacaoID {
+		s.carrosConectadosMutex.Unlock()
+		return // Transação coordenada por outro servidor
+	}
+	paradas := carStatus.CommittedReserva.Paradas
+	if len(paradas) > 0 {
+		ultima := paradas[len(paradas)-1]
+		if ultima.IDPosto != aviso.PostoID || (ultima.IDConector != "" && ultima.IDConector != aviso.ConectorID) {
+			s.carrosConectadosMutex.Unlock()
+			return // Ainda há paradas pela frente
+		}
+	}
+	delete(s.carrosConectados, aviso.CarroID)
+	s.carrosConectadosMutex.Unlock()
+
+	log.Printf("[SERVIDOR] Viagem %s do carro %s concluída no posto %s.", aviso.TransacaoID, aviso.CarroID, aviso.PostoID)
+	// As faturas já foram capturadas: devolve o que sobrou da retenção da carteira
+	reserva := carStatus.CommittedReserva
+	for _, p := range carStatus.Participantes2PC {
+		if p.Recurso != consts.RecursoCarteira {
+			continue
 		}
+		if err := api.LiberarParticipante(reserva.ID, p, reserva.Carro, "viagem concluída"); err != nil {
+			log.Printf("[SERVIDOR] ERRO: Falha ao liberar a retenção da viagem %s: %v\n", reserva.ID, err)
+		}
+	}
+}
+
+// Registra uma transação 2PC coordenada por este servidor; false durante o encerramento.
+// Quem recebe true chama s.transacoes.Done() ao terminar.
+func (s *Servidor) iniciarTransacao() bool {
+	s.encerramentoMutex.Lock()
+	defer s.encerramentoMutex.Unlock()
+	if s.encerrando {
+		return false
 	}
+	s.transacoes.Add(1)
+	return true
+}
+
+func (s *Servidor) estaEncerrando() bool {
+	s.encerramentoMutex.Lock()
+	defer s.encerramentoMutex.Unlock()
+	return s.encerrando
 }
 
+// Prazo para as transações 2PC em andamento terminarem no encerramento
+const prazoEncerramento = 15 * time.Second
+
+// Prazo para os coordenadores de outros servidores decidirem os prepares feitos nos postos
+// locais, e o intervalo entre as verificações
+const (
+	prazoPendentes     = 5 * time.Second
+	intervaloPendentes = 200 * time.Millisecond
+)
+
+// Encerramento gracioso: recusa novas transações 2PC (como coordenador e no prepare),
+// espera as coordenadas em andamento e, com a API HTTP ainda no ar para commit e abort,
+// os prepares feitos por outros coordenadores nos postos locais. Os que não forem
+// decididos no prazo são abortados. Depois para a API HTTP ao fim das requisições em
+// curso e apaga o anúncio antes de se desconectar de forma limpa, sem depender do LWT.
+func (s *Servidor) Encerrar() {
+	s.encerramentoMutex.Lock()
+	s.encerrando = true
+	s.encerramentoMutex.Unlock()
+	log.Println("[SERVIDOR] Encerrando: novas transações recusadas, aguardando as em andamento...")
+
+	concluidas := make(chan struct{})
+	go func() {
+		s.transacoes.Wait()
+		close(concluidas)
+	}()
+	select {
+	case <-concluidas:
+	case <-time.After(prazoEncerramento):
+		log.Printf("[SERVIDOR] Transações ainda em andamento após %s; encerrando assim mesmo.", prazoEncerramento)
+	}
+
+	s.aguardarPendentes()
+	if abortados, err := api.AbortarPendentes(arquivoPontos); err != nil {
+		log.Printf("[SERVIDOR] Erro ao gravar os postos no encerramento: %v", err)
+	} else if abortados > 0 {
+		log.Printf("[SERVIDOR] %d prepare(s) sem decisão do coordenador abortado(s) nos postos locais.", abortados)
+	}
+
+	ctx, cancelar := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelar()
+	if err := api.EncerrarHTTP(ctx); err != nil {
+		log.Printf("[SERVIDOR] Erro ao encerrar a API HTTP: %v", err)
+	}
+
+	// Payload vazio e retido: os outros servidores removem este da lista de peers
+	s.Client.PublishRetained(topics.ServerAnuncio(s.Cidade), []byte{})
+	s.Client.Client.Disconnect(250)
+	log.Println("[SERVIDOR] Encerrado.")
+}
+
+// Espera até prazoPendentes que os prepares nos postos locais recebam commit ou abort.
+// Novos prepares já são recusados, então a contagem só diminui.
+func (s *Servidor) aguardarPendentes() {
+	limite := time.Now().Add(prazoPendentes)
+	for {
+		pendentes, err := api.ContarPendentes(arquivoPontos)
+		if err != nil {
+			log.Printf("[SERVIDOR] Erro ao ler os postos no encerramento: %v", err)
+			return
+		}
+		if pendentes == 0 {
+			return
+		}
+		if time.Now().After(limite) {
+			log.Printf("[SERVIDOR] %d prepare(s) ainda sem commit ou abort após %s.", pendentes, prazoPendentes)
+			return
+		}
+		time.Sleep(intervaloPendentes)
+	}
+}
+
+func (s *Servidor) processCarroDisconnected(carroID string) {
+	// Lógica para liberar postos LOCAIS que este servidor gerencia (se o carro estava em um deles)
+	// Isso é necessário porque o LWT chega a TODOS os servidores assinados no tópico LWT.
+	// Cada servidor deve verificar se o carro estava em UM POSTO QUE ELE GERENCIA.
+	s.liberarPostosLocais(carroID)
+
+	s.carrosConectadosMutex.Lock()
+	carStatus, exists := s.carrosConectados[carroID]
+	if !exists {
+		s.carrosConectadosMutex.Unlock()
+		log.Printf("[SERVIDOR] Carro %s desconectado, mas não tinha reserva ativa registrada por ESTE COORDENADOR.\n", carroID)
+		return
+	}
+	delete(s.carrosConectados, carroID) // Remove do mapa de carros ativos
+	s.carrosConectadosMutex.Unlock()        // Libera o lock cedo se a operação remota for demorada
 
+	log.Printf("[SERVIDOR] Carro %s desconectado inesperadamente. Iniciando limpeza de reserva comitada.\n", carroID)
 
+	// Se a reserva foi comitada por ESTE coordenador
+	if carStatus.CommittedReserva != nil && len(carStatus.Participantes2PC) > 0 {
+		s.liberarParticipantes(carStatus, "reserva cancelada ou carro desconectado")
+	} else {
+		log.Printf("[SERVIDOR] Carro %s desconectado, mas não tinha reserva multi-servidor comitada ativa neste coordenador.\n", carroID)
+	}
+}
+
+// Encerra as sessões locais do carro e o tira dos postos deste servidor; cada conector
+// liberado passa para o próximo carro da fila
+func (s *Servidor) liberarPostosLocais(carroID string) {
+	for _, sessao := range s.Sessoes.AbortarDoCarro(carroID, "", "", "reserva cancelada ou carro desconectado") {
+		s.sessaoAbortada(sessao)
+	}
+
+	liberados, err := api.RemoverCarroDosPostos(arquivoPontos, carroID)
+	if err != nil {
+		log.Printf("[SERVIDOR] Erro ao atualizar os postos locais após desconexão de %s: %v\n", carroID, err)
+		return
+	}
+	for postoID, conectores := range liberados {
+		log.Printf("[SERVIDOR] Carro %s removido do posto LOCAL %s devido à desconexão.\n", carroID, postoID)
+		if len(conectores) == 0 {
+			// Estava só na lista de espera
+			api.PromoverDaEspera(arquivoPontos, s.dependencias(), postoID)
+			continue
+		}
+		for _, conectorID := range conectores {
+			s.conectorLiberado(postoID, conectorID)
+		}
+	}
+}
 
 func main() {
 	log.Println("[SERVIDOR] Inicializando...")
+	storage.CarregarCidades()
 	server := inicializarServidor()
 	log.Println("[SERVIDOR] IP:", server.IP)
 	server.regitrarHandlersMQTT()
 	server.AssinarEventosDoCarro()
-	go api.ServerAPICommunication(arquivoPontos)
+	go api.ServerAPICommunication(arquivoPontos, server.dependencias())
+	go server.MonitorarPostos()
+	go server.ExpirarReservas()
+	server.Anunciar()
 	time.Sleep(10 * time.Second)
 	log.Println("[SERVIDOR] Iniciando comunicação MQTT...")
-	select {} // mantém o servidor ativo
+
+	// Mantém o servidor ativo até SIGINT/SIGTERM
+	sinais := make(chan os.Signal, 1)
+	signal.Notify(sinais, os.Interrupt, syscall.SIGTERM)
+	log.Printf("[SERVIDOR] Sinal %v recebido.", <-sinais)
+	server.Encerrar()
 }
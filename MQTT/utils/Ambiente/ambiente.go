@@ -0,0 +1,53 @@
+package ambiente
+
+// Leitura das variáveis de ambiente de configuração, compartilhada por servidores, postos
+// e carros. Valores ausentes ou inválidos usam o padrão; os inválidos são registrados no log.
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Lê um número decimal da variável de ambiente, com valor padrão
+func Float(nome string, padrao float64) float64 {
+	if valor := os.Getenv(nome); valor != "" {
+		if numero, err := strconv.ParseFloat(valor, 64); err == nil {
+			return numero
+		}
+		log.Printf("[AMBIENTE] %s inválido (%s), usando padrão %.2f", nome, valor, padrao)
+	}
+	return padrao
+}
+
+// Lê um número decimal maior que minimo da variável de ambiente, com valor padrão
+func FloatAcimaDe(nome string, minimo, padrao float64) float64 {
+	if numero := Float(nome, padrao); numero > minimo {
+		return numero
+	}
+	log.Printf("[AMBIENTE] %s deve ser maior que %g, usando padrão %.2f", nome, minimo, padrao)
+	return padrao
+}
+
+// Lê uma duração do Go (ex: "20s", "2h") da variável de ambiente, com valor padrão
+func Duracao(nome string, padrao time.Duration) time.Duration {
+	if valor := os.Getenv(nome); valor != "" {
+		if duracao, err := time.ParseDuration(valor); err == nil {
+			return duracao
+		}
+		log.Printf("[AMBIENTE] %s inválido (%s), usando padrão %s", nome, valor, padrao)
+	}
+	return padrao
+}
+
+// Lê um inteiro positivo da variável de ambiente, com valor padrão
+func Inteiro(nome string, padrao int) int {
+	if valor := os.Getenv(nome); valor != "" {
+		if numero, err := strconv.Atoi(valor); err == nil && numero > 0 {
+			return numero
+		}
+		log.Printf("[AMBIENTE] %s inválido (%s), usando padrão %d", nome, valor, padrao)
+	}
+	return padrao
+}
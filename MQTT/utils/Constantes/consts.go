@@ -1,25 +1,61 @@
 package Constantes
 
 import (
+	ambiente "MQTT/utils/Ambiente"
 	clientemqtt "MQTT/utils/mqttLib/ClienteMQTT"
 	mqttlib "MQTT/utils/mqttLib/Router"
+	cryptorand "crypto/rand"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// Tipos de conector conhecidos pelo sistema
+const (
+	ConectorTipo2   = "Tipo2"
+	ConectorCCS2    = "CCS2"
+	ConectorCHAdeMO = "CHAdeMO"
+)
+
+// Estados de um conector
+const (
+	ConectorLivre    = "livre"
+	ConectorPendente = "pendente" // Reservado na fase de prepare do 2PC
+	ConectorOcupado  = "ocupado"
+)
+
+type Conector struct {
+	ID         string  `json:"id"`
+	Tipo       string  `json:"tipo"`
+	PotenciaKW float64 `json:"potenciakw"`
+	Status     string  `json:"status"`
+	Fila       []Carro `json:"fila"`
+	Pendente   *Carro  `json:"pendente,omitempty"`
+}
+
 type Posto struct {
-	Id       string  `json:"id"`
-	Nome     string  `json:"nome"`
-	Cidade   string  `json:"cidade"`
-	X        float64 `json:"x"`
-	Y        float64 `json:"y"`
-	CustoKW  float64 `json:"custokw"` // Adicionado
-	Fila     []Carro `json:"fila"`
-	Pendente *Carro `json:"pendente,omitempty"`
+	Id         string     `json:"id"`
+	Nome       string     `json:"nome"`
+	Cidade     string     `json:"cidade"`
+	Lat        float64    `json:"lat"`
+	Lon        float64    `json:"lon"`
+	CustoKW    float64    `json:"custokw"` // Adicionado
+	Operador   string     `json:"operador,omitempty"`
+	Conectores []Conector `json:"conectores"`
+	Cotacao    *Cotacao   `json:"cotacao,omitempty"` // Preço dinâmico, preenchido pelo servidor ao listar os postos
+	// Carros por conector aceitos pelo servidor do posto, preenchido ao listar os postos
+	ProfundidadeFila int `json:"profundidadefila,omitempty"`
+	// Carros aguardando vaga (opt-in), promovidos para a fila quando um conector libera
+	ListaEspera []Carro `json:"listaespera,omitempty"`
 }
 
 type MQTTClient struct {
@@ -31,10 +67,12 @@ type Carro struct {
 	ID                string                 `json:"id"`
 	Bateria           float64                `json:"bateria"`
 	Clientemqtt       clientemqtt.MQTTClient `json:"-"`
-	X                 float64                `json:"x"`
-	Y                 float64                `json:"y"`
+	Lat               float64                `json:"lat"`
+	Lon               float64                `json:"lon"`
 	CapacidadeBateria float64                `json:"capacidadebateria"`
 	Consumobateria    float64                `json:"consumobateria"`
+	Conectores        []string               `json:"conectores"`     // Tipos de conector aceitos pelo carro
+	TaxaMaxCargaKW    float64                `json:"taxamaxcargakw"` // Potência máxima de recarga aceita
 }
 
 type Mensagem struct {
@@ -50,69 +88,748 @@ type MsgServer struct {
 }
 
 type Parada struct {
-	NomePosto string  `json:"nomeposto"`
-	IDPosto   string  `json:"idposto"`
-	X         float64 `json:"x"`
-	Y         float64 `json:"y"`
-	Cidade    string  `json:"cidade"`
+	NomePosto    string   `json:"nomeposto"`
+	IDPosto      string   `json:"idposto"`
+	IDConector   string   `json:"idconector"`
+	TipoConector string   `json:"tipoconector"`
+	PotenciaKW   float64  `json:"potenciakw"` // Potência efetiva (limitada pelo carro)
+	Lat          float64  `json:"lat"`
+	Lon          float64  `json:"lon"`
+	Cidade       string   `json:"cidade"`
+	CustoKW      float64  `json:"custokw"`    // Preço do posto no planejamento (o cotado, se houver cotação)
+	EnergiaKWh   float64  `json:"energiakwh"` // Energia prevista para completar a bateria na parada
+	Cotacao      *Cotacao `json:"cotacao,omitempty"`
+	// Horário previsto de chegada; a reserva expira se o carro não chegar até ele mais a tolerância
+	ChegadaPrevista time.Time `json:"chegadaprevista,omitzero"`
+	// Espera prevista pelos carros já na fila do conector
+	EsperaEstimadaMin float64 `json:"esperaestimadamin,omitempty"`
+	// Perna da viagem em que a parada fica (0 até a primeira escala)
+	Perna int `json:"perna,omitempty"`
+}
+
+// Chave da resposta de rotas que traz os totais de cada rota (ResumoRota por nome)
+const ChaveResumosRotas = "resumos"
+
+// Totais de uma rota calculados pelo servidor ao planejar as paradas
+type ResumoRota struct {
+	DistanciaKm     float64   `json:"distanciakm"`
+	Paradas         int       `json:"paradas"`
+	CustoEstimado   float64   `json:"custoestimado"`  // Energia prevista × preço de cada parada
+	DuracaoMin      float64   `json:"duracaomin"`     // Deslocamento, filas, recargas e permanência nas escalas
+	BateriaChegada  float64   `json:"bateriachegada"` // kWh ao chegar ao destino
+	ChegadaPrevista time.Time `json:"chegadaprevista,omitzero"`
 }
 
 type DadosRotas struct {
-	Cidades map[string]Coordenadas `json:"cidades"`
-	Rotas   map[string][]string    `json:"rotas"`
+	Rotas map[string][]string `json:"rotas"`
+}
+
+// Cidade atendida pelo sistema. Adicionar uma cidade é apenas uma mudança no arquivo de cidades.
+type Cidade struct {
+	ID       string        `json:"id"`
+	Nome     string        `json:"nome"`
+	Centro   Coordenadas   `json:"centro"`
+	RaioKm   float64       `json:"raiokm"`
+	Poligono []Coordenadas `json:"poligono,omitempty"` // Se presente, tem prioridade sobre o raio
+	Servidor string        `json:"servidor"`           // URL HTTP do servidor responsável pela cidade
+	Arquivo  string        `json:"arquivo,omitempty"`  // Arquivo de postos da cidade
+	Carteira bool          `json:"carteira,omitempty"` // O servidor desta cidade mantém as carteiras dos carros
 }
 type Trajeto struct {
-	CarroMQTT Carro  `json:"carro"`
-	Inicio    string `json:"inicio"`
-	Destino   string `json:"destino"`
+	CarroMQTT Carro    `json:"carro"`
+	Inicio    string   `json:"inicio"`
+	Destino   string   `json:"destino"`
+	Escalas   []Escala `json:"escalas,omitempty"` // Destinos intermediários, em ordem
+}
+
+// Destino intermediário da viagem, onde o carro permanece antes de seguir
+type Escala struct {
+	Cidade         string  `json:"cidade"`
+	PermanenciaMin float64 `json:"permanenciamin,omitempty"`
+}
+
+// Divide o trajeto em pernas: da origem à primeira escala, entre as escalas e da última
+// escala ao destino. Sem escalas, a única perna é o próprio trajeto.
+func (t Trajeto) Pernas() []Trajeto {
+	pernas := make([]Trajeto, 0, len(t.Escalas)+1)
+	inicio := t.Inicio
+	for _, escala := range t.Escalas {
+		pernas = append(pernas, Trajeto{CarroMQTT: t.CarroMQTT, Inicio: inicio, Destino: escala.Cidade})
+		inicio = escala.Cidade
+	}
+	return append(pernas, Trajeto{CarroMQTT: t.CarroMQTT, Inicio: inicio, Destino: t.Destino})
+}
+
+// Lê escalas no formato "SSA:60,ILH" (cidade e, opcionalmente, a permanência em minutos)
+func ParseEscalas(texto string) ([]Escala, error) {
+	var escalas []Escala
+	for _, item := range strings.Split(texto, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		cidade, minutos, _ := strings.Cut(item, ":")
+		info, ok := BuscarCidade(strings.TrimSpace(cidade))
+		if !ok {
+			return nil, fmt.Errorf("cidade de escala desconhecida: %q", cidade)
+		}
+		escala := Escala{Cidade: info.ID}
+		if minutos != "" {
+			valor, err := strconv.ParseFloat(strings.TrimSpace(minutos), 64)
+			if err != nil || valor < 0 {
+				return nil, fmt.Errorf("permanência inválida na escala %s: %q", info.ID, minutos)
+			}
+			escala.PermanenciaMin = valor
+		}
+		escalas = append(escalas, escala)
+	}
+	return escalas, nil
 }
 
 type Coordenadas struct {
-	Nome string
-	X    float64
-	Y    float64
+	Nome string  `json:"nome,omitempty"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
 }
 
 type Reserva struct {
+	ID      string   `json:"id,omitempty"` // ID da transação 2PC, definido pelo coordenador
 	Carro   Carro    `json:"carro"`
 	Paradas []Parada `json:"paradas"`
+	// Se a reserva falhar, entra na lista de espera do posto que recusou o prepare
+	ListaEspera bool `json:"listaespera,omitempty"`
+	// Escalas da viagem, para o coordenador replanejar as pernas que faltam
+	Escalas []Escala `json:"escalas,omitempty"`
+}
+
+// Estados da sessão de recarga: reservada → carro_chegou → carregando → finalizada/abortada
+type EstadoSessao string
+
+const (
+	SessaoReservada   EstadoSessao = "reservada"
+	SessaoCarroChegou EstadoSessao = "carro_chegou"
+	SessaoCarregando  EstadoSessao = "carregando"
+	SessaoFinalizada  EstadoSessao = "finalizada"
+	SessaoAbortada    EstadoSessao = "abortada"
+)
+
+type SessaoRecarga struct {
+	ID                string       `json:"id"`
+	TransacaoID       string       `json:"transacaoid"`
+	CarroID           string       `json:"carroid"`
+	PostoID           string       `json:"postoid"`
+	ConectorID        string       `json:"conectorid"`
+	Cidade            string       `json:"cidade"`
+	Estado            EstadoSessao `json:"estado"`
+	PotenciaKW        float64      `json:"potenciakw"`
+	PrecoKWh          float64      `json:"precokwh"` // Preço do posto no momento da reserva
+	BateriaInicial    float64      `json:"bateriainicial"`
+	CapacidadeBateria float64      `json:"capacidadebateria"`
+	ReservadaEm       time.Time    `json:"reservadaem"`
+	ExpiraEm          time.Time    `json:"expiraem,omitzero"` // Prazo para o carro sinalizar a chegada
+	PosicaoFila       int          `json:"posicaofila"`       // Carros à frente no conector ao reservar
+	EsperaEstimadaMin float64      `json:"esperaestimadamin,omitempty"`
+	ChegadaEm         time.Time    `json:"chegadaem,omitzero"`
+	InicioEm          time.Time    `json:"inicioem,omitzero"`
+	FimEm             time.Time    `json:"fimem,omitzero"`
+	EnergiaKWh        float64      `json:"energiakwh"`
+	DuracaoMin        float64      `json:"duracaomin"`
+	Motivo            string       `json:"motivo,omitempty"` // Motivo do aborto
+}
+
+// Motivo de aborto usado quando o carro não comparece ao posto reservado
+const MotivoNoShow = "no-show"
+
+// Cobrança de uma sessão de recarga, emitida pelo servidor dono do posto
+type Fatura struct {
+	ID             string    `json:"id"`
+	SessaoID       string    `json:"sessaoid"`
+	TransacaoID    string    `json:"transacaoid"`
+	CarroID        string    `json:"carroid"`
+	PostoID        string    `json:"postoid"`
+	ConectorID     string    `json:"conectorid"`
+	Cidade         string    `json:"cidade"`
+	EnergiaKWh     float64   `json:"energiakwh"`
+	PrecoKWh       float64   `json:"precokwh"`
+	ValorEnergia   float64   `json:"valorenergia"`
+	OciosidadeMin  float64   `json:"ociosidademin"`
+	TaxaOciosidade float64   `json:"taxaociosidade"`
+	TaxaNoShow     float64   `json:"taxanoshow"`
+	Total          float64   `json:"total"`
+	EmitidaEm      time.Time `json:"emitidaem"`
+}
+
+// Aviso do servidor do posto ao coordenador de que a reserva expirou por no-show
+type ReservaExpirada struct {
+	TransacaoID string `json:"transacao_id"`
+	SessaoID    string `json:"sessao_id"`
+	CarroID     string `json:"carro_id"`
+	PostoID     string `json:"posto_id"`
+}
+
+// Vaga aberta no posto para um carro da lista de espera. Nada fica reservado: o carro
+// refaz a reserva da rota pelo 2PC do coordenador, usando o conector indicado.
+type VagaEspera struct {
+	CarroID    string `json:"carroid"`
+	PostoID    string `json:"postoid"`
+	ConectorID string `json:"conectorid"`
+	Cidade     string `json:"cidade"`
+}
+
+// Aviso do servidor do posto ao coordenador de que a sessão de uma parada foi finalizada
+type ParadaConcluida struct {
+	TransacaoID string `json:"transacao_id"`
+	SessaoID    string `json:"sessao_id"`
+	CarroID     string `json:"carro_id"`
+	PostoID     string `json:"posto_id"`
+	ConectorID  string `json:"conector_id"`
+}
+
+// Fatura consolidada de uma viagem (todas as sessões de uma transação, em todas as cidades)
+type FaturaViagem struct {
+	TransacaoID string   `json:"transacaoid"`
+	CarroID     string   `json:"carroid"`
+	Faturas     []Fatura `json:"faturas"`
+	Total       float64  `json:"total"`
+	Pendentes   []string `json:"pendentes,omitempty"` // Servidores que não responderam
+}
+
+// Posição e bateria publicadas periodicamente pelo carro durante a viagem
+type Telemetria struct {
+	CarroID     string    `json:"carroid"`
+	Lat         float64   `json:"lat"`
+	Lon         float64   `json:"lon"`
+	Bateria     float64   `json:"bateria"`
+	ParadaAtual int       `json:"paradaatual"` // Índice da próxima parada da reserva
+	Instante    time.Time `json:"instante"`
+}
+
+// Perfil persistente do carro (ARQUIVO_PERFIL_CARRO). Guarda a identidade e as
+// características do veículo e, entre reinícios, o estado necessário para retomar a reserva.
+type PerfilCarro struct {
+	ID                string   `json:"id"` // UUID gerado no primeiro uso; também é o client ID no broker
+	Modelo            string   `json:"modelo"`
+	Proprietario      string   `json:"proprietario"`
+	CapacidadeBateria float64  `json:"capacidadebateria"` // kWh
+	Consumobateria    float64  `json:"consumobateria"`    // kWh/km
+	Conectores        []string `json:"conectores"`
+	TaxaMaxCargaKW    float64  `json:"taxamaxcargakw"`
+
+	// Estado salvo a cada mudança da viagem
+	Bateria float64       `json:"bateria,omitempty"`
+	Lat     float64       `json:"lat,omitempty"`
+	Lon     float64       `json:"lon,omitempty"`
+	Reserva *ReservaAtiva `json:"reserva,omitempty"`
+}
+
+// Reserva comitada em andamento, com o coordenador a consultar ao retomar
+type ReservaAtiva struct {
+	Reserva           Reserva `json:"reserva"`
+	ParadaAtual       int     `json:"paradaatual"`
+	CoordenadorID     string  `json:"coordenadorid"`
+	CoordenadorCidade string  `json:"coordenadorcidade"`
+}
+
+// Tipos de evento da viagem simulada
+const (
+	EventoPartida         = "partida"
+	EventoCidade          = "cidade" // O carro entrou em outra cidade
+	EventoChegada         = "chegada"
+	EventoCargaIniciada   = "carga_iniciada"
+	EventoCargaConcluida  = "carga_concluida"
+	EventoBateriaEsgotada = "bateria_esgotada"
+	EventoViagemConcluida = "viagem_concluida"
+)
+
+// Evento publicado pelo carro em car/<id>/evento durante a simulação do movimento
+type EventoCarro struct {
+	CarroID     string    `json:"carroid"`
+	Tipo        string    `json:"tipo"`
+	Cidade      string    `json:"cidade"`
+	Lat         float64   `json:"lat"`
+	Lon         float64   `json:"lon"`
+	Bateria     float64   `json:"bateria"`
+	ParadaAtual int       `json:"paradaatual"`
+	Detalhe     string    `json:"detalhe,omitempty"`
+	Instante    time.Time `json:"instante"`
+}
+
+// Pedido do carro ao coordenador para trocar ou remover uma parada da reserva comitada
+type AlteracaoReserva struct {
+	TransacaoID  string  `json:"transacaoid"`
+	Carro        Carro   `json:"carro"`
+	IndiceParada int     `json:"indiceparada"`
+	NovaParada   *Parada `json:"novaparada,omitempty"` // nil remove a parada
+}
+
+// Resposta do coordenador à consulta de reservas do carro (CarroRequestStatus)
+type StatusReserva struct {
+	TransacaoID string         `json:"transacaoid"`
+	Paradas     []StatusParada `json:"paradas"`
+}
+
+// Parada reservada e a sessão correspondente no servidor dono do posto
+type StatusParada struct {
+	Parada Parada         `json:"parada"`
+	Sessao *SessaoRecarga `json:"sessao,omitempty"`
+	Erro   string         `json:"erro,omitempty"` // Servidor do posto não respondeu
+}
+
+// Comando do servidor para o posto (start/stop)
+type ComandoPosto struct {
+	SessaoID      string  `json:"sessao_id"`
+	CarroID       string  `json:"carro_id"`
+	ConectorID    string  `json:"conector_id"`
+	PotenciaKW    float64 `json:"potenciakw"`
+	EnergiaMaxKWh float64 `json:"energiamaxkwh"` // Energia que falta para encher a bateria
+}
+
+// Evento do posto para o servidor (started/finished)
+type EventoPosto struct {
+	SessaoID   string    `json:"sessao_id"`
+	PostoID    string    `json:"posto_id"`
+	ConectorID string    `json:"conector_id"`
+	CarroID    string    `json:"carro_id"`
+	EnergiaKWh float64   `json:"energiakwh"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Heartbeat publicado pelo posto em station/<id>/status (Online=false vem do LWT)
+type StatusPosto struct {
+	ID         string           `json:"id"`
+	Online     bool             `json:"online"`
+	Conectores []StatusConector `json:"conectores,omitempty"`
+	Timestamp  time.Time        `json:"timestamp"`
+}
+
+type StatusConector struct {
+	ID         string  `json:"id"`
+	Status     string  `json:"status"`
+	SessaoID   string  `json:"sessao_id,omitempty"`
+	EnergiaKWh float64 `json:"energiakwh,omitempty"` // Energia entregue na sessão em andamento
+}
+
+// Gera um identificador aleatório com o prefixo informado (ex: "TX-3f9a1c2b7d4e5f60")
+func NovoID(prefixo string) string {
+	b := make([]byte, 8)
+	if _, err := cryptorand.Read(b); err != nil {
+		return fmt.Sprintf("%s-%d", prefixo, time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s-%x", prefixo, b)
+}
+
+// Gera um UUID versão 4 (RFC 4122), usado como identidade persistente do carro
+func NovoUUID() string {
+	b := make([]byte, 16)
+	if _, err := cryptorand.Read(b); err != nil {
+		return NovoID("carro")
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // versão 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variante RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Aceleração do tempo simulado pelos postos e carros (FATOR_TEMPO, padrão 60: um minuto
+// simulado por segundo real). Viagens, recargas e ociosidade são medidas em tempo simulado;
+// os horários guardados (chegada prevista, prazos) são sempre do relógio real.
+var FatorTempo = sync.OnceValue(func() float64 {
+	return ambiente.FloatAcimaDe("FATOR_TEMPO", 0, 60)
+})
+
+// Arredonda valores em reais para centavos
+func Arredondar(valor float64) float64 {
+	return math.Round(valor*100) / 100
+}
+
+// Intervalo do relógio real em que transcorre uma duração simulada
+func TempoReal(simulado time.Duration) time.Duration {
+	return time.Duration(float64(simulado) / FatorTempo())
+}
+
+// Duração simulada correspondente a um intervalo do relógio real
+func TempoSimulado(real time.Duration) time.Duration {
+	return time.Duration(float64(real) * FatorTempo())
+}
+
+// Anúncio publicado (retido) por cada servidor ao iniciar, usado para descoberta
+type AnuncioServidor struct {
+	ID          string    `json:"id"`
+	Cidade      string    `json:"cidade"`
+	URL         string    `json:"url"`
+	Capacidades []string  `json:"capacidades"`
+	Versao      string    `json:"versao"`
+	Inicio      time.Time `json:"inicio"`
 }
 
 type Participante2PC struct {
-	PostoID string
-	URL     string
+	PostoID         string
+	ConectorID      string
+	URL             string
+	Recurso         string  // RecursoPosto (padrão) ou RecursoCarteira
+	Valor           float64 // Valor a reter, quando o recurso é a carteira
+	CotacaoID       string  // Cotação a travar no prepare do posto
+	ChegadaPrevista time.Time
+	EnergiaKWh      float64 // Energia prevista na parada, calculada pelo coordenador
+	PrecoKWh        float64 // Preço travado pelo posto no prepare
+}
+
+// Recursos reservados pelo 2PC
+const (
+	RecursoPosto    = ""
+	RecursoCarteira = "carteira"
+)
+
+// Preço cotado por um servidor para um posto, válido até ValidaAte.
+// Travado no prepare do 2PC, é o preço cobrado na sessão.
+type Cotacao struct {
+	ID        string    `json:"id"`
+	PostoID   string    `json:"postoid"`
+	PrecoBase float64   `json:"precobase"`
+	PrecoKWh  float64   `json:"precokwh"`
+	Regras    []string  `json:"regras,omitempty"` // Regras aplicadas (ex: "horário ponta x1.25")
+	EmitidaEm time.Time `json:"emitidaem"`
+	ValidaAte time.Time `json:"validaate"`
+}
+
+// Regras de preço dinâmico de um servidor
+type RegrasPreco struct {
+	ValidadeCotacaoMin float64            `json:"validade_cotacao_min"`
+	FusoHorario        int                `json:"fuso_horario"` // Deslocamento em horas em relação ao UTC
+	Horarios           []TarifaHorario    `json:"horarios"`
+	Ocupacao           []TarifaOcupacao   `json:"ocupacao"`
+	DescontosOperador  map[string]float64 `json:"descontos_operador"` // Fração de desconto por operador
 }
 
-var cidades = map[string]struct {
-	x, y, raio float64
-}{
-	"FSA": {x: 97.67, y: 200.0, raio: 225.9}, // Raio aproximado calculado
-	"SSA": {x: 152.0, y: 249.0, raio: 210.1},
-	"ILH": {x: 300.67, y: 101.0, raio: 225.9},
+// Multiplicador aplicado entre Inicio e Fim ("HH:MM"; pode atravessar a meia-noite)
+type TarifaHorario struct {
+	Nome          string  `json:"nome"`
+	Inicio        string  `json:"inicio"`
+	Fim           string  `json:"fim"`
+	Multiplicador float64 `json:"multiplicador"`
 }
 
-var CidadesArray = []string{"FSA", "SSA", "ILH"}
+// Multiplicador aplicado quando a fração de conectores ocupados atinge Minima
+type TarifaOcupacao struct {
+	Minima        float64 `json:"minima"`
+	Multiplicador float64 `json:"multiplicador"`
+}
 
-// Calcula a distância euclidiana entre dois pontos
+// Saldo pré-pago do carro e os valores retidos pelas reservas em andamento
+type Carteira struct {
+	CarroID    string              `json:"carroid"`
+	Saldo      float64             `json:"saldo"`
+	Disponivel float64             `json:"disponivel,omitempty"` // Saldo menos as retenções (apenas em consultas)
+	Retencoes  map[string]Retencao `json:"retencoes"`            // Por transação
+}
+
+type Retencao struct {
+	Valor      float64   `json:"valor"`
+	Confirmada bool      `json:"confirmada"` // false enquanto o 2PC não fez commit
+	CriadaEm   time.Time `json:"criadaem"`
+}
+
+// Um carro sem conectores declarados é tratado como compatível com qualquer tipo
+func (c *Conector) Compativel(carro Carro) bool {
+	if len(carro.Conectores) == 0 {
+		return true
+	}
+	for _, tipo := range carro.Conectores {
+		if strings.EqualFold(tipo, c.Tipo) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conector) Livre() bool {
+	return len(c.Fila) == 0 && c.Pendente == nil
+}
+
+// Há vaga na fila do conector e nenhum prepare em andamento
+func (c *Conector) AceitaReserva(profundidade int) bool {
+	if profundidade < 1 {
+		profundidade = 1
+	}
+	return c.Pendente == nil && len(c.Fila) < profundidade
+}
+
+// Tempo estimado para os primeiros carros da fila completarem a bateria
+func (c *Conector) EsperaEstimadaMin(ate int) float64 {
+	espera := 0.0
+	for i := 0; i < ate && i < len(c.Fila); i++ {
+		carro := c.Fila[i]
+		if potencia := PotenciaEfetiva(*c, carro); potencia > 0 {
+			espera += math.Max(carro.CapacidadeBateria-carro.Bateria, 0) / potencia * 60
+		}
+	}
+	return espera
+}
+
+// Recalcula o status do conector a partir da fila e do pendente
+func (c *Conector) AtualizarStatus() {
+	switch {
+	case len(c.Fila) > 0:
+		c.Status = ConectorOcupado
+	case c.Pendente != nil:
+		c.Status = ConectorPendente
+	default:
+		c.Status = ConectorLivre
+	}
+}
+
+// Potência que o carro realmente consegue receber do conector
+func PotenciaEfetiva(conector Conector, carro Carro) float64 {
+	if carro.TaxaMaxCargaKW > 0 && carro.TaxaMaxCargaKW < conector.PotenciaKW {
+		return carro.TaxaMaxCargaKW
+	}
+	return conector.PotenciaKW
+}
+
+func (p *Posto) BuscarConector(id string) *Conector {
+	for i := range p.Conectores {
+		if p.Conectores[i].ID == id {
+			return &p.Conectores[i]
+		}
+	}
+	return nil
+}
+
+// Retorna o conector livre e compatível com maior potência efetiva para o carro
+func (p *Posto) ConectorCompativel(carro Carro) *Conector {
+	var melhor *Conector
+	for i := range p.Conectores {
+		c := &p.Conectores[i]
+		if !c.Livre() || !c.Compativel(carro) {
+			continue
+		}
+		if melhor == nil || PotenciaEfetiva(*c, carro) > PotenciaEfetiva(*melhor, carro) {
+			melhor = c
+		}
+	}
+	return melhor
+}
+
+// Indica se existe ao menos um conector livre no posto
+func (p *Posto) Disponivel() bool {
+	for _, c := range p.Conectores {
+		if c.Livre() {
+			return true
+		}
+	}
+	return false
+}
+
+// Indica se algum conector ainda tem vaga na fila (profundidade mínima 1)
+func (p *Posto) AceitaReservas(profundidade int) bool {
+	for i := range p.Conectores {
+		if p.Conectores[i].AceitaReserva(profundidade) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conector compatível com vaga na fila e menor espera (empate: maior potência efetiva)
+func (p *Posto) ConectorParaReserva(carro Carro, profundidade int) *Conector {
+	var melhor *Conector
+	for i := range p.Conectores {
+		c := &p.Conectores[i]
+		if !c.AceitaReserva(profundidade) || !c.Compativel(carro) {
+			continue
+		}
+		if melhor == nil {
+			melhor = c
+			continue
+		}
+		espera, esperaMelhor := c.EsperaEstimadaMin(len(c.Fila)), melhor.EsperaEstimadaMin(len(melhor.Fila))
+		if espera < esperaMelhor || (espera == esperaMelhor && PotenciaEfetiva(*c, carro) > PotenciaEfetiva(*melhor, carro)) {
+			melhor = c
+		}
+	}
+	return melhor
+}
+
+// Remove o carro da lista de espera do posto
+func (p *Posto) RemoverDaEspera(carroID string) bool {
+	for i, carro := range p.ListaEspera {
+		if carro.ID == carroID {
+			p.ListaEspera = append(p.ListaEspera[:i], p.ListaEspera[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove o carro da fila e do pendente de todos os conectores do posto, e da lista de espera
+func (p *Posto) RemoverCarro(carroID string) bool {
+	removido := p.RemoverDaEspera(carroID)
+	for i := range p.Conectores {
+		c := &p.Conectores[i]
+		novaFila := []Carro{}
+		for _, carro := range c.Fila {
+			if carro.ID == carroID {
+				removido = true
+			} else {
+				novaFila = append(novaFila, carro)
+			}
+		}
+		c.Fila = novaFila
+		if c.Pendente != nil && c.Pendente.ID == carroID {
+			c.Pendente = nil
+			removido = true
+		}
+		c.AtualizarStatus()
+	}
+	return removido
+}
+
+// Registro de cidades carregado da configuração (ver storage.LerCidades).
+// É preenchido uma única vez na inicialização e apenas lido depois disso.
+var registroCidades []Cidade
+
+func RegistrarCidades(lista []Cidade) {
+	registroCidades = lista
+}
+
+func Cidades() []Cidade {
+	return registroCidades
+}
+
+func BuscarCidade(id string) (Cidade, bool) {
+	for _, c := range registroCidades {
+		if strings.EqualFold(c.ID, id) {
+			return c, true
+		}
+	}
+	return Cidade{}, false
+}
+
+// IDs das cidades registradas, na ordem do arquivo de configuração
+func IDsCidades() []string {
+	ids := make([]string, 0, len(registroCidades))
+	for _, c := range registroCidades {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// Cidade cujo servidor mantém as carteiras (a primeira marcada no registro)
+func CidadeCarteira() (Cidade, bool) {
+	for _, c := range registroCidades {
+		if c.Carteira {
+			return c, true
+		}
+	}
+	return Cidade{}, false
+}
+
+// Centro de cada cidade registrada, usado pelo planejamento de rotas
+func CentrosCidades() map[string]Coordenadas {
+	centros := make(map[string]Coordenadas, len(registroCidades))
+	for _, c := range registroCidades {
+		centro := c.Centro
+		centro.Nome = c.Nome
+		centros[c.ID] = centro
+	}
+	return centros
+}
+
+// Verifica se o ponto está na área de cobertura da cidade (polígono, se houver, senão raio)
+func (c Cidade) Contem(lat, lon float64) bool {
+	if len(c.Poligono) >= 3 {
+		return pontoNoPoligono(lat, lon, c.Poligono)
+	}
+	return distancia(lat, lon, c.Centro.Lat, c.Centro.Lon) <= c.RaioKm
+}
+
+// Ray casting sobre o plano lat/lon (suficiente para áreas do tamanho de uma cidade)
+func pontoNoPoligono(lat, lon float64, poligono []Coordenadas) bool {
+	dentro := false
+	j := len(poligono) - 1
+	for i := range poligono {
+		pi, pj := poligono[i], poligono[j]
+		if (pi.Lat > lat) != (pj.Lat > lat) &&
+			lon < (pj.Lon-pi.Lon)*(lat-pi.Lat)/(pj.Lat-pi.Lat)+pi.Lon {
+			dentro = !dentro
+		}
+		j = i
+	}
+	return dentro
+}
+
+const RaioTerraKm = 6371.0
+
+// Calcula a distância de círculo máximo (haversine) entre dois pontos, em km
 func CalcularDistancia(destino, origem Coordenadas) float64 {
-	return math.Sqrt(math.Pow(destino.X-origem.X, 2) + math.Pow(destino.Y-origem.Y, 2))
+	return distancia(origem.Lat, origem.Lon, destino.Lat, destino.Lon)
+}
+
+func distancia(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * RaioTerraKm * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
 }
 
-// Função para calcular a distância entre dois pontos
-func distancia(x1, y1, x2, y2 float64) float64 {
-	return math.Sqrt(math.Pow(x2-x1, 2) + math.Pow(y2-y1, 2))
+// Retorna a cidade cuja cobertura contém o ponto (a de centro mais próximo, se houver sobreposição)
+func CidadeDaPosicao(lat, lon float64) string {
+	cidadeMaisProxima := ""
+	menorDistancia := math.MaxFloat64
+	for _, cidade := range registroCidades {
+		if !cidade.Contem(lat, lon) {
+			continue
+		}
+		d := distancia(lat, lon, cidade.Centro.Lat, cidade.Centro.Lon)
+		if d < menorDistancia {
+			menorDistancia = d
+			cidadeMaisProxima = cidade.ID
+		}
+	}
+	if cidadeMaisProxima == "" {
+		return "Fora de cobertura"
+	}
+	return cidadeMaisProxima
 }
 
 // Função para determinar em qual cidade o carro está
-func CidadeAtualDoCarro(xCarro, yCarro float64) string {
-	for cidade, info := range cidades {
-		d := distancia(xCarro, yCarro, info.x, info.y)
-		if d <= info.raio {
-			log.Println("Carro está em:", cidade)
-			return cidade
+func CidadeAtualDoCarro(latCarro, lonCarro float64) string {
+	cidade := CidadeDaPosicao(latCarro, lonCarro)
+	log.Println("Carro está em:", cidade)
+	return cidade
+}
+
+// Limite de sorteios antes de recorrer ao centro da cidade
+const maxTentativasPosicao = 100
+
+// Sorteia uma posição dentro da área de cobertura de uma das cidades registradas
+func PosicaoAleatoria() (float64, float64) {
+	if len(registroCidades) == 0 {
+		return 0, 0
+	}
+	cidade := registroCidades[rand.Intn(len(registroCidades))]
+	raio := cidade.RaioKm
+	if len(cidade.Poligono) >= 3 {
+		// Sorteia no círculo que envolve o polígono até cair dentro dele
+		raio = 0
+		for _, p := range cidade.Poligono {
+			raio = math.Max(raio, distancia(cidade.Centro.Lat, cidade.Centro.Lon, p.Lat, p.Lon))
+		}
+	}
+	for tentativa := 0; tentativa < maxTentativasPosicao; tentativa++ {
+		// Distribuição uniforme no disco de cobertura
+		d := raio * math.Sqrt(rand.Float64())
+		angulo := rand.Float64() * 2 * math.Pi
+		lat := cidade.Centro.Lat + (d*math.Cos(angulo))/RaioTerraKm*180/math.Pi
+		lon := cidade.Centro.Lon + (d*math.Sin(angulo))/(RaioTerraKm*math.Cos(cidade.Centro.Lat*math.Pi/180))*180/math.Pi
+		if cidade.Contem(lat, lon) {
+			return lat, lon
 		}
 	}
-	return "Fora de cobertura"
+	// Polígono degenerado ou fora do círculo sorteado: usa o centro da cidade
+	return cidade.Centro.Lat, cidade.Centro.Lon
 }
 
 func GetLocalIP() (string, error) {
@@ -3,9 +3,14 @@ package Rotas
 import (
 	consts "MQTT/utils/Constantes"
 	"log"
+	"sort"
 	"strings"
+	"time"
 )
 
+// Velocidade média usada para prever o horário de chegada em cada parada
+const VelocidadeMediaKmH = 80.0
+
 // Calcula quantos quilômetros o carro pode andar com a bateria fornecida
 func calcularAutonomia(consumoKW, capacidadeBateria float64) float64 {
 	if consumoKW == 0 {
@@ -14,80 +19,152 @@ func calcularAutonomia(consumoKW, capacidadeBateria float64) float64 {
 	return capacidadeBateria / consumoKW
 }
 
-func GerarRotas(carro consts.Carro, rota []string, cidades map[string]consts.Coordenadas, todosOsPostos map[string][]consts.Posto) []consts.Parada {
+// Planeja uma viagem com escalas: cada perna segue a sua rota e começa com a bateria e
+// o horário em que a anterior terminou, somados à permanência na escala (permanencias[i]
+// é o tempo na escala ao fim da perna i). As paradas indicam a perna em que ficam.
+func PlanejarViagem(carro consts.Carro, pernas [][]string, permanencias []float64, cidades map[string]consts.Coordenadas, todosOsPostos map[string][]consts.Posto) ([]consts.Parada, consts.ResumoRota) {
 	log.Println("🔄 Iniciando cálculo da rota com paradas automáticas...")
 
-	posicaoAtual := consts.Coordenadas{X: carro.X, Y: carro.Y}
+	posicaoAtual := consts.Coordenadas{Lat: carro.Lat, Lon: carro.Lon}
 	bateriaAtual := carro.Bateria
 	paradas := []consts.Parada{}
-
-	for _, nomeCidade := range rota {
-		destino := cidades[nomeCidade]
-
-		// Se já estamos no destino, ignorar
-		if posicaoAtual.X == destino.X && posicaoAtual.Y == destino.Y {
-			continue
-		}
-
-		for {
-			distancia := consts.CalcularDistancia(posicaoAtual, destino)
-			autonomia := bateriaAtual / carro.Consumobateria
-			log.Printf("📍 Tentando ir de (%.2f, %.2f) até %s. Distância: %.2f, Autonomia: %.2f", posicaoAtual.X, posicaoAtual.Y, nomeCidade, distancia, autonomia)
-
-			// Se o destino é alcançável, simula a viagem e sai do loop
-			if distancia <= autonomia {
-				bateriaAtual -= distancia * carro.Consumobateria
-				posicaoAtual = destino
-				log.Printf("✅ Chegou diretamente em %s. Bateria restante: %.2f", nomeCidade, bateriaAtual)
-				break
+	postosUsados := make(map[string]bool) // Evita reservar o mesmo posto duas vezes na mesma viagem
+	distanciaPercorrida := 0.0
+	inicio := time.Now()
+	var resumo consts.ResumoRota
+
+	for perna, rota := range pernas {
+		for _, nomeCidade := range rota {
+			destino := cidades[nomeCidade]
+
+			// Se já estamos no destino, ignorar
+			if posicaoAtual.Lat == destino.Lat && posicaoAtual.Lon == destino.Lon {
+				continue
 			}
 
-			// Caso não seja alcançável, procurar melhor posto dentro da autonomia
-			var melhorPosto *consts.Posto
-			var menorDistancia float64 = 1e9
-			var cidadeDaParada string
+			for {
+				distancia := consts.CalcularDistancia(posicaoAtual, destino)
+				autonomia := bateriaAtual / carro.Consumobateria
+				log.Printf("📍 Tentando ir de (%.4f, %.4f) até %s. Distância: %.2f km, Autonomia: %.2f km", posicaoAtual.Lat, posicaoAtual.Lon, nomeCidade, distancia, autonomia)
+
+				// Se o destino é alcançável, simula a viagem e sai do loop
+				if distancia <= autonomia {
+					bateriaAtual -= distancia * carro.Consumobateria
+					distanciaPercorrida += distancia
+					posicaoAtual = destino
+					log.Printf("✅ Chegou diretamente em %s. Bateria restante: %.2f", nomeCidade, bateriaAtual)
+					break
+				}
 
-			for cidade, listaPostos := range todosOsPostos {
-				for _, posto := range listaPostos {
-					distanciaAtePosto := consts.CalcularDistancia(posicaoAtual, consts.Coordenadas{X: posto.X, Y: posto.Y})
-					if distanciaAtePosto <= autonomia && distanciaAtePosto < menorDistancia {
-						menorDistancia = distanciaAtePosto
+				// Caso não seja alcançável, procurar melhor posto dentro da autonomia
+				// que tenha vaga em um conector compatível. O custo de cada posto é o tempo
+				// de deslocamento até ele somado à espera prevista na fila do conector.
+				var melhorPosto *consts.Posto
+				var melhorConector *consts.Conector
+				var menorCusto float64 = 1e9
+				var esperaDaParada float64
+				var cidadeDaParada string
+
+				for cidade, listaPostos := range todosOsPostos {
+					for _, posto := range listaPostos {
+						if postosUsados[posto.Id] {
+							continue
+						}
+						distanciaAtePosto := consts.CalcularDistancia(posicaoAtual, consts.Coordenadas{Lat: posto.Lat, Lon: posto.Lon})
+						if distanciaAtePosto > autonomia {
+							continue
+						}
 						tmp := posto
+						conector := tmp.ConectorParaReserva(carro, tmp.ProfundidadeFila)
+						if conector == nil {
+							continue
+						}
+						espera := conector.EsperaEstimadaMin(len(conector.Fila))
+						custo := distanciaAtePosto/VelocidadeMediaKmH*60 + espera
+						if custo >= menorCusto {
+							continue
+						}
+						menorCusto = custo
 						melhorPosto = &tmp
+						melhorConector = conector
+						esperaDaParada = espera
 						cidadeDaParada = cidade
 					}
 				}
-			}
 
-			if melhorPosto == nil {
-				log.Fatalf("❌ ERRO: Não há posto viável para recarga entre (%.2f, %.2f) e %s", posicaoAtual.X, posicaoAtual.Y, nomeCidade)
-			}
+				if melhorPosto == nil {
+					log.Printf("❌ ERRO: Não há posto viável para recarga entre (%.4f, %.4f) e %s", posicaoAtual.Lat, posicaoAtual.Lon, nomeCidade)
+					return nil, consts.ResumoRota{}
+				}
+				postosUsados[melhorPosto.Id] = true
+
+				log.Printf("🔋 Parada necessária no posto: %s (%.4f, %.4f) conector %s (%s), espera prevista %.0f min", melhorPosto.Nome, melhorPosto.Lat, melhorPosto.Lon, melhorConector.ID, melhorConector.Tipo, esperaDaParada)
+
+				// Simula deslocamento até o posto
+				distanciaAtePosto := consts.CalcularDistancia(posicaoAtual, consts.Coordenadas{Lat: melhorPosto.Lat, Lon: melhorPosto.Lon})
+				bateriaAtual -= distanciaAtePosto * carro.Consumobateria
+				distanciaPercorrida += distanciaAtePosto
+				chegada := inicio.Add(consts.TempoReal(time.Duration(distanciaPercorrida / VelocidadeMediaKmH * float64(time.Hour))))
+				energiaRecarga := carro.CapacidadeBateria - bateriaAtual
+				bateriaAtual = carro.CapacidadeBateria // recarrega totalmente
+				posicaoAtual = consts.Coordenadas{Lat: melhorPosto.Lat, Lon: melhorPosto.Lon}
+
+				// O preço cotado pelo servidor do posto prevalece sobre o estático
+				custoKW := melhorPosto.CustoKW
+				if melhorPosto.Cotacao != nil {
+					custoKW = melhorPosto.Cotacao.PrecoKWh
+				}
+
+				// Adiciona parada à lista
+				paradas = append(paradas, consts.Parada{
+					NomePosto:         melhorPosto.Nome,
+					IDPosto:           melhorPosto.Id,
+					IDConector:        melhorConector.ID,
+					TipoConector:      melhorConector.Tipo,
+					PotenciaKW:        consts.PotenciaEfetiva(*melhorConector, carro),
+					Lat:               melhorPosto.Lat,
+					Lon:               melhorPosto.Lon,
+					Cidade:            cidadeDaParada,
+					CustoKW:           custoKW,
+					EnergiaKWh:        energiaRecarga,
+					Cotacao:           melhorPosto.Cotacao,
+					ChegadaPrevista:   chegada,
+					EsperaEstimadaMin: esperaDaParada,
+					Perna:             perna,
+				})
+				// A espera na fila e a recarga atrasam a chegada às próximas paradas
+				permanencia := esperaDaParada * float64(time.Minute)
+				if parada := paradas[len(paradas)-1]; parada.PotenciaKW > 0 {
+					permanencia += parada.EnergiaKWh / parada.PotenciaKW * float64(time.Hour)
+				}
+				inicio = inicio.Add(consts.TempoReal(time.Duration(permanencia)))
 
-			log.Printf("🔋 Parada necessária no posto: %s (%.2f, %.2f)", melhorPosto.Nome, melhorPosto.X, melhorPosto.Y)
-
-			// Simula deslocamento até o posto
-			distanciaAtePosto := consts.CalcularDistancia(posicaoAtual, consts.Coordenadas{X: melhorPosto.X, Y: melhorPosto.Y})
-			bateriaAtual -= distanciaAtePosto * carro.Consumobateria
-			bateriaAtual = carro.CapacidadeBateria // recarrega totalmente
-			posicaoAtual = consts.Coordenadas{X: melhorPosto.X, Y: melhorPosto.Y}
-
-			// Adiciona parada à lista
-			paradas = append(paradas, consts.Parada{
-				NomePosto: melhorPosto.Nome,
-				IDPosto:   melhorPosto.Id,
-				X:         melhorPosto.X,
-				Y:         melhorPosto.Y,
-				Cidade: cidadeDaParada,
-			})
+				parada := paradas[len(paradas)-1]
+				resumo.CustoEstimado += parada.CustoKW * parada.EnergiaKWh
+				resumo.DuracaoMin += esperaDaParada
+				if parada.PotenciaKW > 0 {
+					resumo.DuracaoMin += parada.EnergiaKWh / parada.PotenciaKW * 60
+				}
+			}
+		}
+		if perna < len(permanencias) && perna < len(pernas)-1 {
+			// A permanência na escala atrasa as paradas das pernas seguintes
+			inicio = inicio.Add(consts.TempoReal(time.Duration(permanencias[perna] * float64(time.Minute))))
+			resumo.DuracaoMin += permanencias[perna]
 		}
 	}
 
 	log.Printf("🚗 Paradas planejadas (%d):", len(paradas))
 	for i, p := range paradas {
-		log.Printf("  [%d] %s (%s) - X: %.2f, Y: %.2f, Cidade: %s", i+1, p.NomePosto, p.IDPosto, p.X, p.Y, p.Cidade)
+		log.Printf("  [%d] %s (%s/%s %.0fkW) - Lat: %.4f, Lon: %.4f, Cidade: %s", i+1, p.NomePosto, p.IDPosto, p.IDConector, p.PotenciaKW, p.Lat, p.Lon, p.Cidade)
 	}
 
-	return paradas
+	resumo.DistanciaKm = distanciaPercorrida
+	resumo.Paradas = len(paradas)
+	resumo.DuracaoMin += distanciaPercorrida / VelocidadeMediaKmH * 60
+	resumo.BateriaChegada = bateriaAtual
+	resumo.ChegadaPrevista = time.Now().Add(consts.TempoReal(time.Duration(resumo.DuracaoMin * float64(time.Minute))))
+	return paradas, resumo
 }
 
 func GetRotasValidas(rotasPossiveis map[string][]string, trajeto consts.Trajeto) map[string][]string {
@@ -129,3 +206,42 @@ func GetRotasValidas(rotasPossiveis map[string][]string, trajeto consts.Trajeto)
 
 	return mapaCompleto
 }
+
+// Combina as rotas válidas de cada perna da viagem. O nome da combinação junta os nomes
+// das rotas de cada perna com "+"; só as primeiras combinações em ordem alfabética, até o
+// limite, são mantidas. Se alguma perna não tem rota, não há combinação.
+func CombinarPernas(rotasPorPerna []map[string][]string, limite int) map[string][][]string {
+	type combinacao struct {
+		nome   string
+		pernas [][]string
+	}
+	combinacoes := []combinacao{{}}
+	for _, rotas := range rotasPorPerna {
+		nomes := make([]string, 0, len(rotas))
+		for nome := range rotas {
+			nomes = append(nomes, nome)
+		}
+		sort.Strings(nomes)
+
+		var proximas []combinacao
+		for _, atual := range combinacoes {
+			for _, nome := range nomes {
+				if len(proximas) >= limite {
+					break
+				}
+				proxima := combinacao{nome: nome, pernas: append(append([][]string{}, atual.pernas...), rotas[nome])}
+				if atual.nome != "" {
+					proxima.nome = atual.nome + "+" + nome
+				}
+				proximas = append(proximas, proxima)
+			}
+		}
+		combinacoes = proximas
+	}
+
+	resultado := make(map[string][][]string, len(combinacoes))
+	for _, c := range combinacoes {
+		resultado[c.nome] = c.pernas
+	}
+	return resultado
+}
@@ -9,12 +9,17 @@ import (
 func CarroRequestReserva(carID string, serverID string, cidade string) string     { return fmt.Sprintf("car/%s/request/reserva/%s/%s", carID, cidade, serverID) }
 func CarroRequestRotas(carID string, cidade string) string     { return fmt.Sprintf("car/%s/request/rotas/%s", carID, strings.ToLower(cidade)) }
 func CarroDesconectado(carID string) string {return fmt.Sprintf("car/%s/desconectado", carID)}
+func CarroReconectado(carID string) string {return fmt.Sprintf("car/%s/reconectado", carID)} // Cancela a limpeza agendada pelo LWT
 func CarroRequestToServer(carID string, cidade string, TipoDeSolicitacao string) string     { return fmt.Sprintf("car/%s/request/%s/%s", carID, cidade, TipoDeSolicitacao) }
 
 func CarroSendsRechargeStart(carID string, serverID, cidade string) string { return fmt.Sprintf("car/%s/recharge/start/%s", carID, strings.ToLower(cidade)) }
 func CarroSendsRechargeFinish(carID string) string { return fmt.Sprintf("car/%s/recharge/finish/", carID) }
 func CarroRequestStatus(carID string, serverID string, cidade string) string      { return fmt.Sprintf("car/%s/request/status/%s/%s", carID, cidade, serverID) }
 func CarroRequestCancel(carID string) string      { return fmt.Sprintf("car/%s/request/cancel//", carID) }
+func CarroRequestAlteracao(carID string, serverID string, cidade string) string { return fmt.Sprintf("car/%s/request/alteracao/%s/%s", carID, cidade, serverID) }
+func CarroRequestReplanejamento(carID string, serverID string, cidade string) string { return fmt.Sprintf("car/%s/request/replanejamento/%s/%s", carID, cidade, serverID) }
+func CarroTelemetria(carID string) string { return fmt.Sprintf("car/%s/telemetria", carID) }
+func CarroEvento(carID string) string { return fmt.Sprintf("car/%s/evento", carID) }
 
 
 // Servidor → Carro
@@ -24,6 +29,16 @@ func ServerReserveStatus(serverID, carID string) string     { return fmt.Sprintf
 func ServerResponteRoutes(carID string, cidade string) string { return fmt.Sprintf("server/%s/rotas/%s", carID, strings.ToLower(cidade))}
 func ServerDesconectado(serverID string) string {return fmt.Sprintf("server/%s/desconectado", serverID)}
 
+// Servidor → Servidores (descoberta, mensagem retida)
+func ServerAnuncio(cidade string) string { return fmt.Sprintf("server/anuncio/%s", strings.ToLower(cidade)) }
+func CidadeDoAnuncio(topico string) string { return strings.ToUpper(strings.TrimPrefix(topico, "server/anuncio/")) } // Para anúncios apagados (payload vazio)
+
+// Servidor do posto → Coordenador da transação (o carro não compareceu a uma parada)
+func ServerReservaExpirada(transacaoID string) string { return fmt.Sprintf("server/reserva/expirada/%s", transacaoID) }
+
+// Servidor do posto → Coordenador da transação (a sessão de uma parada foi finalizada)
+func ServerParadaConcluida(transacaoID string) string { return fmt.Sprintf("server/reserva/concluida/%s", transacaoID) }
+
 // Servidor → Posto
 func ServerCommandReserve(stationID string) string { return fmt.Sprintf("station/%s/command/reserve", stationID) }
 func ServerCommandCancel(stationID string) string  { return fmt.Sprintf("station/%s/command/cancel", stationID) }
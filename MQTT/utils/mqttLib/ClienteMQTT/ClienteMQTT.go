@@ -4,20 +4,29 @@ import (
 	mqttlib "MQTT/utils/mqttLib/Router"
 	"encoding/json"
 	"log"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type MQTTClient struct {
-	Client mqtt.Client
-	Router *mqttlib.Router
+	Client  mqtt.Client
+	Router  *mqttlib.Router
+	eventos *eventosConexao // Só em clientes criados com NewClientComID
+}
+
+// Callbacks de queda e reconexão, compartilhados pelas cópias do cliente
+type eventosConexao struct {
+	mutex        sync.Mutex
+	conectou     bool // Já houve uma conexão: as próximas são reconexões
+	aoReconectar func()
+	aoPerder     func(error)
 }
 
 
 
 func NewClient(broker string, router *mqttlib.Router, LWTtopic string, ID string) *MQTTClient {
-	opts := mqtt.NewClientOptions().AddBroker(broker)
-	opts.SetCleanSession(true)
 	lwtPayload := map[string]string{
 		"ID": ID,
 		"Motivo": "Desconexão inesperada",
@@ -26,11 +35,78 @@ func NewClient(broker string, router *mqttlib.Router, LWTtopic string, ID string
 	if err !=nil{
 		log.Fatalf("Erro ao serializar LWT Payload.")
 	}
-	opts.SetWill(LWTtopic, string(lwtJSON), 1, false)
+	return NewClientWithWill(broker, router, LWTtopic, lwtJSON, false)
+}
+
+// Permite definir o payload do LWT e se ele deve ser retido. Um payload vazio e retido
+// apaga a mensagem retida do tópico quando o cliente cai.
+func NewClientWithWill(broker string, router *mqttlib.Router, LWTtopic string, payload []byte, retido bool) *MQTTClient {
+	opts := mqtt.NewClientOptions().AddBroker(broker)
+	opts.SetCleanSession(true)
+	opts.SetBinaryWill(LWTtopic, payload, 1, retido)
 	client := mqtt.NewClient(opts)
 	return &MQTTClient{Client: client, Router: router}
 }
 
+// Como NewClient, mas usa o ID também como client ID no broker. Uma nova conexão com o
+// mesmo ID (ex: o carro reiniciado) assume a sessão da anterior em vez de coexistir com ela.
+func NewClientComID(broker string, router *mqttlib.Router, LWTtopic string, ID string) *MQTTClient {
+	lwtJSON, err := json.Marshal(map[string]string{
+		"ID":     ID,
+		"Motivo": "Desconexão inesperada",
+	})
+	if err != nil {
+		log.Fatalf("Erro ao serializar LWT Payload.")
+	}
+	eventos := &eventosConexao{}
+	opts := mqtt.NewClientOptions().AddBroker(broker)
+	opts.SetClientID(ID)
+	opts.SetCleanSession(true)
+	opts.SetBinaryWill(LWTtopic, lwtJSON, 1, false)
+	// Tenta de novo a cada 5s no máximo, para voltar dentro da tolerância de desconexão dos servidores
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(5 * time.Second)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		eventos.mutex.Lock()
+		reconexao, callback := eventos.conectou, eventos.aoReconectar
+		eventos.conectou = true
+		eventos.mutex.Unlock()
+		if reconexao && callback != nil {
+			callback()
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		eventos.mutex.Lock()
+		callback := eventos.aoPerder
+		eventos.mutex.Unlock()
+		if callback != nil {
+			callback(err)
+		}
+	})
+	return &MQTTClient{Client: mqtt.NewClient(opts), Router: router, eventos: eventos}
+}
+
+// Define a função chamada quando o cliente volta sozinho depois de uma queda. A sessão
+// é limpa, então as assinaturas precisam ser refeitas nela.
+func (m *MQTTClient) AoReconectar(callback func()) {
+	if m.eventos == nil {
+		return
+	}
+	m.eventos.mutex.Lock()
+	m.eventos.aoReconectar = callback
+	m.eventos.mutex.Unlock()
+}
+
+// Define a função chamada quando a conexão com o broker cai
+func (m *MQTTClient) AoPerderConexao(callback func(error)) {
+	if m.eventos == nil {
+		return
+	}
+	m.eventos.mutex.Lock()
+	m.eventos.aoPerder = callback
+	m.eventos.mutex.Unlock()
+}
+
 func (m *MQTTClient) Connect() mqtt.Token{
 	return m.Client.Connect()
 }
@@ -41,6 +117,15 @@ func (m *MQTTClient) Subscribe(topic string) {
 		m.Router.Handle(msg.Topic(), msg.Payload())
 	})
 }
+// Publica uma mensagem retida pelo broker (entregue a quem assinar o tópico depois)
+func (m *MQTTClient) PublishRetained(topic string, payload []byte) {
+	token := m.Client.Publish(topic, 1, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Erro ao publicar mensagem retida: %v", token.Error())
+	}
+}
+
 func (m *MQTTClient) Publish(topic string, payload []byte) {
 	token := m.Client.Publish(topic, 0, false, payload)
 	if token.Error() != nil {
@@ -4,22 +4,30 @@ import "strings"
 
 type HandlerFunc func([]byte)
 
+// Handler que também recebe o tópico, para assinaturas com curinga que precisam saber
+// qual tópico casou (por exemplo, quando o payload vem vazio)
+type HandlerTopicoFunc func(string, []byte)
+
 type Router struct {
-	handlers map[string]HandlerFunc
+	handlers map[string]HandlerTopicoFunc
 }
 
 func NewRouter() *Router {
-	return &Router{handlers: make(map[string]HandlerFunc)}
+	return &Router{handlers: make(map[string]HandlerTopicoFunc)}
 }
 
 func (r *Router) Register(topic string, handler HandlerFunc) {
+	r.handlers[topic] = func(_ string, payload []byte) { handler(payload) }
+}
+
+func (r *Router) RegisterComTopico(topic string, handler HandlerTopicoFunc) {
 	r.handlers[topic] = handler
 }
 
 func (r *Router) Handle(topic string, payload []byte) {
 	for pattern, handler := range r.handlers {
 		if matchTopic(pattern, topic) {
-			handler(payload)
+			handler(topic, payload)
 			return
 		}
 	}
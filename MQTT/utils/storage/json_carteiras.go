@@ -0,0 +1,36 @@
+package storage
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Lê as carteiras salvas, por carro. Um arquivo inexistente equivale a nenhuma carteira.
+func LerCarteiras(filePath string) (map[string]*consts.Carteira, error) {
+	carteiras := make(map[string]*consts.Carteira)
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return carteiras, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o arquivo de carteiras: %v", err)
+	}
+	if len(data) == 0 {
+		return carteiras, nil
+	}
+	if err := json.Unmarshal(data, &carteiras); err != nil {
+		return nil, fmt.Errorf("erro ao desserializar o arquivo de carteiras: %v", err)
+	}
+	return carteiras, nil
+}
+
+func SalvarCarteiras(filePath string, carteiras map[string]*consts.Carteira) error {
+	data, err := json.MarshalIndent(carteiras, "", "  ")
+	if err != nil {
+		return fmt.Errorf("erro ao serializar carteiras: %v", err)
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+func LerCidades(filePath string) ([]consts.Cidade, error) {
+	if filePath == "" {
+		return nil, fmt.Errorf("ARQUIVO_JSON_CIDADES não definido")
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o arquivo de cidades: %v", err)
+	}
+
+	var dados struct {
+		Cidades []consts.Cidade `json:"cidades"`
+	}
+	if err := json.Unmarshal(data, &dados); err != nil {
+		return nil, fmt.Errorf("erro ao desserializar o arquivo de cidades: %v", err)
+	}
+	if len(dados.Cidades) == 0 {
+		return nil, fmt.Errorf("nenhuma cidade encontrada em %s", filePath)
+	}
+	return dados.Cidades, nil
+}
+
+// Lê o arquivo indicado por ARQUIVO_JSON_CIDADES e preenche o registro de cidades
+func CarregarCidades() {
+	cidades, err := LerCidades(os.Getenv("ARQUIVO_JSON_CIDADES"))
+	if err != nil {
+		panic(err)
+	}
+	consts.RegistrarCidades(cidades)
+	log.Printf("Registro carregado com %d cidades: %v\n", len(cidades), consts.IDsCidades())
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Lê as faturas salvas, agrupadas por carro. Um arquivo inexistente equivale a nenhuma fatura.
+func LerFaturas(filePath string) (map[string][]consts.Fatura, error) {
+	faturas := make(map[string][]consts.Fatura)
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return faturas, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o arquivo de faturas: %v", err)
+	}
+	if len(data) == 0 {
+		return faturas, nil
+	}
+	if err := json.Unmarshal(data, &faturas); err != nil {
+		return nil, fmt.Errorf("erro ao desserializar o arquivo de faturas: %v", err)
+	}
+	return faturas, nil
+}
+
+func SalvarFaturas(filePath string, faturas map[string][]consts.Fatura) error {
+	data, err := json.MarshalIndent(faturas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("erro ao serializar faturas: %v", err)
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Lê o perfil do carro. Um arquivo inexistente retorna nil, e o carro cria um novo perfil.
+func LerPerfilCarro(filePath string) (*consts.PerfilCarro, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o perfil do carro: %v", err)
+	}
+	var perfil consts.PerfilCarro
+	if err := json.Unmarshal(data, &perfil); err != nil {
+		return nil, fmt.Errorf("erro ao desserializar o perfil do carro: %v", err)
+	}
+	if perfil.ID == "" {
+		return nil, fmt.Errorf("perfil do carro sem id: %s", filePath)
+	}
+	return &perfil, nil
+}
+
+// Grava o perfil em um arquivo temporário e o renomeia, para não deixar um perfil
+// corrompido se o carro cair no meio da escrita
+func SalvarPerfilCarro(filePath string, perfil consts.PerfilCarro) error {
+	data, err := json.MarshalIndent(perfil, "", "  ")
+	if err != nil {
+		return fmt.Errorf("erro ao serializar o perfil do carro: %v", err)
+	}
+	temporario := filePath + ".tmp"
+	if err := os.WriteFile(temporario, data, 0644); err != nil {
+		return fmt.Errorf("erro ao salvar o perfil do carro: %v", err)
+	}
+	return os.Rename(temporario, filePath)
+}
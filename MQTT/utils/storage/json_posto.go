@@ -70,7 +70,8 @@ func AtualizarArquivo(filePath string, postos []*consts.Posto) error {
 }
 
 
-func GetPostosDisponiveis(arquivoPontos string) ([]*consts.Posto, error) {
+// Postos com vaga na fila de algum conector, considerando a profundidade de fila do servidor
+func GetPostosDisponiveis(arquivoPontos string, profundidadeFila int) ([]*consts.Posto, error) {
 	postos, err := GetPostosFromJSON(arquivoPontos)
 	if err != nil {
 		return nil, err
@@ -78,7 +79,8 @@ func GetPostosDisponiveis(arquivoPontos string) ([]*consts.Posto, error) {
 
 	var postosDisponiveis []*consts.Posto
 	for _, posto := range postos {
-		if len(posto.Fila) == 0 { // Verifica se a fila está vazia
+		if posto.AceitaReservas(profundidadeFila) { // Verifica se há vaga em algum conector
+			posto.ProfundidadeFila = profundidadeFila
 			postosDisponiveis = append(postosDisponiveis, posto)
 		}
 	}
@@ -121,3 +123,17 @@ func CarregarPostos() []consts.Posto {
 	log.Printf("Servidor carregado com %d postos de %s\n", len(resultado), cidade)
 	return postos
 }
+
+// Lê os postos de uma cidade em um arquivo no formato {"<cidade>": [...]}, sem depender
+// de CIDADE. Usado pelo carro para desenhar o mapa de todas as cidades.
+func LerPostosDaCidade(arquivo string, cidade string) ([]consts.Posto, error) {
+	data, err := os.ReadFile(arquivo)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o arquivo JSON: %v", err)
+	}
+	var mapa map[string][]consts.Posto
+	if err := json.Unmarshal(data, &mapa); err != nil {
+		return nil, fmt.Errorf("erro ao desserializar o JSON: %v", err)
+	}
+	return mapa[cidade], nil
+}
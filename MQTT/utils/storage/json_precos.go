@@ -0,0 +1,20 @@
+package storage
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func LerRegrasPreco(filePath string) (consts.RegrasPreco, error) {
+	var regras consts.RegrasPreco
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return regras, fmt.Errorf("erro ao ler o arquivo de preços: %v", err)
+	}
+	if err := json.Unmarshal(data, &regras); err != nil {
+		return regras, fmt.Errorf("erro ao desserializar o arquivo de preços: %v", err)
+	}
+	return regras, nil
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	consts "MQTT/utils/Constantes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Lê as sessões de recarga salvas, indexadas pelo ID. Um arquivo inexistente equivale a nenhuma sessão.
+func LerSessoes(filePath string) (map[string]*consts.SessaoRecarga, error) {
+	sessoes := make(map[string]*consts.SessaoRecarga)
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return sessoes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o arquivo de sessões: %v", err)
+	}
+	if len(data) == 0 {
+		return sessoes, nil
+	}
+	if err := json.Unmarshal(data, &sessoes); err != nil {
+		return nil, fmt.Errorf("erro ao desserializar o arquivo de sessões: %v", err)
+	}
+	return sessoes, nil
+}
+
+func SalvarSessoes(filePath string, sessoes map[string]*consts.SessaoRecarga) error {
+	data, err := json.MarshalIndent(sessoes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("erro ao serializar sessões: %v", err)
+	}
+	return os.WriteFile(filePath, data, 0644)
+}